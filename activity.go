@@ -0,0 +1,94 @@
+package pino
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultActivityWindow = 60 * time.Minute
+
+// Modes for relaying joins, parts, quits, and nick changes
+const (
+	presenceFilterAll   = "all"
+	presenceFilterNone  = "none"
+	presenceFilterSmart = "smart"
+)
+
+// The activityTracker remembers when each nick last spoke in each channel, so that the "smart"
+// filter can hide joins, parts, quits, and nick changes of users who have just been idling.
+type activityTracker struct {
+	window time.Duration
+
+	mutex     sync.Mutex
+	lastSpoke map[string]map[string]time.Time
+	lastPrune time.Time
+}
+
+func newActivityTracker(window time.Duration) *activityTracker {
+	if window <= 0 {
+		window = defaultActivityWindow
+	}
+
+	return &activityTracker{
+		window:    window,
+		lastSpoke: make(map[string]map[string]time.Time),
+		lastPrune: time.Now(),
+	}
+}
+
+// Called whenever someone says something in a channel
+func (tracker *activityTracker) recordMessage(channel IRCChannel, nick string) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	channelKey := strings.ToLower(string(channel))
+	nicks, ok := tracker.lastSpoke[channelKey]
+	if !ok {
+		nicks = make(map[string]time.Time)
+		tracker.lastSpoke[channelKey] = nicks
+	}
+	nicks[strings.ToLower(nick)] = time.Now()
+
+	if time.Since(tracker.lastPrune) > tracker.window {
+		tracker.prune()
+	}
+}
+
+// Whether the nick has spoken in the channel within the window
+func (tracker *activityTracker) isActive(channel IRCChannel, nick string) bool {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	lastSpoke, ok := tracker.lastSpoke[strings.ToLower(string(channel))][strings.ToLower(nick)]
+	return ok && time.Since(lastSpoke) <= tracker.window
+}
+
+// Carries a user's activity over to their new nick
+func (tracker *activityTracker) renameNick(oldNick string, newNick string) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	oldKey := strings.ToLower(oldNick)
+	for _, nicks := range tracker.lastSpoke {
+		if lastSpoke, ok := nicks[oldKey]; ok {
+			delete(nicks, oldKey)
+			nicks[strings.ToLower(newNick)] = lastSpoke
+		}
+	}
+}
+
+// Forgets everyone who hasn't spoken within the window. The caller must hold the mutex.
+func (tracker *activityTracker) prune() {
+	for channel, nicks := range tracker.lastSpoke {
+		for nick, lastSpoke := range nicks {
+			if time.Since(lastSpoke) > tracker.window {
+				delete(nicks, nick)
+			}
+		}
+		if len(nicks) == 0 {
+			delete(tracker.lastSpoke, channel)
+		}
+	}
+	tracker.lastPrune = time.Now()
+}
@@ -0,0 +1,97 @@
+package pino
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultAwayAutoReplyInterval = 60 * time.Minute
+
+// The awayAutoReplier remembers who we've auto-replied to, so each nick
+// gets at most one reply per interval no matter how much they message us.
+type awayAutoReplier struct {
+	interval time.Duration
+
+	mutex     sync.Mutex
+	lastReply map[string]time.Time
+}
+
+func newAwayAutoReplier(interval time.Duration) *awayAutoReplier {
+	if interval <= 0 {
+		interval = defaultAwayAutoReplyInterval
+	}
+
+	return &awayAutoReplier{
+		interval:  interval,
+		lastReply: make(map[string]time.Time),
+	}
+}
+
+// Whether the nick is due a reply. If so, it won't be again until the interval has passed.
+func (replier *awayAutoReplier) shouldReply(nick string) bool {
+	key := strings.ToLower(nick)
+	now := time.Now()
+
+	replier.mutex.Lock()
+	defer replier.mutex.Unlock()
+
+	if last, ok := replier.lastReply[key]; ok && now.Sub(last) < replier.interval {
+		return false
+	}
+	replier.lastReply[key] = now
+
+	// Nobody who replied long enough ago needs remembering
+	for otherNick, last := range replier.lastReply {
+		if now.Sub(last) >= replier.interval {
+			delete(replier.lastReply, otherNick)
+		}
+	}
+
+	return true
+}
+
+// Forgets everyone we've replied to, so the next time the owner is away they'll hear from us again
+func (replier *awayAutoReplier) reset() {
+	replier.mutex.Lock()
+	defer replier.mutex.Unlock()
+
+	replier.lastReply = make(map[string]time.Time)
+}
+
+// Marks us away on every IRC network while the owner is away on Slack, and back when they return
+func (pino *Pino) syncAway() {
+	for _, network := range pino.networks {
+		pino.syncNetworkAway(network)
+	}
+}
+
+func (pino *Pino) syncNetworkAway(network *ircNetwork) {
+	if !pino.config.Away.Enabled {
+		return
+	}
+
+	if pino.presence.isOwnerActive() {
+		network.proxy.setAway("")
+		network.awayReplies.reset()
+		return
+	}
+
+	data := &messageTemplateData{Reason: pino.presence.getStatusText()}
+	network.proxy.setAway(pino.templates.render("away", data))
+}
+
+// Lets someone who messaged us privately know that the owner isn't around
+func (pino *Pino) replyWhileAway(network *ircNetwork, nick string) {
+	away := pino.config.Away
+	if !away.Enabled || !away.AutoReply || nick == "" || pino.presence.isOwnerActive() {
+		return
+	}
+
+	if !network.awayReplies.shouldReply(nick) {
+		return
+	}
+
+	data := &messageTemplateData{Nick: nick, Reason: pino.presence.getStatusText()}
+	network.proxy.sendNotice(nick, pino.templates.render("away-reply", data))
+}
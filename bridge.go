@@ -0,0 +1,189 @@
+package pino
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Which way a bridge relays messages
+const (
+	bridgeDirectionBoth       = "both"
+	bridgeDirectionIRCToSlack = "irc-to-slack"
+	bridgeDirectionSlackToIRC = "slack-to-irc"
+)
+
+const slackQuotePrefix = "> "
+
+// The IRC events that a bridge can choose whether to show on Slack
+var bridgeEventTypes = map[string]bool{
+	"join":  true,
+	"part":  true,
+	"quit":  true,
+	"mode":  true,
+	"nick":  true,
+	"topic": true,
+	"kick":  true,
+}
+
+// A Slack channel and the IRC channel it's bridged with, along with the settings for the pair
+type bridge struct {
+	slack          *slackProxy
+	slackChannel   SlackChannel
+	network        *ircNetwork
+	ircChannel     IRCChannel
+	config         *BridgeConfig
+	events         map[string]bool
+	highlightRules []*ircHighlightRule
+	templates      messageTemplates
+	// Whether the Slack channel is bridged with other IRC channels too, without threads to tell them apart
+	isMerged bool
+	// Only set for Threaded bridges
+	threads *slackThreadTracker
+}
+
+func newBridge(slack *slackProxy, slackChannel SlackChannel, network *ircNetwork, config *BridgeConfig, globalTemplates map[string]string) (*bridge, error) {
+	bridge := &bridge{
+		slack:          slack,
+		slackChannel:   slackChannel,
+		network:        network,
+		ircChannel:     config.IRCChannel,
+		config:         config,
+		events:         make(map[string]bool),
+		highlightRules: network.proxy.highlightRules,
+	}
+
+	events := config.Events
+	if len(events) == 0 {
+		for event := range bridgeEventTypes {
+			events = append(events, event)
+		}
+	}
+	for _, event := range events {
+		bridge.events[event] = true
+	}
+
+	if len(config.HighlightRules) > 0 {
+		rules, err := compileHighlightRules(config.HighlightRules)
+		if err != nil {
+			return nil, err
+		}
+		bridge.highlightRules = rules
+	}
+
+	templates, err := newMessageTemplates(globalTemplates, config.Templates)
+	if err != nil {
+		return nil, err
+	}
+	bridge.templates = templates
+
+	return bridge, nil
+}
+
+func (bridge *bridge) relaysToSlack() bool {
+	return bridge.config.Direction != bridgeDirectionSlackToIRC
+}
+
+func (bridge *bridge) relaysToIRC() bool {
+	return bridge.config.Direction != bridgeDirectionIRCToSlack
+}
+
+// Whether this kind of IRC event (like "join") should be shown on Slack
+func (bridge *bridge) showsEvent(event string) bool {
+	return bridge.relaysToSlack() && bridge.events[event]
+}
+
+// What to do with lines from a ZNC buffer playback
+func (bridge *bridge) playbackMode() string {
+	if bridge.config.Playback == "" {
+		return playbackModeDrop
+	}
+	return bridge.config.Playback
+}
+
+// How IRC formatting codes are shown on Slack
+func (bridge *bridge) formattingMode() string {
+	if bridge.config.Formatting == "" {
+		return formattingConvert
+	}
+	return bridge.config.Formatting
+}
+
+// Converts IRC formatting codes in text according to the bridge's formatting mode
+func (bridge *bridge) formatForSlack(text string) string {
+	return formatIRCTextForSlack(text, bridge.formattingMode())
+}
+
+// Renders the bridge's template for a message in its Slack channel, saying which IRC channel
+// it's about if the Slack channel is merged
+func (bridge *bridge) render(name string, data *messageTemplateData) string {
+	text := bridge.templates.render(name, data)
+	if !bridge.isMerged {
+		return text
+	}
+
+	prefix := bridge.templates.render("channel-prefix", &messageTemplateData{Network: bridge.network.name, Channel: bridge.ircChannel})
+	// Slack only takes a quote as a quote if it starts the message
+	if strings.HasPrefix(text, slackQuotePrefix) {
+		return slackQuotePrefix + prefix + strings.TrimPrefix(text, slackQuotePrefix)
+	}
+	return prefix + text
+}
+
+// Renders the bridge's template for a DM to the owner, which doesn't need the channel prefix
+func (bridge *bridge) renderForOwner(name string, data *messageTemplateData) string {
+	return bridge.templates.render(name, data)
+}
+
+// Identifies the bridge among the threads, like "partner/#caa rizon/#caa"
+func (bridge *bridge) threadKey() string {
+	slackChannel := joinWorkspaceAndSlackChannel(bridge.slack.name, bridge.slackChannel)
+	return fmt.Sprintf("%v %v", slackChannel, describeBridgedIRCChannel(bridge.network.name, ircChannelKey(bridge.ircChannel)))
+}
+
+// Posts in the bridge's Slack channel as the bot, or in today's thread if the bridge is Threaded
+func (bridge *bridge) sendMessageAsBot(text string) {
+	if bridge.threads == nil {
+		bridge.slack.sendMessageAsBot(bridge.slackChannel, text)
+		return
+	}
+
+	bridge.threads.post(bridge, func(threadTimestamp string) {
+		bridge.slack.replyInThreadAsBot(bridge.slackChannel, threadTimestamp, text)
+	})
+}
+
+// Posts in the bridge's Slack channel as an IRC user, or in today's thread if the bridge is Threaded
+func (bridge *bridge) sendMessageAsUser(username string, text string) {
+	bridge.relayMessageAsUser(username, text, false, nil)
+}
+
+// Like sendMessageAsUser, but coalesced with the user's previous lines if coalesce is set and the
+// channel has coalescing enabled. If onDelivered isn't nil, it's called with the timestamp of the
+// Slack message that holds the text, and of its thread if it's in one.
+func (bridge *bridge) relayMessageAsUser(username string, text string, coalesce bool, onDelivered func(timestamp string, threadTimestamp string)) {
+	if bridge.threads != nil {
+		bridge.threads.post(bridge, func(threadTimestamp string) {
+			var onReplied func(timestamp string)
+			if onDelivered != nil {
+				onReplied = func(timestamp string) { onDelivered(timestamp, threadTimestamp) }
+			}
+			bridge.slack.replyInThreadAsUserWithCallback(bridge.slackChannel, threadTimestamp, username, text, onReplied)
+		})
+		return
+	}
+
+	var onPosted func(timestamp string)
+	if onDelivered != nil {
+		onPosted = func(timestamp string) { onDelivered(timestamp, "") }
+	}
+	if coalesce {
+		bridge.slack.sendCoalescedMessageAsUser(bridge.slackChannel, username, text, onPosted)
+	} else {
+		bridge.slack.sendMessageAsUserWithCallback(bridge.slackChannel, username, text, onPosted)
+	}
+}
+
+// IRC channel names are case insensitive, so bridges are looked up by the lowercase name
+func ircChannelKey(channel IRCChannel) IRCChannel {
+	return IRCChannel(strings.ToLower(string(channel)))
+}
@@ -0,0 +1,281 @@
+package pino
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often old logs are checked for deletion
+const chatLogRetentionCheckInterval = time.Hour
+
+// The kinds of chatLogEntry
+const (
+	chatLogMessage = "message"
+	chatLogAction  = "action"
+	chatLogNotice  = "notice"
+	chatLogJoin    = "join"
+	chatLogPart    = "part"
+	chatLogQuit    = "quit"
+	chatLogKick    = "kick"
+	chatLogMode    = "mode"
+	chatLogNick    = "nick"
+	chatLogTopic   = "topic"
+)
+
+// A single line of a chat log. Fields that don't apply to the kind of entry are empty.
+type chatLogEntry struct {
+	Time     time.Time  `json:"time"`
+	Network  string     `json:"network"`
+	Channel  IRCChannel `json:"channel"`
+	Kind     string     `json:"kind"`
+	Nick     string     `json:"nick,omitempty"`
+	Usermask string     `json:"usermask,omitempty"`
+	// Who was kicked, or what a mode was set on
+	Target string `json:"target,omitempty"`
+	// The new nick, or the mode that was set
+	Value string `json:"value,omitempty"`
+	// The message, or the reason for a part, quit, or kick
+	Text string `json:"text,omitempty"`
+}
+
+// The chatLogger writes everything said in our IRC channels to disk, in one file per
+// network, channel, and day, like ZNC's log module: <Directory>/<network>/<channel>/2016-10-18.log
+type chatLogger struct {
+	config *ChatLogConfig
+
+	mutex sync.Mutex
+	// Open files, by path
+	files map[string]*chatLogFile
+}
+
+type chatLogFile struct {
+	file *os.File
+	size int64
+}
+
+func newChatLogger(config *ChatLogConfig) *chatLogger {
+	logger := &chatLogger{
+		config: config,
+		files:  make(map[string]*chatLogFile),
+	}
+
+	if config.Directory != "" && config.RetentionDays > 0 {
+		go logger.deleteOldLogsRegularly()
+	}
+
+	return logger
+}
+
+// The server's host name, without the port
+func ircNetworkName(config *IRCConfig) string {
+	host, _, err := net.SplitHostPort(config.Server)
+	if err != nil {
+		return config.Server
+	}
+	return host
+}
+
+func (logger *chatLogger) log(network *ircNetwork, entry *chatLogEntry) {
+	if logger.config.Directory == "" {
+		return
+	}
+	entry.Network = network.displayName()
+
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+
+	base := logger.basePath(entry)
+	logger.write(base+".log", formatChatLogLine(entry)+"\n")
+
+	if logger.config.JSON {
+		encoded, err := json.Marshal(entry)
+		if err != nil {
+			fmt.Printf("Could not encode chat log entry: %v\n", err)
+			return
+		}
+		logger.write(base+".jsonl", string(encoded)+"\n")
+	}
+}
+
+// The path of the entry's log file, without the extension
+func (logger *chatLogger) basePath(entry *chatLogEntry) string {
+	day := entry.Time.Local().Format("2006-01-02")
+	return filepath.Join(logger.config.Directory, sanitizeChatLogPathPart(entry.Network), sanitizeChatLogPathPart(string(entry.Channel)), day)
+}
+
+// Channel and network names can't be trusted to make good paths
+func sanitizeChatLogPathPart(part string) string {
+	part = strings.ToLower(part)
+	part = strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', 0:
+			return '_'
+		}
+		return r
+	}, part)
+
+	if part == "" || part == "." || part == ".." {
+		return "_"
+	}
+	return part
+}
+
+// Appends text to the file, rotating it first if it's grown too big. The caller must hold the mutex.
+func (logger *chatLogger) write(path string, text string) {
+	logFile, err := logger.open(path)
+	if err != nil {
+		fmt.Printf("Could not open chat log %v: %v\n", path, err)
+		return
+	}
+
+	maxSize := int64(logger.config.MaxFileSizeMB) * 1024 * 1024
+	if maxSize > 0 && logFile.size > 0 && logFile.size+int64(len(text)) > maxSize {
+		logger.rotate(path)
+		if logFile, err = logger.open(path); err != nil {
+			fmt.Printf("Could not open chat log %v: %v\n", path, err)
+			return
+		}
+	}
+
+	n, err := logFile.file.WriteString(text)
+	logFile.size += int64(n)
+	if err != nil {
+		fmt.Printf("Could not write to chat log %v: %v\n", path, err)
+	}
+}
+
+// The caller must hold the mutex
+func (logger *chatLogger) open(path string) (*chatLogFile, error) {
+	if logFile, ok := logger.files[path]; ok {
+		return logFile, nil
+	}
+
+	// Only one day's files are written at a time, so close the rest
+	day := filepath.Base(path)[:len("2006-01-02")]
+	for openPath, logFile := range logger.files {
+		if filepath.Dir(openPath) == filepath.Dir(path) && !strings.HasPrefix(filepath.Base(openPath), day) {
+			logFile.file.Close()
+			delete(logger.files, openPath)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	logFile := &chatLogFile{file: file, size: info.Size()}
+	logger.files[path] = logFile
+	return logFile, nil
+}
+
+// Moves a full log aside, to the first free name like 2016-10-18.1.log.
+// The caller must hold the mutex.
+func (logger *chatLogger) rotate(path string) {
+	if logFile, ok := logger.files[path]; ok {
+		logFile.file.Close()
+		delete(logger.files, path)
+	}
+
+	extension := filepath.Ext(path)
+	base := strings.TrimSuffix(path, extension)
+	for i := 1; ; i++ {
+		rotatedPath := fmt.Sprintf("%v.%v%v", base, i, extension)
+		if _, err := os.Stat(rotatedPath); os.IsNotExist(err) {
+			if err := os.Rename(path, rotatedPath); err != nil {
+				fmt.Printf("Could not rotate chat log %v: %v\n", path, err)
+			}
+			return
+		}
+	}
+}
+
+func (logger *chatLogger) deleteOldLogsRegularly() {
+	logger.deleteOldLogs()
+	for range time.Tick(chatLogRetentionCheckInterval) {
+		logger.deleteOldLogs()
+	}
+}
+
+// Deletes logs that haven't been written to in RetentionDays. Anything else in the Directory is left alone.
+func (logger *chatLogger) deleteOldLogs() {
+	cutoff := time.Now().AddDate(0, 0, -logger.config.RetentionDays)
+
+	filepath.Walk(logger.config.Directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !info.ModTime().Before(cutoff) {
+			return nil
+		}
+		if extension := filepath.Ext(path); extension != ".log" && extension != ".jsonl" {
+			return nil
+		}
+
+		logger.mutex.Lock()
+		if logFile, ok := logger.files[path]; ok {
+			logFile.file.Close()
+			delete(logger.files, path)
+		}
+		logger.mutex.Unlock()
+
+		if err := os.Remove(path); err != nil {
+			fmt.Printf("Could not delete old chat log %v: %v\n", path, err)
+		}
+		return nil
+	})
+}
+
+// Formats an entry like irssi and ZNC do, like "[15:04:05] <nick> hello"
+func formatChatLogLine(entry *chatLogEntry) string {
+	timestamp := entry.Time.Local().Format("[15:04:05]")
+
+	var text string
+	switch entry.Kind {
+	case chatLogMessage:
+		text = fmt.Sprintf("<%v> %v", entry.Nick, entry.Text)
+	case chatLogAction:
+		text = fmt.Sprintf("* %v %v", entry.Nick, entry.Text)
+	case chatLogNotice:
+		text = fmt.Sprintf("-%v- %v", entry.Nick, entry.Text)
+	case chatLogJoin:
+		text = fmt.Sprintf("*** Joins: %v (%v)", entry.Nick, chatLogUserhost(entry))
+	case chatLogPart:
+		text = fmt.Sprintf("*** Parts: %v (%v) (%v)", entry.Nick, chatLogUserhost(entry), entry.Text)
+	case chatLogQuit:
+		text = fmt.Sprintf("*** Quits: %v (%v) (%v)", entry.Nick, chatLogUserhost(entry), entry.Text)
+	case chatLogKick:
+		text = fmt.Sprintf("*** %v was kicked by %v (%v)", entry.Target, entry.Nick, entry.Text)
+	case chatLogMode:
+		text = fmt.Sprintf("*** %v sets mode: %v %v", entry.Nick, entry.Value, entry.Target)
+	case chatLogNick:
+		text = fmt.Sprintf("*** %v is now known as %v", entry.Nick, entry.Value)
+	case chatLogTopic:
+		text = fmt.Sprintf("*** %v changes topic to '%v'", entry.Nick, entry.Text)
+	default:
+		text = entry.Text
+	}
+
+	return timestamp + " " + text
+}
+
+// The user@host part of a nick!user@host
+func chatLogUserhost(entry *chatLogEntry) string {
+	if i := strings.Index(entry.Usermask, "!"); i >= 0 {
+		return entry.Usermask[i+1:]
+	}
+	return entry.Usermask
+}
@@ -0,0 +1,142 @@
+package pino
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestChatLogger(t *testing.T, config *ChatLogConfig) (*chatLogger, func()) {
+	directory, err := ioutil.TempDir("", "pino-chatlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.Directory = directory
+	logger := &chatLogger{config: config, files: make(map[string]*chatLogFile)}
+	return logger, func() {
+		for _, logFile := range logger.files {
+			logFile.file.Close()
+		}
+		os.RemoveAll(directory)
+	}
+}
+
+// The files under the directory, relative to it, in order
+func listChatLogs(t *testing.T, directory string) string {
+	var paths []string
+	filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.IsDir() {
+			relative, _ := filepath.Rel(directory, path)
+			paths = append(paths, filepath.ToSlash(relative))
+		}
+		return nil
+	})
+	sort.Strings(paths)
+	return strings.Join(paths, " ")
+}
+
+func TestChatLoggerRotate(t *testing.T) {
+	logger, cleanUp := newTestChatLogger(t, &ChatLogConfig{})
+	defer cleanUp()
+
+	path := filepath.Join(logger.config.Directory, "net", "#go", "2016-10-18.log")
+	for _, text := range []string{"first\n", "second\n", "third\n"} {
+		logger.write(path, text)
+		logger.rotate(path)
+	}
+
+	// Each rotation takes the next free number
+	expected := "net/#go/2016-10-18.1.log net/#go/2016-10-18.2.log net/#go/2016-10-18.3.log"
+	if logs := listChatLogs(t, logger.config.Directory); logs != expected {
+		t.Errorf("Expected %v, got %v", expected, logs)
+	}
+	if len(logger.files) != 0 {
+		t.Errorf("Expected the rotated files to be closed, got %v open", len(logger.files))
+	}
+
+	contents, err := ioutil.ReadFile(filepath.Join(logger.config.Directory, "net", "#go", "2016-10-18.2.log"))
+	if err != nil || string(contents) != "second\n" {
+		t.Errorf("Expected the second rotated file to have the second line, got %q, %v", contents, err)
+	}
+}
+
+func TestChatLoggerOpenClosesPreviousDays(t *testing.T) {
+	logger, cleanUp := newTestChatLogger(t, &ChatLogConfig{})
+	defer cleanUp()
+
+	channel := filepath.Join(logger.config.Directory, "net", "#go")
+	other := filepath.Join(logger.config.Directory, "net", "#other")
+	for _, path := range []string{
+		filepath.Join(channel, "2016-10-18.log"),
+		filepath.Join(channel, "2016-10-18.jsonl"),
+		filepath.Join(other, "2016-10-18.log"),
+		filepath.Join(channel, "2016-10-19.log"),
+	} {
+		if _, err := logger.open(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the channel that moved on to a new day closes its old files
+	var open []string
+	for path := range logger.files {
+		relative, _ := filepath.Rel(logger.config.Directory, path)
+		open = append(open, filepath.ToSlash(relative))
+	}
+	sort.Strings(open)
+	if expected := "net/#go/2016-10-19.log net/#other/2016-10-18.log"; strings.Join(open, " ") != expected {
+		t.Errorf("Expected %v to be open, got %v", expected, open)
+	}
+}
+
+func TestChatLoggerDeleteOldLogs(t *testing.T) {
+	logger, cleanUp := newTestChatLogger(t, &ChatLogConfig{RetentionDays: 7})
+	defer cleanUp()
+
+	channel := filepath.Join(logger.config.Directory, "net", "#go")
+	if err := os.MkdirAll(channel, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().AddDate(0, 0, -8)
+	files := map[string]time.Time{
+		"2016-10-01.log":   old,
+		"2016-10-01.1.log": old,
+		"2016-10-01.jsonl": old,
+		// Not ours to delete
+		"notes.txt": old,
+		// Still recent enough
+		"2016-10-18.log": time.Now().AddDate(0, 0, -6),
+	}
+	for name, modified := range files {
+		path := filepath.Join(channel, name)
+		if err := ioutil.WriteFile(path, []byte("hello\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// An open file that's deleted is closed, so it's reopened on the next write
+	if _, err := logger.open(filepath.Join(channel, "2016-10-01.log")); err != nil {
+		t.Fatal(err)
+	}
+
+	logger.deleteOldLogs()
+
+	if logs, expected := listChatLogs(t, logger.config.Directory), "net/#go/2016-10-18.log net/#go/notes.txt"; logs != expected {
+		t.Errorf("Expected %v to be left, got %v", expected, logs)
+	}
+	if len(logger.files) != 0 {
+		t.Errorf("Expected the deleted file to be closed, got %v open", len(logger.files))
+	}
+}
@@ -0,0 +1,203 @@
+package pino
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Once a coalesced message gets this long, further lines start a new Slack message
+	maxCoalescedMessageLength = 3000
+	// How long after its first line a coalesced message can still have lines added to it
+	coalescedMessageEditWindow = time.Minute
+)
+
+// The ircLineCoalescer merges bursts of lines from the same IRC user into a single Slack message.
+// The first line is posted right away. Lines the sender adds within the channel's window of their
+// previous one are appended by editing the posted message, for up to coalescedMessageEditWindow.
+// Edits to a message go out at most once per window, so a burst of lines only costs a few of them.
+type ircLineCoalescer struct {
+	proxy   *slackProxy
+	windows map[SlackChannel]time.Duration
+
+	mutex    sync.Mutex
+	messages map[SlackChannel]*coalescedMessage
+}
+
+type coalescedMessage struct {
+	channel  SlackChannel
+	username string
+	lines    []string
+	length   int
+	started  time.Time
+	lastLine time.Time
+
+	// How many of the lines have been sent to Slack so far
+	sentLines int
+	// Set once the message has been posted and Slack has told us its timestamp
+	timestamp string
+	// Set if Slack never took the message, so there's nothing to edit
+	failed bool
+	// When the message was last posted or edited, and the timer for the next edit, if one is due
+	lastSent    time.Time
+	updateTimer *time.Timer
+	// Waiting for the timestamp of the posted message
+	callbacks []*coalescedCallback
+}
+
+// An onDelivered callback for one of the lines of a coalesced message
+type coalescedCallback struct {
+	line        int
+	onDelivered func(timestamp string)
+}
+
+func newIRCLineCoalescer(proxy *slackProxy, windowsInMilliseconds map[SlackChannel]int) *ircLineCoalescer {
+	coalescer := &ircLineCoalescer{
+		proxy:    proxy,
+		windows:  make(map[SlackChannel]time.Duration),
+		messages: make(map[SlackChannel]*coalescedMessage),
+	}
+
+	for channel, milliseconds := range windowsInMilliseconds {
+		if milliseconds > 0 {
+			coalescer.windows[channel] = time.Duration(milliseconds) * time.Millisecond
+		}
+	}
+
+	return coalescer
+}
+
+// Sends a line from an IRC user to Slack, merging it with that user's previous lines if possible.
+// Returns false if coalescing isn't enabled for the channel, in which case nothing was sent.
+// If onDelivered isn't nil, it's called with the timestamp of the Slack message the line ended up in.
+func (coalescer *ircLineCoalescer) add(channel SlackChannel, username string, text string, onDelivered func(timestamp string)) bool {
+	window, ok := coalescer.windows[channel]
+	if !ok {
+		return false
+	}
+
+	coalescer.mutex.Lock()
+	defer coalescer.mutex.Unlock()
+
+	now := time.Now()
+	message := coalescer.messages[channel]
+
+	canAppend := message != nil &&
+		!message.failed &&
+		message.username == username &&
+		now.Sub(message.lastLine) <= window &&
+		now.Sub(message.started) <= coalescedMessageEditWindow &&
+		message.length+len(text) <= maxCoalescedMessageLength
+
+	if !canAppend {
+		message = &coalescedMessage{channel: channel, username: username, started: now}
+		coalescer.messages[channel] = message
+	}
+
+	message.lines = append(message.lines, text)
+	message.length += len(text) + 1
+	message.lastLine = now
+
+	if onDelivered != nil {
+		if message.timestamp != "" {
+			go onDelivered(message.timestamp)
+		} else {
+			message.callbacks = append(message.callbacks, &coalescedCallback{line: len(message.lines) - 1, onDelivered: onDelivered})
+		}
+	}
+
+	if canAppend {
+		coalescer.scheduleUpdate(message)
+	} else {
+		coalescer.post(message)
+	}
+
+	return true
+}
+
+// Posts the message's lines as a new Slack message. The caller must hold the mutex.
+func (coalescer *ircLineCoalescer) post(message *coalescedMessage) {
+	message.sentLines = len(message.lines)
+	message.lastSent = time.Now()
+
+	text := strings.Join(message.lines, "\n")
+	coalescer.proxy.sendMessageAsUserWithCallback(message.channel, message.username, text, func(timestamp string) {
+		coalescer.posted(message, timestamp)
+	})
+}
+
+// Called once Slack has posted the message, or with an empty timestamp if it couldn't
+func (coalescer *ircLineCoalescer) posted(message *coalescedMessage, timestamp string) {
+	coalescer.mutex.Lock()
+
+	callbacks := message.callbacks
+	message.callbacks = nil
+	var delivered []*coalescedCallback
+
+	if timestamp != "" {
+		message.timestamp = timestamp
+		delivered = callbacks
+		// Lines that came in while the post was on its way still need to be added
+		coalescer.scheduleUpdate(message)
+	} else {
+		message.failed = true
+		for _, callback := range callbacks {
+			if callback.line < message.sentLines {
+				delivered = append(delivered, callback)
+			}
+		}
+
+		// Lines added since then go out as a message of their own
+		if message.sentLines < len(message.lines) {
+			retry := &coalescedMessage{
+				channel:  message.channel,
+				username: message.username,
+				lines:    message.lines[message.sentLines:],
+				started:  time.Now(),
+				lastLine: message.lastLine,
+			}
+			for _, line := range retry.lines {
+				retry.length += len(line) + 1
+			}
+			for _, callback := range callbacks {
+				if callback.line >= message.sentLines {
+					retry.callbacks = append(retry.callbacks, &coalescedCallback{line: callback.line - message.sentLines, onDelivered: callback.onDelivered})
+				}
+			}
+
+			if coalescer.messages[message.channel] == message {
+				coalescer.messages[message.channel] = retry
+			}
+			coalescer.post(retry)
+		}
+	}
+	coalescer.mutex.Unlock()
+
+	for _, callback := range delivered {
+		callback.onDelivered(timestamp)
+	}
+}
+
+// Edits the posted message to hold any lines added since it was last sent, once a window has
+// passed since then. The caller must hold the mutex.
+func (coalescer *ircLineCoalescer) scheduleUpdate(message *coalescedMessage) {
+	if message.timestamp == "" || message.updateTimer != nil || message.sentLines == len(message.lines) {
+		return
+	}
+
+	wait := coalescer.windows[message.channel] - time.Since(message.lastSent)
+	if wait < 0 {
+		wait = 0
+	}
+
+	message.updateTimer = time.AfterFunc(wait, func() {
+		coalescer.mutex.Lock()
+		defer coalescer.mutex.Unlock()
+
+		message.updateTimer = nil
+		message.sentLines = len(message.lines)
+		message.lastSent = time.Now()
+		coalescer.proxy.updateMessage(message.channel, message.timestamp, strings.Join(message.lines, "\n"))
+	})
+}
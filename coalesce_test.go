@@ -0,0 +1,103 @@
+package pino
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestLineCoalescer(t *testing.T, api *fakeSlackMessageAPI, window time.Duration) *ircLineCoalescer {
+	proxy := &slackProxy{
+		channelNameToID: map[SlackChannel]string{"#chat": "C1"},
+		dispatcher:      newTestSlackDispatcher(t, api, 10),
+	}
+	proxy.coalescer = newIRCLineCoalescer(proxy, map[SlackChannel]int{"#chat": int(window / time.Millisecond)})
+	return proxy.coalescer
+}
+
+func waitForSlackUpdates(t *testing.T, api *fakeSlackMessageAPI, count int) []string {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		api.mutex.Lock()
+		updated := append([]string(nil), api.updated...)
+		api.mutex.Unlock()
+		if len(updated) >= count {
+			return updated
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatalf("Timed out waiting for %v updates", count)
+	return nil
+}
+
+func TestCoalescerPostsFirstLineThenEdits(t *testing.T) {
+	api := newFakeSlackMessageAPI()
+	coalescer := newTestLineCoalescer(t, api, 200*time.Millisecond)
+
+	delivered := make(chan string, 3)
+	onDelivered := func(timestamp string) { delivered <- timestamp }
+
+	coalescer.add("#chat", "alice", "one", onDelivered)
+	// The first line doesn't wait for the window
+	expectSlackPosts(t, waitForSlackPosts(t, api, 1), []string{"one"})
+
+	coalescer.add("#chat", "alice", "two", onDelivered)
+	coalescer.add("#chat", "alice", "three", onDelivered)
+
+	// Both lines go out in a single edit
+	waitForSlackUpdates(t, api, 1)
+	time.Sleep(300 * time.Millisecond)
+	api.mutex.Lock()
+	updated := append([]string(nil), api.updated...)
+	api.mutex.Unlock()
+	if len(updated) != 1 || updated[0] != "1.000 one\ntwo\nthree" {
+		t.Errorf("Expected one edit with every line, got %q", updated)
+	}
+	expectSlackPosts(t, api.postedMessages(), []string{"one"})
+
+	for i := 0; i < 3; i++ {
+		if timestamp := <-delivered; timestamp != "1.000" {
+			t.Errorf("Expected every line to be delivered in 1.000, got %v", timestamp)
+		}
+	}
+}
+
+func TestCoalescerStartsNewMessages(t *testing.T) {
+	api := newFakeSlackMessageAPI()
+	coalescer := newTestLineCoalescer(t, api, 50*time.Millisecond)
+
+	coalescer.add("#chat", "alice", "one", nil)
+	waitForSlackPosts(t, api, 1)
+
+	// Someone else speaking starts a new message
+	coalescer.add("#chat", "bob", "two", nil)
+	waitForSlackPosts(t, api, 2)
+
+	// So does a line after the window
+	time.Sleep(100 * time.Millisecond)
+	coalescer.add("#chat", "bob", "three", nil)
+
+	expectSlackPosts(t, waitForSlackPosts(t, api, 3), []string{"one", "two", "three"})
+}
+
+func TestCoalescerPostsSeparatelyWhenTheFirstPostFails(t *testing.T) {
+	api := newFakeSlackMessageAPI()
+	api.failures["one"] = []error{errors.New("channel_not_found")}
+	api.blocked = make(chan bool)
+	coalescer := newTestLineCoalescer(t, api, time.Second)
+
+	delivered := make(chan string, 2)
+	coalescer.add("#chat", "alice", "one", func(timestamp string) { delivered <- "one " + timestamp })
+	coalescer.add("#chat", "alice", "two", func(timestamp string) { delivered <- "two " + timestamp })
+
+	api.mutex.Lock()
+	close(api.blocked)
+	api.blocked = nil
+	api.mutex.Unlock()
+
+	expectSlackPosts(t, waitForSlackPosts(t, api, 1), []string{"two"})
+	if first, second := <-delivered, <-delivered; first != "one " || second != "two 1.000" {
+		t.Errorf("Unexpected deliveries: %q, %q", first, second)
+	}
+}
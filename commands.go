@@ -0,0 +1,186 @@
+package pino
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+// History results longer than this are uploaded as a file instead of posted as a message
+const defaultMaxInlineHistoryResults = 20
+
+// A command the owner can send Pino in a Slack DM, like "history nick:alice kubernetes"
+type ownerCommand struct {
+	usage       string
+	description string
+	run         func(args []string)
+}
+
+func (pino *Pino) ownerCommands() map[string]*ownerCommand {
+	return map[string]*ownerCommand{
+		"help": {
+			usage:       "help",
+			description: "Lists the commands",
+			run:         pino.runHelpCommand,
+		},
+		"history": {
+			usage:       "history [nick:NICK] [network:NETWORK] [channel:#CHANNEL] [after:DATE] [before:DATE] [limit:N] [WORDS]",
+			description: "Searches what was said. Dates are like 2016-10-18, 2016-10-18T15:04, 12h, or 7d.",
+			run:         pino.runHistoryCommand,
+		},
+		"seen": {
+			usage:       "seen NICK",
+			description: "Shows when an IRC nick was last around, and what they were doing",
+			run:         pino.runSeenCommand,
+		},
+	}
+}
+
+// Handles a DM from the owner, which is always a command
+func (pino *Pino) handleOwnerCommand(text string) {
+	args := strings.Fields(text)
+	if len(args) == 0 {
+		return
+	}
+
+	name := strings.ToLower(args[0])
+	command, ok := pino.ownerCommands()[name]
+	if !ok {
+		pino.slackProxy.sendMessageToOwner(fmt.Sprintf("Unknown command: %v. Send \"help\" for a list of commands.", name))
+		return
+	}
+
+	fmt.Printf("Running owner command: %v\n", text)
+	command.run(args[1:])
+}
+
+func (pino *Pino) runHelpCommand(args []string) {
+	commands := pino.ownerCommands()
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := make([]string, len(names))
+	for i, name := range names {
+		lines[i] = fmt.Sprintf("`%v`: %v", encodeSlackHTMLEntities(commands[name].usage), commands[name].description)
+	}
+	pino.slackProxy.sendMessageToOwner(strings.Join(lines, "\n"))
+}
+
+func (pino *Pino) runHistoryCommand(args []string) {
+	query, err := parseMessageQuery(args, time.Now())
+	if err != nil {
+		pino.slackProxy.sendMessageToOwner(err.Error())
+		return
+	}
+
+	messages, hasMore, err := pino.messages.search(query)
+	if err != nil {
+		pino.slackProxy.sendMessageToOwner(fmt.Sprintf("Could not search history: %v", err))
+		return
+	}
+	if len(messages) == 0 {
+		pino.slackProxy.sendMessageToOwner("No messages found.")
+		return
+	}
+
+	lines := make([]string, len(messages))
+	for i, message := range messages {
+		lines[i] = formatStoredMessage(message)
+	}
+
+	summary := fmt.Sprintf("%v messages", len(messages))
+	if hasMore {
+		summary = fmt.Sprintf("The latest %v messages (use limit: to see more)", len(messages))
+	}
+
+	maxInline := pino.config.MessageStore.MaxInlineResults
+	if maxInline == 0 {
+		maxInline = defaultMaxInlineHistoryResults
+	}
+
+	if len(messages) <= maxInline {
+		text := fmt.Sprintf("%v:\n```\n%v\n```", summary, encodeSlackHTMLEntities(strings.Join(lines, "\n")))
+		pino.slackProxy.sendMessageToOwner(text)
+		return
+	}
+
+	filename := fmt.Sprintf("history-%v.txt", time.Now().Format("2006-01-02-150405"))
+	if err := pino.slackProxy.uploadFileToOwner(filename, summary, strings.Join(lines, "\n")+"\n"); err != nil {
+		pino.slackProxy.sendMessageToOwner(fmt.Sprintf("Could not upload history: %v", err))
+	}
+}
+
+func (pino *Pino) runSeenCommand(args []string) {
+	if len(args) != 1 {
+		pino.slackProxy.sendMessageToOwner("Usage: `seen NICK`")
+		return
+	}
+
+	var lines []string
+	for _, network := range pino.networks {
+		record := network.seen.lookup(args[0])
+		if record == nil {
+			continue
+		}
+
+		if network.name != "" {
+			lines = append(lines, fmt.Sprintf("On %v:", network.name))
+		}
+		lines = append(lines, record.details(time.Now())...)
+	}
+
+	if len(lines) == 0 {
+		pino.slackProxy.sendMessageToOwner(fmt.Sprintf("I haven't seen %v.", args[0]))
+		return
+	}
+	pino.slackProxy.sendMessageToOwner(encodeSlackHTMLEntities(strings.Join(lines, "\n")))
+}
+
+// Whether an IRC message is a "!seen nick" command, and who it asks about
+func parseIRCSeenCommand(text string) (string, bool) {
+	args := strings.Fields(text)
+	if len(args) != 2 || !strings.EqualFold(args[0], "!seen") {
+		return "", false
+	}
+	return args[1], true
+}
+
+// Answers "!seen nick" with a notice to wherever it was asked. It's only answered in bridged
+// channels and private messages, since other channels we're in didn't ask for a bot.
+func (pino *Pino) replyToIRCSeenCommand(network *ircNetwork, line *irc.Line, nick string) {
+	if strings.EqualFold(line.Nick, network.proxy.currentNick()) {
+		// Our own messages came from Slack, where the owner has the seen command
+		return
+	}
+
+	var channel IRCChannel
+	replyTo := line.Nick
+	if target := line.Target(); isIRCChannelName(target) {
+		channel = IRCChannel(target)
+		replyTo = target
+		if len(network.bridgesForIRCChannel(channel)) == 0 {
+			return
+		}
+	}
+
+	if !network.seenCommands.allow(channel, line.Nick, time.Now()) {
+		return
+	}
+
+	var reply string
+	if strings.EqualFold(nick, line.Nick) {
+		reply = fmt.Sprintf("%v: That's you!", line.Nick)
+	} else if record := network.seen.lookup(nick); record != nil {
+		reply = record.summary(time.Now())
+	} else {
+		reply = fmt.Sprintf("I haven't seen %v.", nick)
+	}
+
+	network.proxy.sendNotice(replyTo, reply)
+}
@@ -3,15 +3,74 @@ package pino
 import (
 	"fmt"
 	"io/ioutil"
+	"strings"
 
 	"gopkg.in/yaml.v2"
 )
 
-// Config holds the configuration that Pino expects
+// Config holds the configuration that Pino expects.
+// Pino connects to one IRC network, configured under IRC, or to each of the Networks. A network's
+// name is how bridges refer to it, and tags the owner's DMs about it.
+// Slack is the owner's own workspace, where Pino DMs them and takes their commands. Bridges can also
+// reach other Workspaces, by name, which each have their own Token and Owner.
+// StateDirectory is where Pino keeps anything that must survive a restart;
+// if it's empty, that state is only kept in memory.
 type Config struct {
-	IRC            IRCConfig                   `yaml:"IRC"`
-	Slack          SlackConfig                 `yaml:"Slack"`
-	ChannelMapping map[SlackChannel]IRCChannel `yaml:"ChannelMapping"`
+	IRC            IRCConfig                      `yaml:"IRC"`
+	Networks       map[string]IRCConfig           `yaml:"Networks"`
+	Slack          SlackConfig                    `yaml:"Slack"`
+	Workspaces     map[string]SlackConfig         `yaml:"Workspaces"`
+	ChannelMapping map[SlackChannel]BridgeConfigs `yaml:"ChannelMapping"`
+	StateDirectory string                         `yaml:"StateDirectory"`
+
+	DeliveryConfirmation DeliveryConfirmationConfig `yaml:"DeliveryConfirmation"`
+	// Templates overrides the text of messages Pino generates, by name (see defaultMessageTemplates)
+	Templates map[string]string `yaml:"Templates"`
+	Away      AwayConfig        `yaml:"Away"`
+	ChatLog   ChatLogConfig     `yaml:"ChatLog"`
+
+	MessageStore MessageStoreConfig `yaml:"MessageStore"`
+}
+
+// MessageStoreConfig controls the searchable store of everything said on both sides of the bridge,
+// which the owner can query by sending "history" in a DM. It's kept in the StateDirectory, so it's
+// only on when there is one. History results longer than MaxInlineResults (default 20) lines
+// are uploaded as a file.
+type MessageStoreConfig struct {
+	Disabled         bool `yaml:"Disabled"`
+	MaxInlineResults int  `yaml:"MaxInlineResults"`
+}
+
+// ChatLogConfig controls logging everything said in our IRC channels to disk, in irssi/ZNC-style
+// text files under Directory, one per network, channel, and day. With JSON, each entry is also
+// written as a line of JSON to a matching .jsonl file. A file bigger than MaxFileSizeMB is moved
+// aside to a numbered name, and .log and .jsonl files that haven't been written to in RetentionDays
+// are deleted.
+// Logging is off unless Directory is set, and zero means no limit.
+type ChatLogConfig struct {
+	Directory     string `yaml:"Directory"`
+	JSON          bool   `yaml:"JSON"`
+	MaxFileSizeMB int    `yaml:"MaxFileSizeMB"`
+	RetentionDays int    `yaml:"RetentionDays"`
+}
+
+// AwayConfig controls how the owner's Slack presence shows on IRC. If Enabled, Pino marks
+// itself away on IRC while the owner is away on Slack, with their Slack status text as the away
+// message (see the "away" template). With AutoReply, private messages that arrive while the owner
+// is away get a notice from the "away-reply" template, at most once every
+// AutoReplyIntervalMinutes (default 60) per nick.
+type AwayConfig struct {
+	Enabled                  bool `yaml:"Enabled"`
+	AutoReply                bool `yaml:"AutoReply"`
+	AutoReplyIntervalMinutes int  `yaml:"AutoReplyIntervalMinutes"`
+}
+
+// DeliveryConfirmationConfig controls whether Slack messages relayed to IRC get a reaction once we
+// know how IRC took them: ✅ when the server echoes the message back or no error arrives within
+// TimeoutSeconds (default 5), and ⚠️ with a thread reply explaining why when it's rejected.
+type DeliveryConfirmationConfig struct {
+	Enabled        bool `yaml:"Enabled"`
+	TimeoutSeconds int  `yaml:"TimeoutSeconds"`
 }
 
 // IRCChannel is the name of an IRC channel, like "#CAA"
@@ -20,35 +79,179 @@ type IRCChannel string
 // IRCChannelKey is an optional password for an IRC channel
 type IRCChannelKey string
 
-// SlackChannel is the name of a Slack channel, like "#CAA-on-Slack"
+// SlackChannel is the name of a Slack channel, like "#CAA-on-Slack".
+// In the ChannelMapping, a channel in one of the other Workspaces is named with its workspace,
+// like "partner/#CAA".
 type SlackChannel string
 
-// IRCConfig define the IRC-specific config
+// BridgeConfig is how a Slack channel is bridged with an IRC channel.
+// In the simplest case it's just the name of the IRC channel (like "#CAA", or "rizon/#CAA" to
+// name its network), but it can also be a mapping that sets IRCChannel along with options for
+// just this pair of channels:
+//   - Network: the name of the IRC network the channel is on, which can be left out if there's
+//     only one
+//   - Direction: "both" (the default), "irc-to-slack", or "slack-to-irc"
+//   - Events: which IRC events to show on Slack, out of join, part, quit, mode, nick, topic,
+//     and kick (all of them by default)
+//   - JoinPartFilter: "all", "none", or "smart" (see JoinPartFilterConfig)
+//   - HighlightRules: used instead of the IRC HighlightRules for this channel
+//   - Formatting: how IRC bold/italic/color codes are shown on Slack: "convert" to Slack
+//     formatting (the default), "strip" them, or leave them "raw"
+//   - CoalesceMilliseconds: consecutive IRC lines from the same nick that arrive within this
+//     window of each other are merged into a single Slack message. The first line is posted right
+//     away, and the rest are added by editing it, for up to a minute after it was posted.
+//   - Templates: overrides the global Templates for this channel
+//   - Playback: what to do with the lines of a ZNC buffer playback: "drop" them (the default),
+//     relay them into a single Slack "thread", or relay them "inline" labelled with when they were
+//     sent. Lines Slack has already seen are skipped either way.
+//   - Threaded: relays the IRC channel into its own thread in the Slack channel, with a new thread
+//     every day, and sends replies in any of its threads from the last week back to it. It must be
+//     the same for all the bridges of a Slack channel, and can't be used with coalescing or
+//     Playback "thread".
+type BridgeConfig struct {
+	Network              string                   `yaml:"Network"`
+	IRCChannel           IRCChannel               `yaml:"IRCChannel"`
+	Direction            string                   `yaml:"Direction"`
+	Events               []string                 `yaml:"Events"`
+	JoinPartFilter       string                   `yaml:"JoinPartFilter"`
+	HighlightRules       []IRCHighlightRuleConfig `yaml:"HighlightRules"`
+	Formatting           string                   `yaml:"Formatting"`
+	CoalesceMilliseconds int                      `yaml:"CoalesceMilliseconds"`
+	Templates            map[string]string        `yaml:"Templates"`
+	Playback             string                   `yaml:"Playback"`
+	Threaded             bool                     `yaml:"Threaded"`
+}
+
+// BridgeConfigs are the bridges of a single Slack channel. Usually there's just one, but a list of them
+// merges several IRC channels into the Slack channel, with the IRC channel in front of everything
+// relayed from each (see the "channel-prefix" template). Messages from Slack have to go to just one
+// of them, so the rest need a Direction of "irc-to-slack", unless they're Threaded, in which case
+// each IRC channel has its own threads to reply in instead. To mirror one IRC channel into several
+// Slack channels instead, map each of the Slack channels to it.
+type BridgeConfigs []BridgeConfig
+
+// UnmarshalYAML lets a Slack channel with a single bridge have it on its own, instead of in a list
+func (bridges *BridgeConfigs) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []BridgeConfig
+	if err := unmarshal(&list); err == nil {
+		*bridges = list
+		return nil
+	}
+
+	var bridge BridgeConfig
+	if err := unmarshal(&bridge); err != nil {
+		return err
+	}
+	*bridges = BridgeConfigs{bridge}
+	return nil
+}
+
+// UnmarshalYAML lets a bridge be written as just the name of its IRC channel
+func (bridge *BridgeConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var ircChannel string
+	if err := unmarshal(&ircChannel); err == nil {
+		bridge.Network, bridge.IRCChannel = splitNetworkAndIRCChannel(ircChannel)
+		return nil
+	}
+
+	type plainBridgeConfig BridgeConfig
+	return unmarshal((*plainBridgeConfig)(bridge))
+}
+
+// IRCConfig define the IRC-specific config.
+// IntakeQueueSize is how many unhandled lines each IRC channel may have waiting before
+// new lines for that channel get dropped (default 500).
+// Messages containing our current nick or one of the NickAliases highlight the owner
+// when no HighlightRule matches them, unless DisableNickHighlight is set.
+// Typing in bridged channels is shown on the other side when the server supports IRCv3
+// message tags, unless DisableTypingIndicators is set.
+// Pino asks the server for every IRCv3 capability it supports (see ircSupportedCapabilities)
+// except those in DisabledCapabilities.
+// When the server supports chathistory, messages missed while Pino was gone are fetched after
+// rejoining, up to HistoryBackfillLimit (default 100) per channel. The time of the last message
+// seen in each channel is kept in the StateDirectory.
+// Anyone in a bridged channel, or in a private message, can ask when a nick was last around
+// with "!seen nick", which is answered with a notice unless DisableSeenCommand is set. Each nick
+// gets an answer at most every 30 seconds, and each channel at most every 10.
 type IRCConfig struct {
-	Nickname       string                       `yaml:"Nickname"`
-	Name           string                       `yaml:"Name"`
-	Server         string                       `yaml:"Server"`
-	Password       string                       `yaml:"Password"`
-	IsSSL          bool                         `yaml:"IsSSL"`
-	Channels       map[IRCChannel]IRCChannelKey `yaml:"Channels"`
-	HighlightRules []IRCHighlightRuleConfig     `yaml:"HighlightRules"`
+	Nickname        string                       `yaml:"Nickname"`
+	Name            string                       `yaml:"Name"`
+	Server          string                       `yaml:"Server"`
+	Password        string                       `yaml:"Password"`
+	IsSSL           bool                         `yaml:"IsSSL"`
+	Channels        map[IRCChannel]IRCChannelKey `yaml:"Channels"`
+	HighlightRules  []IRCHighlightRuleConfig     `yaml:"HighlightRules"`
+	IntakeQueueSize int                          `yaml:"IntakeQueueSize"`
+	JoinPartFilter  JoinPartFilterConfig         `yaml:"JoinPartFilter"`
+
+	NickAliases          []string `yaml:"NickAliases"`
+	DisableNickHighlight bool     `yaml:"DisableNickHighlight"`
+
+	DisableTypingIndicators bool     `yaml:"DisableTypingIndicators"`
+	DisabledCapabilities    []string `yaml:"DisabledCapabilities"`
+	HistoryBackfillLimit    int      `yaml:"HistoryBackfillLimit"`
+	DisableSeenCommand      bool     `yaml:"DisableSeenCommand"`
+}
+
+// JoinPartFilterConfig decides which joins, parts, quits, and nick changes are relayed to Slack.
+// The mode is "all" (the default), "none", or "smart", which only relays them for users who have
+// spoken in the channel within the last ActivityWindowMinutes (default 60).
+// Default applies to every channel that doesn't set its own JoinPartFilter in the ChannelMapping.
+type JoinPartFilterConfig struct {
+	Default               string `yaml:"Default"`
+	ActivityWindowMinutes int    `yaml:"ActivityWindowMinutes"`
 }
 
 // IRCHighlightRuleConfig defines when to directly ping the owner on Slack.
-// You can define a nick pattern, a message pattern, or both.
+// You can define a nick, message, hostmask, or account pattern, or any combination of them.
 // If a pattern is not defined, then it is assumed to match all values for that.
 // The first rule that matches is executed. Default is to not highlight.
 type IRCHighlightRuleConfig struct {
-	NickPattern     string `yaml:"NickPattern"`
-	MessagePattern  string `yaml:"MessagePattern"`
-	ShouldHighlight bool   `yaml:"ShouldHighlight"`
+	NickPattern    string `yaml:"NickPattern"`
+	MessagePattern string `yaml:"MessagePattern"`
+	// Matched against the sender's nick!user@host
+	HostmaskPattern string `yaml:"HostmaskPattern"`
+	// Matched against the sender's services account, when the server reports it
+	AccountPattern string `yaml:"AccountPattern"`
+	// The IRC channels the rule applies to, with "PM" for private messages. Empty means everywhere.
+	Channels        []string `yaml:"Channels"`
+	CaseInsensitive bool     `yaml:"CaseInsensitive"`
+	// If true, MessagePattern only matches whole words
+	WholeWord bool `yaml:"WholeWord"`
+	// What to do on a match: any of "mention", "dm", "react", and "suppress".
+	// If empty, ShouldHighlight: true is the same as "mention".
+	Actions         []string `yaml:"Actions"`
+	ShouldHighlight bool     `yaml:"ShouldHighlight"`
+	// The emoji (without colons) for the "react" action. Defaults to "eyes".
+	Reaction string `yaml:"Reaction"`
 }
 
-// SlackConfig defines the Slack-specific config
+// SlackConfig defines the Slack-specific config.
+// Owner may be the owner's Slack user ID, email address, or username.
+// NameOrder lists which Slack user fields to try, in order, when displaying a user's name.
+// Valid fields are "DisplayName", "RealName", and "Name" (the legacy username), which is also the default order.
+// While the owner is away or in Do Not Disturb, highlights are collected and sent as a single DM
+// when they come back, unless DisableHighlightDigest is set.
 type SlackConfig struct {
-	Owner    string                  `yaml:"Owner"`
-	Token    string                  `yaml:"Token"`
-	Channels map[SlackChannel]string `yaml:"Channels"`
+	Owner     string                  `yaml:"Owner"`
+	Token     string                  `yaml:"Token"`
+	Channels  map[SlackChannel]string `yaml:"Channels"`
+	NameOrder []string                `yaml:"NameOrder"`
+	Outbox    SlackOutboxConfig       `yaml:"Outbox"`
+
+	DisableHighlightDigest bool `yaml:"DisableHighlightDigest"`
+}
+
+// SlackOutboxConfig tunes how messages are delivered to Slack.
+// Each Slack channel has its own queue, so messages to a channel are posted in order.
+// A message that still fails after MaxRetries attempts (default 5), or that arrives while
+// its channel already has QueueSize (default 1000) messages waiting, is saved to the
+// StateDirectory. The channel goes back to it once its queue has drained, and anything still
+// saved when Pino stops is sent after it restarts. Messages Slack will never take, like ones
+// to an archived channel, are dropped and the owner is told.
+type SlackOutboxConfig struct {
+	MaxRetries int `yaml:"MaxRetries"`
+	QueueSize  int `yaml:"QueueSize"`
 }
 
 // LoadConfig returns the Config parsed from the given config file path
@@ -65,27 +268,261 @@ func LoadConfig(path string) (*Config, error) {
 		return config, fmt.Errorf("Unable to parse YAML from config file %v: %v", path, err)
 	}
 
+	if err := config.resolveNetworks(); err != nil {
+		return config, err
+	}
+	for name := range config.Workspaces {
+		if name == "" || strings.ContainsAny(name, "/ ") {
+			return config, fmt.Errorf("Invalid workspace name '%v', names can't be empty or contain '/' or spaces", name)
+		}
+	}
+
 	// Verify that the channel mapping is consistent with the configured IRC/Slack Channels
-	for slackChannel, ircChannel := range config.ChannelMapping {
-		if _, ok := config.IRC.Channels[ircChannel]; !ok {
-			return config, fmt.Errorf("IRC channel '%v' was specified in the channel mapping, but wasn't configured under IRC", ircChannel)
+	for slackChannel, bridges := range config.ChannelMapping {
+		if len(bridges) == 0 {
+			return config, fmt.Errorf("Slack channel '%v' was specified in the channel mapping without an IRC channel", slackChannel)
 		}
 
-		if _, ok := config.Slack.Channels[slackChannel]; !ok {
-			return config, fmt.Errorf("Slack channel '%v' was specified in the channel mapping, but wasn't configured under Slack", slackChannel)
+		workspaceName, channel := splitWorkspaceAndSlackChannel(slackChannel)
+		workspace, ok := config.workspace(workspaceName)
+		if !ok {
+			return config, fmt.Errorf("Slack channel '%v' was specified in the channel mapping, but there's no workspace '%v' under Workspaces", slackChannel, workspaceName)
+		}
+		if _, ok := workspace.Channels[channel]; !ok {
+			return config, fmt.Errorf("Slack channel '%v' was specified in the channel mapping, but wasn't configured under %v", channel, describeWorkspace(workspaceName))
+		}
+
+		for i := range bridges {
+			bridge := &bridges[i]
+			ircChannel := bridge.IRCChannel
+			if ircChannel == "" {
+				return config, fmt.Errorf("Slack channel '%v' was specified in the channel mapping without an IRC channel", slackChannel)
+			}
+
+			networkName, err := config.networkForBridge(bridge)
+			if err != nil {
+				return config, fmt.Errorf("Invalid channel mapping for Slack channel '%v': %v", slackChannel, err)
+			}
+			// Later lookups can count on every bridge naming its network
+			bridge.Network = networkName
+
+			if _, ok := config.Networks[networkName].Channels[ircChannel]; !ok {
+				return config, fmt.Errorf("IRC channel '%v' was specified in the channel mapping, but wasn't configured under %v", ircChannel, describeNetwork(networkName))
+			}
+
+			if err := bridge.validate(); err != nil {
+				return config, fmt.Errorf("Invalid channel mapping for Slack channel '%v': %v", slackChannel, err)
+			}
+		}
+
+		if err := bridges.validate(); err != nil {
+			return config, fmt.Errorf("Invalid channel mapping for Slack channel '%v': %v", slackChannel, err)
+		}
+	}
+
+	for _, network := range config.Networks {
+		if err := validateJoinPartFilterMode(network.JoinPartFilter.Default); err != nil {
+			return config, err
 		}
 	}
 
 	return config, nil
 }
 
-func (config *Config) getUsedIRCChannels() []IRCChannel {
-	channels := make([]IRCChannel, len(config.ChannelMapping))
-	i := 0
+// Turns a config written for a single network under IRC into one with a single unnamed network,
+// so the rest of Pino only has to deal with Networks
+func (config *Config) resolveNetworks() error {
+	if len(config.Networks) == 0 {
+		config.Networks = map[string]IRCConfig{"": config.IRC}
+		config.IRC = IRCConfig{}
+		return nil
+	}
+
+	if config.IRC.Server != "" {
+		return fmt.Errorf("IRC and Networks can't both be configured, move the IRC network into Networks")
+	}
+
+	for name := range config.Networks {
+		if name == "" || strings.ContainsAny(name, "/ ") {
+			return fmt.Errorf("Invalid network name '%v', names can't be empty or contain '/' or spaces", name)
+		}
+	}
+
+	return nil
+}
+
+// The name of the network a bridge's IRC channel is on. The network can only be left out if there's just one.
+func (config *Config) networkForBridge(bridge *BridgeConfig) (string, error) {
+	if bridge.Network == "" {
+		if len(config.Networks) != 1 {
+			return "", fmt.Errorf("Network must be set when there's more than one network")
+		}
+		for name := range config.Networks {
+			return name, nil
+		}
+	}
+
+	if _, ok := config.Networks[bridge.Network]; !ok {
+		return "", fmt.Errorf("Unknown Network '%v'", bridge.Network)
+	}
+	return bridge.Network, nil
+}
+
+// How a network is referred to in errors
+func describeNetwork(name string) string {
+	if name == "" {
+		return "IRC"
+	}
+	return fmt.Sprintf("network '%v'", name)
+}
+
+// The Slack workspace with the name, where the empty name is the owner's own workspace under Slack
+func (config *Config) workspace(name string) (*SlackConfig, bool) {
+	if name == "" {
+		return &config.Slack, true
+	}
+
+	workspace, ok := config.Workspaces[name]
+	return &workspace, ok
+}
+
+// How a workspace is referred to in errors
+func describeWorkspace(name string) string {
+	if name == "" {
+		return "Slack"
+	}
+	return fmt.Sprintf("workspace '%v'", name)
+}
+
+// Splits a ChannelMapping key like "partner/#CAA" into the workspace and the channel.
+// Slack channel names can't have a "/" in them, so there's no mistaking one for a workspace.
+func splitWorkspaceAndSlackChannel(channel SlackChannel) (string, SlackChannel) {
+	i := strings.Index(string(channel), "/")
+	if i < 0 {
+		return "", channel
+	}
+
+	return string(channel[:i]), channel[i+1:]
+}
+
+// The reverse of splitWorkspaceAndSlackChannel
+func joinWorkspaceAndSlackChannel(workspace string, channel SlackChannel) SlackChannel {
+	if workspace == "" {
+		return channel
+	}
+	return SlackChannel(workspace + "/" + string(channel))
+}
+
+// Splits the short form of a bridge, like "rizon/#CAA", into the network and the channel.
+// A "/" that's part of the channel name, like "#CAA/dev", isn't taken as a network.
+func splitNetworkAndIRCChannel(text string) (string, IRCChannel) {
+	i := strings.Index(text, "/")
+	if i < 0 || isIRCChannelName(text) {
+		return "", IRCChannel(text)
+	}
+
+	return text[:i], IRCChannel(text[i+1:])
+}
+
+// Makes sure there's no question of where a message goes, for a Slack channel with more than one bridge.
+// The bridges' networks must already be resolved.
+func (bridges BridgeConfigs) validate() error {
+	seen := make(map[string]bool)
+	var toIRC []string
+
+	for _, bridge := range bridges {
+		name := describeBridgedIRCChannel(bridge.Network, bridge.IRCChannel)
+		key := strings.ToLower(name)
+		if seen[key] {
+			return fmt.Errorf("IRC channel '%v' is listed more than once", name)
+		}
+		seen[key] = true
+
+		if bridge.Direction != bridgeDirectionIRCToSlack {
+			toIRC = append(toIRC, name)
+		}
+
+		if bridge.CoalesceMilliseconds != bridges[0].CoalesceMilliseconds {
+			return fmt.Errorf("IRC channels in the same Slack channel must have the same CoalesceMilliseconds")
+		}
+
+		if bridge.Threaded != bridges[0].Threaded {
+			return fmt.Errorf("Either all of the IRC channels in a Slack channel are Threaded, or none of them are")
+		}
+		if bridge.Threaded && bridge.CoalesceMilliseconds > 0 {
+			return fmt.Errorf("Threaded IRC channels can't have CoalesceMilliseconds")
+		}
+		if bridge.Threaded && bridge.Playback == playbackModeThread {
+			return fmt.Errorf("Threaded IRC channels can't have Playback %v, since threads can't have threads of their own", playbackModeThread)
+		}
+	}
+
+	// Replies in a thread go to the thread's IRC channel, so there's no question of where they go
+	if len(toIRC) > 1 && !bridges[0].Threaded {
+		return fmt.Errorf("Messages from Slack can only go to one IRC channel, but %v all take them. Set Direction to irc-to-slack on all but one", strings.Join(toIRC, ", "))
+	}
+
+	return nil
+}
+
+// Like "#CAA", or "rizon/#CAA" on a named network
+func describeBridgedIRCChannel(network string, channel IRCChannel) string {
+	if network == "" {
+		return string(channel)
+	}
+	return fmt.Sprintf("%v/%v", network, channel)
+}
 
-	for _, ircChannel := range config.ChannelMapping {
-		channels[i] = ircChannel
-		i++
+func (bridge *BridgeConfig) validate() error {
+	switch bridge.Direction {
+	case "", bridgeDirectionBoth, bridgeDirectionIRCToSlack, bridgeDirectionSlackToIRC:
+	default:
+		return fmt.Errorf("Unknown Direction '%v', expected one of: both, irc-to-slack, slack-to-irc", bridge.Direction)
+	}
+
+	for _, event := range bridge.Events {
+		if !bridgeEventTypes[event] {
+			return fmt.Errorf("Unknown event type '%v' in Events, expected any of: join, part, quit, mode, nick, topic, kick", event)
+		}
+	}
+
+	switch bridge.Formatting {
+	case "", formattingConvert, formattingStrip, formattingRaw:
+	default:
+		return fmt.Errorf("Unknown Formatting '%v', expected one of: convert, strip, raw", bridge.Formatting)
+	}
+
+	switch bridge.Playback {
+	case "", playbackModeDrop, playbackModeThread, playbackModeInline:
+	default:
+		return fmt.Errorf("Unknown Playback mode '%v', expected one of: drop, thread, inline", bridge.Playback)
+	}
+
+	return validateJoinPartFilterMode(bridge.JoinPartFilter)
+}
+
+func validateJoinPartFilterMode(mode string) error {
+	switch mode {
+	case "", presenceFilterAll, presenceFilterNone, presenceFilterSmart:
+		return nil
+	}
+
+	return fmt.Errorf("Unknown JoinPartFilter mode '%v', expected one of: all, none, smart", mode)
+}
+
+// The IRC channels on the named network that are bridged with Slack
+func (config *Config) getUsedIRCChannels(network string) []IRCChannel {
+	var channels []IRCChannel
+	// More than one Slack channel can be bridged with the same IRC channel
+	seen := make(map[IRCChannel]bool)
+
+	for _, bridges := range config.ChannelMapping {
+		for _, bridge := range bridges {
+			if bridge.Network == network && !seen[ircChannelKey(bridge.IRCChannel)] {
+				seen[ircChannelKey(bridge.IRCChannel)] = true
+				channels = append(channels, bridge.IRCChannel)
+			}
+		}
 	}
 
 	return channels
@@ -0,0 +1,121 @@
+package pino
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func loadTestConfig(t *testing.T, yaml string) (*Config, error) {
+	directory, err := ioutil.TempDir("", "pino-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return LoadConfig(path)
+}
+
+func TestBridgeConfigsValidate(t *testing.T) {
+	tests := []struct {
+		description string
+		bridges     BridgeConfigs
+		// The start of the expected error, or empty if the bridges are fine
+		expected string
+	}{
+		{
+			"a single bridge",
+			BridgeConfigs{{IRCChannel: "#a"}},
+			"",
+		},
+		{
+			"one bridge taking messages from Slack",
+			BridgeConfigs{{IRCChannel: "#a"}, {IRCChannel: "#b", Direction: bridgeDirectionIRCToSlack}},
+			"",
+		},
+		{
+			"the same channel name on different networks",
+			BridgeConfigs{{Network: "libera", IRCChannel: "#a"}, {Network: "oftc", IRCChannel: "#a", Direction: bridgeDirectionIRCToSlack}},
+			"",
+		},
+		{
+			"Threaded bridges that all take messages from Slack",
+			BridgeConfigs{{IRCChannel: "#a", Threaded: true}, {IRCChannel: "#b", Threaded: true}},
+			"",
+		},
+		{
+			"the same IRC channel twice",
+			BridgeConfigs{{IRCChannel: "#a"}, {IRCChannel: "#A", Direction: bridgeDirectionIRCToSlack}},
+			"IRC channel '#A' is listed more than once",
+		},
+		{
+			"the same IRC channel twice on a network",
+			BridgeConfigs{{Network: "libera", IRCChannel: "#a"}, {Network: "Libera", IRCChannel: "#a", Direction: bridgeDirectionIRCToSlack}},
+			"IRC channel 'Libera/#a' is listed more than once",
+		},
+		{
+			"more than one bridge taking messages from Slack",
+			BridgeConfigs{{IRCChannel: "#a"}, {IRCChannel: "#b", Direction: bridgeDirectionSlackToIRC}},
+			"Messages from Slack can only go to one IRC channel, but #a, #b all take them",
+		},
+		{
+			"different CoalesceMilliseconds",
+			BridgeConfigs{{IRCChannel: "#a", CoalesceMilliseconds: 1000}, {IRCChannel: "#b", Direction: bridgeDirectionIRCToSlack}},
+			"IRC channels in the same Slack channel must have the same CoalesceMilliseconds",
+		},
+		{
+			"some bridges Threaded",
+			BridgeConfigs{{IRCChannel: "#a", Threaded: true}, {IRCChannel: "#b", Direction: bridgeDirectionIRCToSlack}},
+			"Either all of the IRC channels in a Slack channel are Threaded, or none of them are",
+		},
+		{
+			"Threaded with coalescing",
+			BridgeConfigs{{IRCChannel: "#a", Threaded: true, CoalesceMilliseconds: 1000}},
+			"Threaded IRC channels can't have CoalesceMilliseconds",
+		},
+		{
+			"Threaded with playback in a thread",
+			BridgeConfigs{{IRCChannel: "#a", Threaded: true, Playback: playbackModeThread}},
+			"Threaded IRC channels can't have Playback thread",
+		},
+	}
+
+	for _, test := range tests {
+		err := test.bridges.validate()
+		if test.expected == "" && err != nil {
+			t.Errorf("Expected %v to be accepted, got %v", test.description, err)
+		}
+		if test.expected != "" && (err == nil || !strings.HasPrefix(err.Error(), test.expected)) {
+			t.Errorf("Expected %v to be rejected with %q, got %v", test.description, test.expected, err)
+		}
+	}
+}
+
+func TestLoadConfigRejectsAmbiguousMappings(t *testing.T) {
+	_, err := loadTestConfig(t, `
+IRC:
+  Nickname: pino
+  Server: irc.example.net:6697
+  Channels:
+    '#a': ''
+    '#b': ''
+Slack:
+  Token: token
+  Channels:
+    '#merged': ''
+ChannelMapping:
+  '#merged':
+    - '#a'
+    - '#b'
+`)
+	if err == nil || !strings.Contains(err.Error(), "Messages from Slack can only go to one IRC channel") {
+		t.Errorf("Expected two IRC channels taking messages from one Slack channel to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,290 @@
+package pino
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDeliveryTimeout = 5 * time.Second
+	deliveredReaction      = "white_check_mark"
+	deliveryFailedReaction = "warning"
+)
+
+// How long lines that were confirmed without being echoed can still be recognized as echoes, since
+// the client library's flood control can hold a long paste back for much longer than the timeout
+const (
+	lateEchoWindow   = 5 * time.Minute
+	maxLateEchoLines = 100
+)
+
+// The ircDeliveryTracker remembers which Slack messages we've relayed to IRC, so that we can mark
+// them once we know whether IRC accepted them. A message is confirmed when the server echoes it back
+// to us, or when no error about its channel arrives before the timeout. With echo-message, the server
+// echoes everything it accepts, so only the echo or an error settles a message. Since IRC errors don't
+// say which message they're about, an error for a channel is blamed on its oldest unconfirmed message.
+//
+// Messages are tracked even when confirmation is disabled, so that their echoes can be told apart
+// from lines the owner sent from another client.
+type ircDeliveryTracker struct {
+	enabled bool
+	timeout time.Duration
+
+	mutex   sync.Mutex
+	pending map[string][]*pendingDelivery
+	// Lines of messages that timed out before they were echoed, in case their echoes turn up late
+	unechoed map[string][]*unechoedLine
+}
+
+type unechoedLine struct {
+	text      string
+	confirmed time.Time
+}
+
+// A Slack message that has been sent to IRC, but hasn't been confirmed yet
+type pendingDelivery struct {
+	channel IRCChannel
+	// The bridge the message came through, which knows its Slack workspace and templates
+	bridge         *bridge
+	slackChannelID string
+	timestamp      string
+	// The thread the message is a reply in, if it is one
+	threadTimestamp string
+	// The lines we sent to IRC for this message that the server hasn't echoed back yet
+	lines []string
+	timer *time.Timer
+}
+
+func newIRCDeliveryTracker(config *DeliveryConfirmationConfig) *ircDeliveryTracker {
+	tracker := &ircDeliveryTracker{
+		enabled:  config.Enabled,
+		timeout:  time.Duration(config.TimeoutSeconds) * time.Second,
+		pending:  make(map[string][]*pendingDelivery),
+		unechoed: make(map[string][]*unechoedLine),
+	}
+
+	if tracker.timeout <= 0 {
+		tracker.timeout = defaultDeliveryTimeout
+	}
+
+	return tracker
+}
+
+// Starts watching a Slack message that was just sent through the bridge to its IRC channel, as the
+// lines the IRC client sent. If the server echoes our messages, only its echo or an error settles it.
+func (tracker *ircDeliveryTracker) track(bridge *bridge, slackChannelID string, timestamp string, threadTimestamp string, lines []string, expectEcho bool) {
+	delivery := &pendingDelivery{
+		channel:         bridge.ircChannel,
+		bridge:          bridge,
+		slackChannelID:  slackChannelID,
+		timestamp:       timestamp,
+		threadTimestamp: threadTimestamp,
+		lines:           append([]string(nil), lines...),
+	}
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	key := deliveryKey(delivery.channel)
+	tracker.pending[key] = append(tracker.pending[key], delivery)
+	if expectEcho {
+		return
+	}
+
+	delivery.timer = time.AfterFunc(tracker.timeout, func() {
+		// No news is good news
+		if tracker.remove(delivery) {
+			tracker.rememberUnechoed(delivery)
+			tracker.markDelivered(delivery)
+		}
+	})
+}
+
+// Keeps the lines of a message that was confirmed without an echo, so a late echo isn't taken
+// for something the owner sent from another client
+func (tracker *ircDeliveryTracker) rememberUnechoed(delivery *pendingDelivery) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	key := deliveryKey(delivery.channel)
+	now := time.Now()
+	for _, line := range delivery.lines {
+		tracker.unechoed[key] = append(tracker.unechoed[key], &unechoedLine{text: line, confirmed: now})
+	}
+	if lines := tracker.unechoed[key]; len(lines) > maxLateEchoLines {
+		tracker.unechoed[key] = lines[len(lines)-maxLateEchoLines:]
+	}
+}
+
+// Called when the server echoes back a line from our nick in a channel. Returns whether it's
+// one we sent from Slack, rather than one the owner sent from another client.
+// A message is confirmed once all of its lines have been echoed.
+func (tracker *ircDeliveryTracker) confirm(channel IRCChannel, text string) bool {
+	key := deliveryKey(channel)
+
+	tracker.mutex.Lock()
+	var echoed, confirmed *pendingDelivery
+	for _, delivery := range tracker.pending[key] {
+		for i, line := range delivery.lines {
+			if line == text {
+				echoed = delivery
+				delivery.lines = append(delivery.lines[:i:i], delivery.lines[i+1:]...)
+				break
+			}
+		}
+		if echoed != nil {
+			if len(echoed.lines) == 0 {
+				confirmed = echoed
+			}
+			break
+		}
+	}
+	lateEcho := echoed == nil && tracker.takeUnechoed(key, text)
+	tracker.mutex.Unlock()
+
+	if confirmed != nil && tracker.remove(confirmed) {
+		confirmed.stopTimer()
+		tracker.markDelivered(confirmed)
+	}
+
+	return echoed != nil || lateEcho
+}
+
+// Whether the text is a line of a message that was confirmed before it was echoed, forgetting
+// it if so. The caller must hold the mutex.
+func (tracker *ircDeliveryTracker) takeUnechoed(key string, text string) bool {
+	var kept []*unechoedLine
+	found := false
+	for _, line := range tracker.unechoed[key] {
+		if time.Since(line.confirmed) > lateEchoWindow {
+			continue
+		}
+		if !found && line.text == text {
+			found = true
+			continue
+		}
+		kept = append(kept, line)
+	}
+
+	if len(kept) == 0 {
+		delete(tracker.unechoed, key)
+	} else {
+		tracker.unechoed[key] = kept
+	}
+	return found
+}
+
+// Called when IRC tells us that something we sent to a channel was rejected.
+// Returns false if there was no message waiting to be blamed for it.
+func (tracker *ircDeliveryTracker) fail(channel IRCChannel, reason string) bool {
+	if !tracker.enabled {
+		return false
+	}
+
+	tracker.mutex.Lock()
+	var failed *pendingDelivery
+	if deliveries := tracker.pending[deliveryKey(channel)]; len(deliveries) > 0 {
+		failed = deliveries[0]
+	}
+	tracker.mutex.Unlock()
+
+	if failed == nil || !tracker.remove(failed) {
+		return false
+	}
+
+	failed.stopTimer()
+	tracker.markFailed(failed, reason)
+	return true
+}
+
+// Fails every message that hasn't been confirmed yet, like when we get disconnected
+func (tracker *ircDeliveryTracker) failAll(reason string) {
+	tracker.mutex.Lock()
+	var failed []*pendingDelivery
+	for _, deliveries := range tracker.pending {
+		failed = append(failed, deliveries...)
+	}
+	tracker.pending = make(map[string][]*pendingDelivery)
+	tracker.mutex.Unlock()
+
+	for _, delivery := range failed {
+		delivery.stopTimer()
+		tracker.markFailed(delivery, reason)
+	}
+}
+
+// Marks a message that could never have been delivered, without tracking it first
+func (tracker *ircDeliveryTracker) failImmediately(bridge *bridge, slackChannelID string, timestamp string, threadTimestamp string, reason string) {
+	if !tracker.enabled {
+		return
+	}
+
+	tracker.markFailed(&pendingDelivery{
+		channel:         bridge.ircChannel,
+		bridge:          bridge,
+		slackChannelID:  slackChannelID,
+		timestamp:       timestamp,
+		threadTimestamp: threadTimestamp,
+	}, reason)
+}
+
+// Stops tracking a delivery. Returns false if it was already resolved by someone else.
+func (tracker *ircDeliveryTracker) remove(delivery *pendingDelivery) bool {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	key := deliveryKey(delivery.channel)
+	deliveries := tracker.pending[key]
+	for i, candidate := range deliveries {
+		if candidate == delivery {
+			tracker.pending[key] = append(deliveries[:i:i], deliveries[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+func (tracker *ircDeliveryTracker) markDelivered(delivery *pendingDelivery) {
+	if !tracker.enabled {
+		return
+	}
+
+	delivery.bridge.slack.addReaction(delivery.slackChannelID, delivery.timestamp, deliveredReaction)
+}
+
+func (tracker *ircDeliveryTracker) markFailed(delivery *pendingDelivery, reason string) {
+	if !tracker.enabled {
+		return
+	}
+
+	fmt.Printf("Could not deliver Slack message %v to %v: %v\n", delivery.timestamp, delivery.channel, reason)
+
+	delivery.bridge.slack.addReaction(delivery.slackChannelID, delivery.timestamp, deliveryFailedReaction)
+	// A reply in a thread gets its explanation in the same thread, since threads can't have threads
+	threadTimestamp := delivery.threadTimestamp
+	if threadTimestamp == "" {
+		threadTimestamp = delivery.timestamp
+	}
+
+	data := &messageTemplateData{Channel: delivery.channel, Reason: reason}
+	delivery.bridge.slack.replyInThread(
+		delivery.slackChannelID,
+		threadTimestamp,
+		delivery.bridge.render("delivery-failed", data),
+	)
+}
+
+// Stops the timeout, if the message has one
+func (delivery *pendingDelivery) stopTimer() {
+	if delivery.timer != nil {
+		delivery.timer.Stop()
+	}
+}
+
+// IRC channel names are case insensitive
+func deliveryKey(channel IRCChannel) string {
+	return strings.ToLower(string(channel))
+}
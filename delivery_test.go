@@ -0,0 +1,102 @@
+package pino
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeliveryTrackerRecognizesEchoes(t *testing.T) {
+	// Echoes are recognized even when the owner hasn't asked for reactions
+	tracker := newIRCDeliveryTracker(&DeliveryConfirmationConfig{})
+	bridge := &bridge{ircChannel: "#Chat"}
+
+	tracker.track(bridge, "C1", "1.000", "", []string{"<alice> one", "<alice> two"}, true)
+
+	tests := []struct {
+		channel IRCChannel
+		text    string
+		isEcho  bool
+	}{
+		// Sent from another client
+		{"#chat", "hello from ZNC", false},
+		{"#other", "<alice> one", false},
+		{"#chat", "<alice> two", true},
+		{"#CHAT", "<alice> one", true},
+		// Each line is only echoed once
+		{"#chat", "<alice> one", false},
+	}
+
+	for _, test := range tests {
+		if isEcho := tracker.confirm(test.channel, test.text); isEcho != test.isEcho {
+			t.Errorf("confirm(%v, %q) = %v, expected %v", test.channel, test.text, isEcho, test.isEcho)
+		}
+	}
+
+	if pending := tracker.pending["#chat"]; len(pending) != 0 {
+		t.Errorf("Expected the message to be confirmed, still waiting on %v", pending)
+	}
+}
+
+func TestDeliveryTrackerWaitsForLateEchoes(t *testing.T) {
+	tests := []struct {
+		name       string
+		expectEcho bool
+		// Whether the message should still be waiting for its echo after the timeout
+		stillPending bool
+	}{
+		// With echo-message, only the echo settles the message
+		{"echo-message", true, true},
+		// Without it, the timeout settles the message, but its echo is still recognized
+		{"no echo-message", false, false},
+	}
+
+	for _, test := range tests {
+		tracker := newIRCDeliveryTracker(&DeliveryConfirmationConfig{})
+		tracker.timeout = 10 * time.Millisecond
+		bridge := &bridge{ircChannel: "#chat"}
+
+		tracker.track(bridge, "C1", "1.000", "", []string{"<alice> slow"}, test.expectEcho)
+		time.Sleep(50 * time.Millisecond)
+
+		tracker.mutex.Lock()
+		pending := len(tracker.pending["#chat"]) > 0
+		tracker.mutex.Unlock()
+		if pending != test.stillPending {
+			t.Errorf("%v: pending after the timeout = %v, expected %v", test.name, pending, test.stillPending)
+		}
+
+		if !tracker.confirm("#chat", "<alice> slow") {
+			t.Errorf("%v: expected the late echo to be recognized", test.name)
+		}
+		if tracker.confirm("#chat", "<alice> slow") {
+			t.Errorf("%v: expected the late echo to only be recognized once", test.name)
+		}
+		if pending := tracker.pending["#chat"]; len(pending) != 0 {
+			t.Errorf("%v: expected the message to be confirmed, still waiting on %v", test.name, pending)
+		}
+	}
+}
+
+func TestSplitIRCMessage(t *testing.T) {
+	tests := []struct {
+		line        string
+		splitLength int
+		expected    []string
+	}{
+		{"short enough", 450, []string{"short enough"}},
+		// Breaks after punctuation when it can
+		{"first part, second part", 20, []string{"first part, ...", "second part"}},
+		// Then after a space
+		{"first part second part", 20, []string{"first part ...", "second part"}},
+		// And otherwise wherever it has to
+		{strings.Repeat("a", 30), 20, []string{strings.Repeat("a", 17) + "...", strings.Repeat("a", 13)}},
+	}
+
+	for _, test := range tests {
+		lines := splitIRCMessage(test.line, test.splitLength)
+		if strings.Join(lines, "|") != strings.Join(test.expected, "|") {
+			t.Errorf("splitIRCMessage(%q, %v) = %q, expected %q", test.line, test.splitLength, lines, test.expected)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package pino
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Slack won't take a message longer than this, so longer digests are split up
+const maxDigestMessageLength = 4000
+
+// The highlightDigest collects highlights while the owner is away or in Do Not Disturb,
+// so they can be sent as a single DM when the owner comes back.
+type highlightDigest struct {
+	mutex      sync.Mutex
+	highlights []*messageTemplateData
+}
+
+func newHighlightDigest() *highlightDigest {
+	return &highlightDigest{}
+}
+
+// Queues a highlight for the next digest, returning the queued copy so its link can be filled in later
+func (digest *highlightDigest) add(data *messageTemplateData) *messageTemplateData {
+	queued := *data
+	queued.Time = formatSlackTime(time.Now())
+
+	digest.mutex.Lock()
+	defer digest.mutex.Unlock()
+
+	digest.highlights = append(digest.highlights, &queued)
+
+	return &queued
+}
+
+// Sets the link to the relayed message once Slack has told us where it is
+func (digest *highlightDigest) setLink(queued *messageTemplateData, link string) {
+	digest.mutex.Lock()
+	defer digest.mutex.Unlock()
+
+	queued.Link = link
+}
+
+// Removes and returns everything that was queued
+func (digest *highlightDigest) take() []messageTemplateData {
+	digest.mutex.Lock()
+	defer digest.mutex.Unlock()
+
+	highlights := make([]messageTemplateData, len(digest.highlights))
+	for i, queued := range digest.highlights {
+		highlights[i] = *queued
+	}
+	digest.highlights = nil
+
+	return highlights
+}
+
+// Shows a time in the reader's own timezone, like "Oct 18, 2016 3:04 AM"
+func formatSlackTime(t time.Time) string {
+	return fmt.Sprintf("<!date^%d^{date_short_pretty} {time}|%v>", t.Unix(), t.Format("Jan 2 15:04 MST"))
+}
+
+// Joins lines into as few messages as possible without any going over maxLength
+func joinLinesIntoMessages(lines []string, maxLength int) []string {
+	var messages []string
+	var current []string
+	length := 0
+
+	for _, line := range lines {
+		if len(current) > 0 && length+len(line)+1 > maxLength {
+			messages = append(messages, strings.Join(current, "\n"))
+			current = nil
+			length = 0
+		}
+
+		current = append(current, line)
+		length += len(line) + 1
+	}
+
+	if len(current) > 0 {
+		messages = append(messages, strings.Join(current, "\n"))
+	}
+
+	return messages
+}
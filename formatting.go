@@ -0,0 +1,135 @@
+package pino
+
+import (
+	"strings"
+)
+
+// How IRC formatting codes are shown on Slack
+const (
+	formattingConvert = "convert"
+	formattingStrip   = "strip"
+	formattingRaw     = "raw"
+)
+
+// IRC formatting control codes
+const (
+	ircBold          = '\x02'
+	ircColor         = '\x03'
+	ircHexColor      = '\x04'
+	ircReset         = '\x0f'
+	ircMonospace     = '\x11'
+	ircReverse       = '\x16'
+	ircItalic        = '\x1d'
+	ircStrikethrough = '\x1e'
+	ircUnderline     = '\x1f'
+)
+
+// The Slack markup for the IRC styles that Slack can show. Anything else is dropped.
+var slackMarkupForIRCStyle = map[rune]string{
+	ircBold:          "*",
+	ircItalic:        "_",
+	ircStrikethrough: "~",
+	ircMonospace:     "`",
+}
+
+// Converts or strips the IRC formatting codes in text
+func formatIRCTextForSlack(text string, mode string) string {
+	if mode == formattingRaw || !strings.ContainsAny(text, "\x02\x03\x04\x0f\x11\x16\x1d\x1e\x1f") {
+		return text
+	}
+
+	var output strings.Builder
+	// The styles that are currently on, in the order they were turned on
+	var openStyles []rune
+
+	closeStyles := func() {
+		for i := len(openStyles) - 1; i >= 0; i-- {
+			output.WriteString(slackMarkupForIRCStyle[openStyles[i]])
+		}
+		openStyles = nil
+	}
+
+	runes := []rune(text)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		switch r {
+		case ircColor:
+			// Skip the optional foreground and background, like "\x0304,12"
+			i = skipIRCColorDigits(runes, i+1, 2, isDecimalDigit) - 1
+		case ircHexColor:
+			i = skipIRCColorDigits(runes, i+1, 6, isHexDigit) - 1
+		case ircReset:
+			if mode == formattingConvert {
+				closeStyles()
+			}
+		case ircReverse, ircUnderline:
+			// Slack has no equivalent
+		case ircBold, ircItalic, ircStrikethrough, ircMonospace:
+			if mode != formattingConvert {
+				continue
+			}
+
+			index := -1
+			for j, style := range openStyles {
+				if style == r {
+					index = j
+				}
+			}
+
+			if index < 0 {
+				openStyles = append(openStyles, r)
+				output.WriteString(slackMarkupForIRCStyle[r])
+			} else {
+				// Slack markup can't overlap, so close everything opened since, then reopen it
+				reopen := append([]rune(nil), openStyles[index+1:]...)
+				for j := len(openStyles) - 1; j >= index; j-- {
+					output.WriteString(slackMarkupForIRCStyle[openStyles[j]])
+				}
+				openStyles = openStyles[:index]
+				for _, style := range reopen {
+					openStyles = append(openStyles, style)
+					output.WriteString(slackMarkupForIRCStyle[style])
+				}
+			}
+		default:
+			output.WriteRune(r)
+		}
+	}
+
+	if mode == formattingConvert {
+		closeStyles()
+	}
+
+	return output.String()
+}
+
+// Returns the index just past a color code's "fg[,bg]" digits, starting at start
+func skipIRCColorDigits(runes []rune, start int, maxDigits int, isDigit func(rune) bool) int {
+	i := skipDigits(runes, start, maxDigits, isDigit)
+	if i == start {
+		return i
+	}
+
+	if i+1 < len(runes) && runes[i] == ',' && isDigit(runes[i+1]) {
+		return skipDigits(runes, i+1, maxDigits, isDigit)
+	}
+
+	return i
+}
+
+func skipDigits(runes []rune, start int, maxDigits int, isDigit func(rune) bool) int {
+	i := start
+	for i < len(runes) && i-start < maxDigits && isDigit(runes[i]) {
+		i++
+	}
+	return i
+}
+
+func isDecimalDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+func isHexDigit(r rune) bool {
+	return isDecimalDigit(r) || (r >= 'a' && r <= 'f') || (r >= 'A' && r <= 'F')
+}
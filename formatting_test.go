@@ -0,0 +1,58 @@
+package pino
+
+import (
+	"testing"
+)
+
+func TestFormatIRCTextForSlack(t *testing.T) {
+	tests := []struct {
+		text     string
+		mode     string
+		expected string
+	}{
+		{"plain text", formattingConvert, "plain text"},
+		{"\x02bold\x02 text", formattingConvert, "*bold* text"},
+		{"\x1ditalic\x1d and \x1estruck\x1e", formattingConvert, "_italic_ and ~struck~"},
+		{"\x11code\x11", formattingConvert, "`code`"},
+		// Styles left open at the end of the line are closed
+		{"\x02bold", formattingConvert, "*bold*"},
+		{"\x02bold \x1dboth\x0f none", formattingConvert, "*bold _both_* none"},
+		// Closing a style opened before another one closes and reopens the other
+		{"\x02a\x1db\x02c\x1d", formattingConvert, "*a_b_*_c_"},
+		{"\x0304red\x03 \x0304,12on blue\x03", formattingConvert, "red on blue"},
+		{"\x03,not a background", formattingConvert, ",not a background"},
+		{"\x0312345", formattingConvert, "345"},
+		{"\x04ff0000red\x04", formattingConvert, "red"},
+		{"\x1funderlined\x1f \x16reversed\x16", formattingConvert, "underlined reversed"},
+
+		{"\x02bold\x02 \x0304red\x03 \x1ditalic\x1d\x0f", formattingStrip, "bold red italic"},
+
+		{"\x02bold\x02", formattingRaw, "\x02bold\x02"},
+	}
+
+	for _, test := range tests {
+		if formatted := formatIRCTextForSlack(test.text, test.mode); formatted != test.expected {
+			t.Errorf("formatIRCTextForSlack(%q, %v) = %q, expected %q", test.text, test.mode, formatted, test.expected)
+		}
+	}
+}
+
+func TestBridgeFormatForSlack(t *testing.T) {
+	tests := []struct {
+		formatting string
+		expected   string
+	}{
+		// Converting is the default
+		{"", "*bold* red"},
+		{formattingConvert, "*bold* red"},
+		{formattingStrip, "bold red"},
+		{formattingRaw, "\x02bold\x02 \x0304red\x03"},
+	}
+
+	for _, test := range tests {
+		bridge := &bridge{config: &BridgeConfig{Formatting: test.formatting}}
+		if formatted := bridge.formatForSlack("\x02bold\x02 \x0304red\x03"); formatted != test.expected {
+			t.Errorf("With Formatting %q, formatForSlack = %q, expected %q", test.formatting, formatted, test.expected)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package pino
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// What a highlight rule can do when it matches
+const (
+	// Mention the owner in the bridged Slack channel
+	highlightActionMention = "mention"
+	// DM the owner, with a link to the relayed message
+	highlightActionDM = "dm"
+	// Add a reaction to the relayed message
+	highlightActionReact = "react"
+	// Don't relay the message to Slack at all
+	highlightActionSuppress = "suppress"
+)
+
+// Rules scoped to this pseudo-channel apply to private messages
+const highlightPrivateMessageScope = "pm"
+
+const defaultHighlightReaction = "eyes"
+
+type ircHighlightRule struct {
+	nickRegexp     *regexp.Regexp
+	messageRegexp  *regexp.Regexp
+	hostmaskRegexp *regexp.Regexp
+	accountRegexp  *regexp.Regexp
+	// Lowercased IRC channels (or highlightPrivateMessageScope) the rule applies to. Empty means everywhere.
+	channels map[string]bool
+	actions  map[string]bool
+	reaction string
+}
+
+// An IRC message being checked against the highlight rules
+type ircHighlightCandidate struct {
+	// Empty for private messages
+	channel  IRCChannel
+	nick     string
+	usermask string
+	// The services account of the sender, if the server told us
+	account string
+	text    string
+}
+
+func compileHighlightRules(configs []IRCHighlightRuleConfig) ([]*ircHighlightRule, error) {
+	rules := make([]*ircHighlightRule, len(configs))
+	for i, highlightConfig := range configs {
+		rule := &ircHighlightRule{
+			channels: make(map[string]bool),
+			actions:  make(map[string]bool),
+			reaction: highlightConfig.Reaction,
+		}
+		var err error
+
+		if rule.nickRegexp, err = compileHighlightPattern(highlightConfig.NickPattern, highlightConfig.CaseInsensitive, false); err != nil {
+			return nil, fmt.Errorf("Invalid highlight NickPattern %q: %v", highlightConfig.NickPattern, err)
+		}
+		if rule.messageRegexp, err = compileHighlightPattern(highlightConfig.MessagePattern, highlightConfig.CaseInsensitive, highlightConfig.WholeWord); err != nil {
+			return nil, fmt.Errorf("Invalid highlight MessagePattern %q: %v", highlightConfig.MessagePattern, err)
+		}
+		if rule.hostmaskRegexp, err = compileHighlightPattern(highlightConfig.HostmaskPattern, highlightConfig.CaseInsensitive, false); err != nil {
+			return nil, fmt.Errorf("Invalid highlight HostmaskPattern %q: %v", highlightConfig.HostmaskPattern, err)
+		}
+		if rule.accountRegexp, err = compileHighlightPattern(highlightConfig.AccountPattern, highlightConfig.CaseInsensitive, false); err != nil {
+			return nil, fmt.Errorf("Invalid highlight AccountPattern %q: %v", highlightConfig.AccountPattern, err)
+		}
+
+		for _, channel := range highlightConfig.Channels {
+			rule.channels[strings.ToLower(channel)] = true
+		}
+
+		actions := highlightConfig.Actions
+		if len(actions) == 0 && highlightConfig.ShouldHighlight {
+			// Rules from before there were actions just mention the owner
+			actions = []string{highlightActionMention}
+		}
+		for _, action := range actions {
+			switch action {
+			case highlightActionMention, highlightActionDM, highlightActionReact, highlightActionSuppress:
+				rule.actions[action] = true
+			default:
+				return nil, fmt.Errorf("Unknown highlight action: %v", action)
+			}
+		}
+
+		if rule.reaction == "" {
+			rule.reaction = defaultHighlightReaction
+		}
+
+		rules[i] = rule
+	}
+
+	return rules, nil
+}
+
+func compileHighlightPattern(pattern string, caseInsensitive bool, wholeWord bool) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+
+	if wholeWord {
+		pattern = `\b(?:` + pattern + `)\b`
+	}
+	if caseInsensitive {
+		pattern = "(?i)" + pattern
+	}
+
+	return regexp.Compile(pattern)
+}
+
+func (rule *ircHighlightRule) appliesTo(channel IRCChannel) bool {
+	if len(rule.channels) == 0 {
+		return true
+	}
+
+	if channel == "" {
+		return rule.channels[highlightPrivateMessageScope]
+	}
+
+	return rule.channels[strings.ToLower(string(channel))]
+}
+
+func (rule *ircHighlightRule) matches(candidate *ircHighlightCandidate) bool {
+	if !rule.appliesTo(candidate.channel) {
+		return false
+	}
+
+	patterns := []struct {
+		pattern *regexp.Regexp
+		value   string
+	}{
+		{rule.nickRegexp, candidate.nick},
+		{rule.messageRegexp, candidate.text},
+		{rule.hostmaskRegexp, candidate.usermask},
+		{rule.accountRegexp, candidate.account},
+	}
+
+	// A pattern that isn't defined matches everything
+	for _, p := range patterns {
+		if p.pattern != nil && !p.pattern.MatchString(p.value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (rule *ircHighlightRule) has(action string) bool {
+	return rule != nil && rule.actions[action]
+}
+
+// Finds the first rule that matches the message, or nil if none do.
+// A rule without any actions still counts, so it can stop later rules from matching.
+func matchHighlightRule(rules []*ircHighlightRule, candidate *ircHighlightCandidate) *ircHighlightRule {
+	for _, rule := range rules {
+		if rule.matches(candidate) {
+			return rule
+		}
+	}
+
+	return nil
+}
+
+// Whether the text mentions the nick as a whole word, ignoring case.
+// Nicks can contain characters like "[" and "|" that regexp word boundaries don't handle,
+// so the boundaries are any characters that can't be part of a nick.
+func containsIRCNick(text string, nick string) bool {
+	if nick == "" {
+		return false
+	}
+
+	text = strings.ToLower(text)
+	nick = strings.ToLower(nick)
+
+	for offset := 0; offset < len(text); {
+		i := strings.Index(text[offset:], nick)
+		if i < 0 {
+			return false
+		}
+		start := offset + i
+		end := start + len(nick)
+
+		before, _ := utf8.DecodeLastRuneInString(text[:start])
+		after, _ := utf8.DecodeRuneInString(text[end:])
+		if (start == 0 || !isIRCNickRune(before)) && (end == len(text) || !isIRCNickRune(after)) {
+			return true
+		}
+
+		offset = start + 1
+	}
+
+	return false
+}
+
+func isIRCNickRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("-[]\\`^{}|_", r)
+}
@@ -0,0 +1,95 @@
+package pino
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatchHighlightRule(t *testing.T) {
+	rules, err := compileHighlightRules([]IRCHighlightRuleConfig{
+		// Ignore a bot everywhere, without doing anything
+		{NickPattern: "^bot$"},
+		{MessagePattern: "deploy", WholeWord: true, CaseInsensitive: true, Actions: []string{highlightActionDM}, Channels: []string{"#Ops"}},
+		{AccountPattern: "^boss$", Actions: []string{highlightActionMention, highlightActionReact}, Reaction: "star"},
+		{HostmaskPattern: `@spam\.example\.com$`, Actions: []string{highlightActionSuppress}},
+		{MessagePattern: "ping me", ShouldHighlight: true, Channels: []string{highlightPrivateMessageScope}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		candidate *ircHighlightCandidate
+		// The index of the rule expected to match, or -1 for none
+		rule int
+	}{
+		{&ircHighlightCandidate{channel: "#ops", nick: "bot", text: "deploy"}, 0},
+		{&ircHighlightCandidate{channel: "#ops", nick: "alice", text: "Deploy done"}, 1},
+		{&ircHighlightCandidate{channel: "#OPS", nick: "alice", text: "time to DEPLOY!"}, 1},
+		// Not a whole word
+		{&ircHighlightCandidate{channel: "#ops", nick: "alice", text: "redeployed"}, -1},
+		// Not in scope
+		{&ircHighlightCandidate{channel: "#dev", nick: "alice", text: "deploy"}, -1},
+		{&ircHighlightCandidate{channel: "#dev", nick: "carol", account: "boss", text: "hi"}, 2},
+		{&ircHighlightCandidate{channel: "#dev", nick: "boss", account: "", text: "hi"}, -1},
+		{&ircHighlightCandidate{channel: "#dev", nick: "eve", usermask: "eve!e@spam.example.com", text: "buy"}, 3},
+		{&ircHighlightCandidate{nick: "dave", text: "ping me"}, 4},
+		{&ircHighlightCandidate{channel: "#dev", nick: "dave", text: "ping me"}, -1},
+	}
+
+	for _, test := range tests {
+		rule := matchHighlightRule(rules, test.candidate)
+		if test.rule < 0 && rule != nil || test.rule >= 0 && rule != rules[test.rule] {
+			t.Errorf("Expected %+v to match rule %v, got %+v", test.candidate, test.rule, rule)
+		}
+	}
+
+	if rules[0].has(highlightActionMention) || !rules[2].has(highlightActionReact) || rules[2].reaction != "star" {
+		t.Errorf("Unexpected actions")
+	}
+	if !rules[4].has(highlightActionMention) || rules[1].reaction != defaultHighlightReaction {
+		t.Errorf("Expected ShouldHighlight to mean mention, and the default reaction")
+	}
+}
+
+func TestInvalidHighlightRules(t *testing.T) {
+	tests := []struct {
+		config   IRCHighlightRuleConfig
+		expected string
+	}{
+		{IRCHighlightRuleConfig{NickPattern: "("}, "Invalid highlight NickPattern"},
+		{IRCHighlightRuleConfig{MessagePattern: "["}, "Invalid highlight MessagePattern"},
+		{IRCHighlightRuleConfig{MessagePattern: "hi", Actions: []string{"shout"}}, "Unknown highlight action: shout"},
+	}
+
+	for _, test := range tests {
+		_, err := compileHighlightRules([]IRCHighlightRuleConfig{test.config})
+		if err == nil || !strings.HasPrefix(err.Error(), test.expected) {
+			t.Errorf("compileHighlightRules(%+v) returned %v, expected %q", test.config, err, test.expected)
+		}
+	}
+}
+
+func TestContainsIRCNick(t *testing.T) {
+	tests := []struct {
+		text     string
+		nick     string
+		expected bool
+	}{
+		{"alice: hi", "alice", true},
+		{"hi ALICE", "alice", true},
+		{"hi alice_", "alice", false},
+		{"malice", "alice", false},
+		{"malice and alice", "alice", true},
+		{"[away]bob, hello", "[away]bob", true},
+		{"x[away]bob", "[away]bob", false},
+		{"ping a|b.", "a|b", true},
+		{"anything", "", false},
+	}
+
+	for _, test := range tests {
+		if contains := containsIRCNick(test.text, test.nick); contains != test.expected {
+			t.Errorf("containsIRCNick(%q, %q) = %v, expected %v", test.text, test.nick, contains, test.expected)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package pino
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	ircLastSeenFilename = "irc-last-seen.json"
+	// How often the last-seen timestamps are written to disk, if they've changed
+	ircLastSeenSaveInterval = 10 * time.Second
+)
+
+// The ircHistoryBackfill remembers when we last saw a message in each channel, across restarts,
+// so that after rejoining we can ask the server for everything we missed with CHATHISTORY AFTER.
+type ircHistoryBackfill struct {
+	// Asks the server for the channel's messages since the given time
+	requestHistoryAfter func(channel IRCChannel, after time.Time)
+
+	mutex sync.Mutex
+	// Keyed by lowercased channel
+	lastSeen map[IRCChannel]time.Time
+	// When we last joined each channel. History from after this reached us live,
+	// so it's not relayed again.
+	joinedAt map[IRCChannel]time.Time
+	state    *jsonStateFile
+}
+
+func newIRCHistoryBackfill(stateDirectory string, filename string, requestHistoryAfter func(channel IRCChannel, after time.Time)) *ircHistoryBackfill {
+	backfill := &ircHistoryBackfill{
+		requestHistoryAfter: requestHistoryAfter,
+		lastSeen:            make(map[IRCChannel]time.Time),
+		joinedAt:            make(map[IRCChannel]time.Time),
+	}
+	backfill.state = newJSONStateFile(stateDirectory, filename, "IRC last-seen times", &backfill.mutex, func() interface{} {
+		return backfill.lastSeen
+	})
+
+	lastSeen := make(map[IRCChannel]time.Time)
+	if backfill.state.load(&lastSeen) {
+		for channel, t := range lastSeen {
+			backfill.lastSeen[ircChannelKey(channel)] = t
+		}
+	}
+	backfill.state.saveRegularly(ircLastSeenSaveInterval)
+
+	return backfill
+}
+
+// Records that we've seen a message from the channel that was sent at the given time
+func (backfill *ircHistoryBackfill) recordSeen(channel IRCChannel, t time.Time) {
+	if !isIRCChannelName(string(channel)) {
+		// Private messages have no history to fetch
+		return
+	}
+	key := ircChannelKey(channel)
+
+	backfill.mutex.Lock()
+	defer backfill.mutex.Unlock()
+
+	if t.After(backfill.lastSeen[key]) {
+		backfill.lastSeen[key] = t
+		backfill.state.changed()
+	}
+}
+
+// When we last saw a message in the channel, if we ever have
+func (backfill *ircHistoryBackfill) lastSeenIn(channel IRCChannel) (time.Time, bool) {
+	backfill.mutex.Lock()
+	defer backfill.mutex.Unlock()
+
+	lastSeen, ok := backfill.lastSeen[ircChannelKey(channel)]
+	return lastSeen, ok
+}
+
+// Records that we've just joined the channel, and returns when we last saw a message there.
+// Returns false if we've never seen the channel before, so there's nothing to catch up on.
+func (backfill *ircHistoryBackfill) joined(channel IRCChannel, t time.Time) (time.Time, bool) {
+	key := ircChannelKey(channel)
+
+	backfill.mutex.Lock()
+	defer backfill.mutex.Unlock()
+
+	backfill.joinedAt[key] = t
+
+	lastSeen, ok := backfill.lastSeen[key]
+	return lastSeen, ok
+}
+
+// Whether a line from the channel's history was sent before we joined, so it wasn't relayed live
+func (backfill *ircHistoryBackfill) wasMissed(channel IRCChannel, t time.Time) bool {
+	key := ircChannelKey(channel)
+
+	backfill.mutex.Lock()
+	defer backfill.mutex.Unlock()
+
+	joinedAt, ok := backfill.joinedAt[key]
+	return !ok || t.Before(joinedAt)
+}
+
+// Whether the server has told us the batch contains channel history
+func isIRCHistoryBatch(batch *ircBatch) bool {
+	return batch != nil && (batch.batchType == "chathistory" || batch.batchType == "draft/chathistory")
+}
@@ -0,0 +1,126 @@
+package pino
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+// A network with no bridges, recording the history it asks the server for
+func newTestHistoryNetwork(stateDirectory string, requested *[]string) *ircNetwork {
+	return &ircNetwork{
+		proxy:           &ircProxy{nick: "pino"},
+		recentlyRelayed: newRecentlyRelayedMessages(),
+		history: newIRCHistoryBackfill(stateDirectory, ircLastSeenFilename, func(channel IRCChannel, after time.Time) {
+			*requested = append(*requested, fmt.Sprintf("%v %v", channel, after.Format("15:04")))
+		}),
+		bridgesByIRCChannel: make(map[IRCChannel][]*bridge),
+	}
+}
+
+func TestCatchUpOnIRCChannel(t *testing.T) {
+	var requested []string
+	network := newTestHistoryNetwork("", &requested)
+	pino := &Pino{messages: &messageStore{}}
+	start := time.Date(2016, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	// There's nothing to catch up on in a channel we've never seen
+	pino.catchUpOnIRCChannel(network, "#go", start)
+	if len(requested) != 0 {
+		t.Errorf("Expected no history to be requested, got %v", requested)
+	}
+
+	network.history.recordSeen("#go", start.Add(time.Minute))
+	pino.catchUpOnIRCChannel(network, "#Go", start.Add(time.Hour))
+	if fmt.Sprint(requested) != "[#Go 12:01]" {
+		t.Errorf("Expected history since the last message we saw, got %v", requested)
+	}
+}
+
+func TestHandleIRCHistoryLine(t *testing.T) {
+	var requested []string
+	network := newTestHistoryNetwork("", &requested)
+	pino := &Pino{messages: &messageStore{}}
+	joinedAt := time.Date(2016, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	network.history.recordSeen("#go", joinedAt.Add(-time.Hour))
+	pino.catchUpOnIRCChannel(network, "#go", joinedAt)
+
+	historyLine := func(nick string, sentAt time.Time) *irc.Line {
+		return &irc.Line{
+			Cmd:  irc.PRIVMSG,
+			Nick: nick,
+			Src:  nick + "!user@example.com",
+			Args: []string{"#go", "hello"},
+			Tags: map[string]string{"time": sentAt.Format(time.RFC3339Nano)},
+		}
+	}
+
+	tests := []struct {
+		line     *irc.Line
+		lastSeen time.Time
+	}{
+		// Missed while we were away
+		{historyLine("alice", joinedAt.Add(-30*time.Minute)), joinedAt.Add(-30 * time.Minute)},
+		// Our own messages came from Slack
+		{historyLine("pino", joinedAt.Add(-10*time.Minute)), joinedAt.Add(-30 * time.Minute)},
+		// This reached us live after we joined
+		{historyLine("bob", joinedAt.Add(time.Minute)), joinedAt.Add(-30 * time.Minute)},
+		// Only messages count
+		{&irc.Line{Cmd: irc.JOIN, Nick: "carol", Args: []string{"#go"}, Tags: map[string]string{"time": joinedAt.Add(-5 * time.Minute).Format(time.RFC3339Nano)}}, joinedAt.Add(-30 * time.Minute)},
+		{historyLine("dave", joinedAt.Add(-time.Minute)), joinedAt.Add(-time.Minute)},
+	}
+
+	for _, test := range tests {
+		pino.handleIRCHistoryLine(network, test.line)
+		if lastSeen, _ := network.history.lastSeenIn("#go"); !lastSeen.Equal(test.lastSeen) {
+			t.Errorf("After %v from %v, last seen %v, expected %v", test.line.Cmd, test.line.Nick, lastSeen, test.lastSeen)
+		}
+	}
+}
+
+func TestIRCHistoryBackfillWasMissed(t *testing.T) {
+	backfill := newIRCHistoryBackfill("", ircLastSeenFilename, func(IRCChannel, time.Time) {})
+	joinedAt := time.Date(2016, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	// Before we've joined, everything was missed
+	if !backfill.wasMissed("#go", joinedAt) {
+		t.Error("Expected lines from a channel we haven't joined to be missed")
+	}
+
+	backfill.joined("#Go", joinedAt)
+	if !backfill.wasMissed("#go", joinedAt.Add(-time.Second)) {
+		t.Error("Expected a line from before we joined to be missed")
+	}
+	if backfill.wasMissed("#GO", joinedAt.Add(time.Second)) {
+		t.Error("Expected a line from after we joined to have reached us live")
+	}
+}
+
+func TestIRCHistoryBackfillPersistsLastSeen(t *testing.T) {
+	directory, err := ioutil.TempDir("", "pino-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	lastSeen := time.Date(2016, 10, 18, 12, 0, 0, 0, time.UTC)
+	backfill := newIRCHistoryBackfill(directory, ircLastSeenFilename, func(IRCChannel, time.Time) {})
+	backfill.recordSeen("#Go", lastSeen)
+	// Older messages and private messages don't move it
+	backfill.recordSeen("#go", lastSeen.Add(-time.Hour))
+	backfill.recordSeen("alice", lastSeen.Add(time.Hour))
+	backfill.state.save()
+
+	restarted := newIRCHistoryBackfill(directory, ircLastSeenFilename, func(IRCChannel, time.Time) {})
+	if seen, ok := restarted.lastSeenIn("#GO"); !ok || !seen.Equal(lastSeen) {
+		t.Errorf("Expected #go to have been last seen at %v, got %v", lastSeen, seen)
+	}
+	if _, ok := restarted.lastSeenIn("alice"); ok {
+		t.Error("Expected no last-seen time for a private message")
+	}
+}
@@ -3,29 +3,54 @@ package pino
 import (
 	"crypto/tls"
 	"fmt"
-	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	irc "github.com/fluffle/goirc/client"
 )
 
+// IRCv3 commands the client library doesn't know about
+const (
+	ircCapability = "CAP"
+	// A message with only tags, like +typing
+	ircTagMessage = "TAGMSG"
+	// With account-notify, someone logged in to or out of their account
+	ircAccount      = "ACCOUNT"
+	ircBatchCommand = "BATCH"
+)
+
+const defaultIRCHistoryBackfillLimit = 100
+
+// Longer messages get split into several lines, leaving room for the prefix the server adds
+const ircMessageSplitLength = 450
+
 type ircProxy struct {
 	config         *IRCConfig
 	client         *irc.Conn
-	incomingEvents chan *irc.Line
+	intake         *ircIntake
 	highlightRules []*ircHighlightRule
+	// Used when no highlight rule matches a message that mentions our nick, or nil if that's disabled
+	nickHighlightRule *ircHighlightRule
+	caps              *ircCapabilityNegotiator
+	accounts          *ircAccountTracker
+	batches           *ircBatchTracker
+	members           *ircChannelMembers
+
+	stateMutex sync.Mutex
+	// The nick the server has confirmed we're using, or empty while we're not registered
+	nick string
+	// Our away message, or empty if we're not away
+	awayMessage string
 }
 
-type ircHighlightRule struct {
-	nickRegexp      *regexp.Regexp
-	messageRegexp   *regexp.Regexp
-	shouldHighlight bool
-}
-
-func newIRCProxy(config *IRCConfig) (*ircProxy, error) {
+func newIRCProxy(config *IRCConfig, handleEvent func(*ircEvent)) (*ircProxy, error) {
 	proxy := new(ircProxy)
 	proxy.config = config
-	proxy.incomingEvents = make(chan *irc.Line)
+	proxy.intake = newIRCIntake(proxy, config.IntakeQueueSize, handleEvent)
+	proxy.accounts = newIRCAccountTracker()
+	proxy.batches = newIRCBatchTracker()
+	proxy.members = newIRCChannelMembers()
 
 	nick := config.Nickname
 	if nick == "" {
@@ -42,23 +67,21 @@ func newIRCProxy(config *IRCConfig) (*ircProxy, error) {
 		return nil, fmt.Errorf("Server must be defined in IRC config")
 	}
 
-	proxy.highlightRules = make([]*ircHighlightRule, len(config.HighlightRules))
-	for i, highlightConfig := range config.HighlightRules {
-		var nickRegexp *regexp.Regexp
-		var messageRegexp *regexp.Regexp
-
-		if highlightConfig.NickPattern != "" {
-			nickRegexp = regexp.MustCompile(highlightConfig.NickPattern)
-		}
+	caps, err := newIRCCapabilityNegotiator(func(line string) { proxy.client.Raw(line) }, config.DisabledCapabilities)
+	if err != nil {
+		return nil, err
+	}
+	proxy.caps = caps
 
-		if highlightConfig.MessagePattern != "" {
-			messageRegexp = regexp.MustCompile(highlightConfig.MessagePattern)
-		}
+	highlightRules, err := compileHighlightRules(config.HighlightRules)
+	if err != nil {
+		return nil, err
+	}
+	proxy.highlightRules = highlightRules
 
-		proxy.highlightRules[i] = &ircHighlightRule{
-			nickRegexp:      nickRegexp,
-			messageRegexp:   messageRegexp,
-			shouldHighlight: highlightConfig.ShouldHighlight,
+	if !config.DisableNickHighlight {
+		proxy.nickHighlightRule = &ircHighlightRule{
+			actions: map[string]bool{highlightActionMention: true},
 		}
 	}
 
@@ -69,6 +92,11 @@ func newIRCProxy(config *IRCConfig) (*ircProxy, error) {
 	clientConfig.Pass = config.Password
 	clientConfig.SSL = config.IsSSL
 	clientConfig.SSLConfig = &tls.Config{InsecureSkipVerify: true}
+	clientConfig.SplitLen = ircMessageSplitLength
+	// CAP LS goes out ahead of NICK and USER, so the server waits for our capabilities to be
+	// settled before it welcomes us
+	clientConfig.EnableCapabilityNegotiation = true
+	clientConfig.Capabilites = proxy.caps.wantedCapabilities()
 
 	proxy.client = irc.Client(clientConfig)
 	proxy.client.EnableStateTracking()
@@ -92,14 +120,66 @@ func (proxy *ircProxy) registerEventHandlers() {
 		irc.PRIVMSG,
 		irc.QUIT,
 		irc.TOPIC,
+		irc.NOTICE,
+		ircTagMessage,
+	}
+	for numeric := range ircErrorDescriptions {
+		eventTypes = append(eventTypes, numeric)
 	}
 
-	sendLineToChannel := func(conn *irc.Conn, line *irc.Line) {
-		proxy.incomingEvents <- line
+	enqueueLine := func(conn *irc.Conn, line *irc.Line) {
+		proxy.intake.enqueue(line)
+		// Only now, so the intake could see which channels a nick was in before it quit
+		proxy.members.handle(line, proxy.currentNick())
 	}
 
 	for _, eventType := range eventTypes {
-		proxy.client.HandleFunc(eventType, sendLineToChannel)
+		proxy.client.HandleFunc(eventType, enqueueLine)
+	}
+
+	// Our nick is tracked as the lines arrive, rather than through the intake, so that
+	// it's already right by the time the intake handles anything addressed to the new nick.
+	proxy.client.HandleFunc("001", func(conn *irc.Conn, line *irc.Line) {
+		// RPL_WELCOME is addressed to the nick the server registered us with
+		proxy.setNick(line.Args[0])
+	})
+	proxy.client.HandleFunc("433", func(conn *irc.Conn, line *irc.Line) {
+		// ERR_NICKNAMEINUSE leaves us with whatever nick we had. During registration,
+		// the client tries another one and 001 tells us which one worked.
+		fmt.Printf("Nick %v is already in use\n", line.Args[1])
+	})
+	proxy.client.HandleFunc(irc.NICK, func(conn *irc.Conn, line *irc.Line) {
+		if strings.EqualFold(line.Nick, proxy.currentNick()) {
+			proxy.setNick(line.Args[0])
+		}
+	})
+	proxy.client.HandleFunc(irc.DISCONNECTED, func(conn *irc.Conn, line *irc.Line) {
+		proxy.setNick("")
+
+		// The server forgets we were away, and what we negotiated, once we're disconnected
+		proxy.stateMutex.Lock()
+		proxy.awayMessage = ""
+		proxy.stateMutex.Unlock()
+		proxy.caps.reset()
+		proxy.batches.reset()
+		proxy.members.reset()
+	})
+
+	proxy.client.HandleFunc(ircCapability, func(conn *irc.Conn, line *irc.Line) {
+		proxy.caps.handle(line)
+	})
+	proxy.client.HandleFunc(ircBatchCommand, func(conn *irc.Conn, line *irc.Line) {
+		proxy.batches.handle(line)
+	})
+	proxy.client.HandleFunc("353", func(conn *irc.Conn, line *irc.Line) {
+		proxy.members.handle(line, proxy.currentNick())
+	})
+
+	trackAccounts := func(conn *irc.Conn, line *irc.Line) {
+		proxy.accounts.handle(line)
+	}
+	for _, eventType := range []string{irc.JOIN, ircAccount, irc.NICK, irc.QUIT, irc.PRIVMSG, irc.ACTION, irc.NOTICE} {
+		proxy.client.HandleFunc(eventType, trackAccounts)
 	}
 }
 
@@ -107,6 +187,54 @@ func (proxy *ircProxy) connect() error {
 	return proxy.client.Connect()
 }
 
+func (proxy *ircProxy) isConnected() bool {
+	return proxy.client.Connected()
+}
+
+// The nick we're currently using on IRC
+func (proxy *ircProxy) currentNick() string {
+	proxy.stateMutex.Lock()
+	defer proxy.stateMutex.Unlock()
+
+	if proxy.nick == "" {
+		// We haven't registered yet, so this is the nick we're trying for
+		return proxy.client.Me().Nick
+	}
+
+	return proxy.nick
+}
+
+func (proxy *ircProxy) setNick(nick string) {
+	proxy.stateMutex.Lock()
+	defer proxy.stateMutex.Unlock()
+
+	if nick != "" && nick != proxy.nick {
+		fmt.Printf("Our IRC nick is now %v\n", nick)
+	}
+	proxy.nick = nick
+}
+
+// Finds the highlight rule for a message. If none of the rules match, a message that
+// mentions our current nick or one of its aliases gets the default nick highlight.
+func (proxy *ircProxy) highlightRuleFor(rules []*ircHighlightRule, candidate *ircHighlightCandidate) *ircHighlightRule {
+	if rule := matchHighlightRule(rules, candidate); rule != nil {
+		return rule
+	}
+
+	if proxy.nickHighlightRule == nil {
+		return nil
+	}
+
+	nicks := append([]string{proxy.currentNick()}, proxy.config.NickAliases...)
+	for _, nick := range nicks {
+		if containsIRCNick(candidate.text, nick) {
+			return proxy.nickHighlightRule
+		}
+	}
+
+	return nil
+}
+
 // Connect to the configured channel
 func (proxy *ircProxy) join(channel IRCChannel) {
 	key := proxy.config.Channels[channel]
@@ -116,97 +244,145 @@ func (proxy *ircProxy) join(channel IRCChannel) {
 // Get the list of names in a channel.
 // Note that this is sometimes wrong right when we join a channel (before we've received the list of names).
 func (proxy *ircProxy) names(channel IRCChannel) []string {
-	statefulChannel := proxy.client.StateTracker().GetChannel(string(channel))
-	channelNicks := statefulChannel.Nicks
+	return proxy.members.names(channel)
+}
 
-	names := make([]string, len(channelNicks))
-	i := 0
-	for name := range channelNicks {
-		names[i] = name
-		i++
-	}
+// The configured channels the nick is in
+func (proxy *ircProxy) channelsOf(nick string) []IRCChannel {
+	return proxy.members.channelsOf(nick, proxy.config.Channels)
+}
 
-	return names
+// Whether the server has enabled an IRCv3 capability, like "server-time", on this connection
+func (proxy *ircProxy) hasCapability(capability string) bool {
+	return proxy.caps.isEnabled(capability)
 }
 
-func (proxy *ircProxy) snapshotOfNicksInChannels() map[IRCChannel]map[string]bool {
-	mapping := make(map[IRCChannel]map[string]bool)
+// The services account of whoever sent the line, or empty if we don't know of one
+func (proxy *ircProxy) accountForLine(line *irc.Line) string {
+	if account, ok := line.Tags["account"]; ok {
+		return account
+	}
 
-	st := proxy.client.StateTracker()
-	for channelName := range proxy.config.Channels {
-		channel := st.GetChannel(string(channelName))
-		if channel == nil {
-			continue
-		}
+	return proxy.accounts.accountFor(line.Nick)
+}
 
-		mapping[channelName] = make(map[string]bool)
+// Asks for the channel's messages since the given time, if the server can tell us.
+// They arrive in a chathistory batch.
+func (proxy *ircProxy) requestHistoryAfter(channel IRCChannel, after time.Time) {
+	if !proxy.supportsHistory() {
+		return
+	}
 
-		for nickname := range channel.Nicks {
-			mapping[channelName][nickname] = true
-		}
+	fmt.Printf("Fetching history for %v since %v\n", channel, after)
+	limit := proxy.config.HistoryBackfillLimit
+	if limit <= 0 {
+		limit = defaultIRCHistoryBackfillLimit
 	}
 
-	return mapping
+	timestamp := after.UTC().Format("2006-01-02T15:04:05.000Z")
+	proxy.client.Raw(fmt.Sprintf("CHATHISTORY AFTER %v timestamp=%v %v", channel, timestamp, limit))
 }
 
-func (proxy *ircProxy) sendMessage(channel IRCChannel, text string) {
-	lines := strings.Split(text, "\n")
-	for _, line := range lines {
-		proxy.client.Privmsg(string(channel), line)
-	}
+// Whether the server lets us fetch channel history
+func (proxy *ircProxy) supportsHistory() bool {
+	return proxy.hasCapability("draft/chathistory") || proxy.hasCapability("chathistory")
 }
 
-func (proxy *ircProxy) sendAction(channel IRCChannel, action string) {
-	lines := strings.Split(action, "\n")
-	for _, line := range lines {
-		proxy.client.Action(string(channel), line)
+// Tells the channel whether we're typing, if the server lets us send tags
+func (proxy *ircProxy) sendTyping(channel IRCChannel, typing string) {
+	if !proxy.hasCapability("message-tags") {
+		return
 	}
+
+	tags := formatIRCTags(map[string]string{"+typing": typing})
+	proxy.client.Raw(fmt.Sprintf("%v %v %v", tags, ircTagMessage, channel))
 }
 
-func isBufferPlaybackStartLine(line *irc.Line) bool {
-	if line.Cmd != irc.PRIVMSG {
-		return false
+// Marks us away with the message, or back if the message is empty.
+// Nothing is sent if that's what the server already thinks.
+func (proxy *ircProxy) setAway(message string) {
+	proxy.stateMutex.Lock()
+	if message == proxy.awayMessage || !proxy.client.Connected() {
+		proxy.stateMutex.Unlock()
+		return
 	}
-
-	if line.Nick != "***" {
-		return false
+	proxy.awayMessage = message
+	// Sending can block on the connection, which shouldn't hold up anything waiting on our state
+	proxy.stateMutex.Unlock()
+
+	if message == "" {
+		proxy.client.Away()
+	} else {
+		proxy.client.Away(message)
 	}
+}
 
-	return line.Text() == "Buffer Playback..."
+func (proxy *ircProxy) sendNotice(target string, text string) {
+	proxy.client.Notice(target, text)
 }
 
-func isBufferPlaybackEndLine(line *irc.Line) bool {
-	if line.Cmd != irc.PRIVMSG {
-		return false
+// Sends a message, returning the lines it went out as
+func (proxy *ircProxy) sendMessage(channel IRCChannel, text string) []string {
+	var sent []string
+	for _, line := range strings.Split(text, "\n") {
+		proxy.client.Privmsg(string(channel), line)
+		sent = append(sent, splitIRCMessage(line, ircMessageSplitLength)...)
 	}
+	return sent
+}
 
-	if line.Nick != "***" {
-		return false
+// Sends an action, returning the lines it went out as
+func (proxy *ircProxy) sendAction(channel IRCChannel, action string) []string {
+	var sent []string
+	for _, line := range strings.Split(action, "\n") {
+		proxy.client.Action(string(channel), line)
+		sent = append(sent, splitIRCMessage(line, ircMessageSplitLength)...)
 	}
-
-	return line.Text() == "Playback Complete."
+	return sent
 }
 
-func (proxy *ircProxy) shouldHighlightOwnerOnMessageByNick(message, nick string) bool {
-	if len(proxy.highlightRules) == 0 {
-		return false
+// Splits a line that's too long for IRC the same way the client library does when it sends it,
+// so we know what the server will echo back
+func splitIRCMessage(line string, splitLength int) []string {
+	if splitLength < 13 {
+		splitLength = 13
 	}
 
-	for _, rule := range proxy.highlightRules {
-		var nickMatches, messageMatches bool
-
-		if (rule.nickRegexp != nil) && (rule.nickRegexp.FindString(nick) != "") {
-			nickMatches = true
-		}
-
-		if (rule.messageRegexp != nil) && (rule.messageRegexp.FindString(message) != "") {
-			messageMatches = true
+	var parts []string
+	for len(line) > splitLength {
+		index := indexIRCMessageFragment(line[:splitLength-3])
+		if index < 0 {
+			index = splitLength - 3
 		}
+		parts = append(parts, line[:index]+"...")
+		line = line[index:]
+	}
+	return append(parts, line)
+}
 
-		if ((rule.nickRegexp == nil) || nickMatches) && ((rule.messageRegexp == nil) || messageMatches) {
-			return rule.shouldHighlight
+// Where to break a line that's too long: after the last punctuation, or failing that the last space
+func indexIRCMessageFragment(line string) int {
+	last := -1
+	for _, separator := range []string{". ", ", ", "; ", ": ", "! ", "? ", "\" ", "' "} {
+		if index := strings.LastIndex(line, separator); index > last {
+			last = index
 		}
 	}
+	if last > 0 {
+		return last + 2
+	}
+	if index := strings.LastIndex(line, " "); index > 0 {
+		return index + 1
+	}
+	return -1
+}
 
-	return false
+// Whether a notice came before we registered, when servers address us as "*" or "AUTH" since we
+// don't have a nick yet. The line's Target is the sender for anything but a channel, so this checks
+// who the notice is addressed to.
+func isIRCPreRegistrationNotice(line *irc.Line) bool {
+	if len(line.Args) == 0 {
+		return false
+	}
+	return line.Args[0] == "*" || line.Args[0] == "AUTH"
 }
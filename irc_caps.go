@@ -0,0 +1,461 @@
+package pino
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+// The IRCv3 capabilities Pino asks for, if the server offers them
+var ircSupportedCapabilities = []string{
+	// Lines are tagged with when the server saw them
+	"server-time",
+	// Lets us send and receive client tags, like +typing
+	"message-tags",
+	// The server echoes our own messages back, which confirms they were delivered
+	"echo-message",
+	// Tells us when users in our channels go away or come back
+	"away-notify",
+	// Tells us when users in our channels log in to or out of their accounts
+	"account-notify",
+	// Tags messages with the sender's account
+	"account-tag",
+	// JOINs include the user's account and real name
+	"extended-join",
+	// NAMES replies show every prefix a user has, like "@+nick"
+	"multi-prefix",
+	// Groups related lines, like the quits of a netsplit
+	"batch",
+	// Tells us when the server starts or stops offering capabilities
+	"cap-notify",
+	// Lets us fetch what was said while we were gone
+	"draft/chathistory",
+	"chathistory",
+}
+
+// The ircCapabilityNegotiator keeps track of which capabilities are enabled on the current connection.
+// While registering, the client library sends CAP LS ahead of NICK and USER and asks for the
+// capabilities we want, so the server holds off on welcoming us until they've been answered.
+// Capabilities the server starts offering later, with cap-notify, are asked for here.
+type ircCapabilityNegotiator struct {
+	// Sends a raw line to the server
+	send   func(line string)
+	wanted map[string]bool
+
+	mutex sync.Mutex
+	// The capabilities the server offers, with their values (like "sasl" -> "PLAIN,EXTERNAL")
+	available map[string]string
+	enabled   map[string]bool
+}
+
+func newIRCCapabilityNegotiator(send func(line string), disabled []string) (*ircCapabilityNegotiator, error) {
+	negotiator := &ircCapabilityNegotiator{
+		send:      send,
+		wanted:    make(map[string]bool),
+		available: make(map[string]string),
+		enabled:   make(map[string]bool),
+	}
+
+	for _, capability := range ircSupportedCapabilities {
+		negotiator.wanted[capability] = true
+	}
+	for _, capability := range disabled {
+		if !negotiator.wanted[capability] {
+			return nil, fmt.Errorf("Unknown IRC capability in DisabledCapabilities: %v", capability)
+		}
+		delete(negotiator.wanted, capability)
+	}
+
+	return negotiator, nil
+}
+
+// The capabilities to ask for while registering
+func (negotiator *ircCapabilityNegotiator) wantedCapabilities() []string {
+	var capabilities []string
+	for _, capability := range ircSupportedCapabilities {
+		if negotiator.wanted[capability] {
+			capabilities = append(capabilities, capability)
+		}
+	}
+
+	return capabilities
+}
+
+// Forgets everything, since capabilities only last as long as the connection
+func (negotiator *ircCapabilityNegotiator) reset() {
+	negotiator.mutex.Lock()
+	defer negotiator.mutex.Unlock()
+
+	negotiator.available = make(map[string]string)
+	negotiator.enabled = make(map[string]bool)
+}
+
+// Handles a CAP line from the server, like "CAP nick ACK :server-time batch"
+func (negotiator *ircCapabilityNegotiator) handle(line *irc.Line) {
+	if len(line.Args) < 3 {
+		return
+	}
+	subcommand := line.Args[1]
+	capabilities := strings.Fields(line.Args[len(line.Args)-1])
+
+	negotiator.mutex.Lock()
+	defer negotiator.mutex.Unlock()
+
+	switch subcommand {
+	case "LS":
+		// Replies to CAP LS 302 can take several lines, with a "*" before the list on all but the last
+		for _, capability := range capabilities {
+			name, value := splitIRCCapability(capability)
+			negotiator.available[name] = value
+		}
+
+	case "NEW":
+		var offered []string
+		for _, capability := range capabilities {
+			name, value := splitIRCCapability(capability)
+			negotiator.available[name] = value
+			offered = append(offered, name)
+		}
+		negotiator.request(offered)
+
+	case "ACK":
+		for _, capability := range capabilities {
+			if strings.HasPrefix(capability, "-") {
+				delete(negotiator.enabled, capability[1:])
+			} else {
+				negotiator.enabled[capability] = true
+			}
+		}
+		fmt.Printf("IRC server enabled capabilities: %v\n", capabilities)
+
+	case "NAK":
+		fmt.Printf("IRC server refused capabilities: %v\n", capabilities)
+
+	case "DEL":
+		for _, capability := range capabilities {
+			delete(negotiator.available, capability)
+			delete(negotiator.enabled, capability)
+		}
+		fmt.Printf("IRC server no longer offers capabilities: %v\n", capabilities)
+	}
+}
+
+// Asks for the newly offered capabilities we want and don't have yet.
+// The caller must hold the mutex.
+func (negotiator *ircCapabilityNegotiator) request(offered []string) {
+	var requested []string
+	for _, capability := range offered {
+		if negotiator.wanted[capability] && !negotiator.enabled[capability] {
+			requested = append(requested, capability)
+		}
+	}
+
+	if len(requested) == 0 {
+		return
+	}
+
+	sort.Strings(requested)
+	negotiator.send(fmt.Sprintf("CAP REQ :%v", strings.Join(requested, " ")))
+}
+
+func (negotiator *ircCapabilityNegotiator) isEnabled(capability string) bool {
+	negotiator.mutex.Lock()
+	defer negotiator.mutex.Unlock()
+
+	return negotiator.enabled[capability]
+}
+
+// Splits a capability from a CAP LS 302 reply, like "sasl=PLAIN,EXTERNAL", into its name and value
+func splitIRCCapability(capability string) (string, string) {
+	if i := strings.Index(capability, "="); i >= 0 {
+		return capability[:i], capability[i+1:]
+	}
+
+	return capability, ""
+}
+
+// When the server saw the line, from its server-time tag if it has one
+func ircLineTime(line *irc.Line) time.Time {
+	if value, ok := line.Tags["time"]; ok {
+		if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			return t
+		}
+	}
+
+	return line.Time
+}
+
+var ircTagValueEscaper = strings.NewReplacer(`\`, `\\`, ";", `\:`, " ", `\s`, "\r", `\r`, "\n", `\n`)
+
+// Formats tags to go at the start of a line we send, like "@+typing=active"
+func formatIRCTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		if value := tags[key]; value != "" {
+			parts[i] = fmt.Sprintf("%v=%v", key, ircTagValueEscaper.Replace(value))
+		} else {
+			parts[i] = key
+		}
+	}
+
+	return "@" + strings.Join(parts, ";")
+}
+
+// An open IRCv3 batch, like the reply to a CHATHISTORY request
+type ircBatch struct {
+	batchType string
+	params    []string
+}
+
+// The ircBatchTracker follows BATCH lines, so the lines inside a batch can be told apart
+type ircBatchTracker struct {
+	mutex sync.Mutex
+	// Reference tag -> batch
+	open map[string]*ircBatch
+}
+
+func newIRCBatchTracker() *ircBatchTracker {
+	return &ircBatchTracker{open: make(map[string]*ircBatch)}
+}
+
+// Handles a BATCH line, like "BATCH +abc chathistory #channel" or "BATCH -abc"
+func (tracker *ircBatchTracker) handle(line *irc.Line) {
+	if len(line.Args) < 1 || len(line.Args[0]) < 2 {
+		return
+	}
+	reference := line.Args[0][1:]
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	switch line.Args[0][0] {
+	case '+':
+		if len(line.Args) < 2 {
+			return
+		}
+		tracker.open[reference] = &ircBatch{batchType: line.Args[1], params: line.Args[2:]}
+	case '-':
+		delete(tracker.open, reference)
+	}
+}
+
+// The batch the line is part of, or nil if it isn't in one
+func (tracker *ircBatchTracker) batchOf(line *irc.Line) *ircBatch {
+	reference, ok := line.Tags["batch"]
+	if !ok {
+		return nil
+	}
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	return tracker.open[reference]
+}
+
+// Forgets every open batch, since they don't outlive the connection
+func (tracker *ircBatchTracker) reset() {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.open = make(map[string]*ircBatch)
+}
+
+// The ircAccountTracker remembers which services account each user is logged in to,
+// from extended-join, account-notify, and account-tag.
+type ircAccountTracker struct {
+	mutex sync.Mutex
+	// Lowercased nick -> account
+	accounts map[string]string
+}
+
+func newIRCAccountTracker() *ircAccountTracker {
+	return &ircAccountTracker{accounts: make(map[string]string)}
+}
+
+// Updates what we know from a line, if it says anything about accounts
+func (tracker *ircAccountTracker) handle(line *irc.Line) {
+	switch line.Cmd {
+	case irc.JOIN:
+		// With extended-join, JOIN #channel account :Real Name
+		if len(line.Args) >= 3 {
+			tracker.set(line.Nick, line.Args[1])
+		}
+	case "ACCOUNT":
+		if len(line.Args) >= 1 {
+			tracker.set(line.Nick, line.Args[0])
+		}
+	case irc.NICK:
+		tracker.mutex.Lock()
+		oldKey := strings.ToLower(line.Nick)
+		if account, ok := tracker.accounts[oldKey]; ok {
+			delete(tracker.accounts, oldKey)
+			tracker.accounts[strings.ToLower(line.Text())] = account
+		}
+		tracker.mutex.Unlock()
+	case irc.QUIT:
+		tracker.set(line.Nick, "*")
+	default:
+		if account, ok := line.Tags["account"]; ok && line.Nick != "" {
+			tracker.set(line.Nick, account)
+		}
+	}
+}
+
+// Records the account for a nick, where "*" means they're not logged in
+func (tracker *ircAccountTracker) set(nick string, account string) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	if account == "*" || account == "" {
+		delete(tracker.accounts, strings.ToLower(nick))
+	} else {
+		tracker.accounts[strings.ToLower(nick)] = account
+	}
+}
+
+func (tracker *ircAccountTracker) accountFor(nick string) string {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	return tracker.accounts[strings.ToLower(nick)]
+}
+
+// The ircChannelMembers tracks who is in each of our channels. The client library's state
+// tracker only strips one prefix from each name in a NAMES reply, so with multi-prefix it would
+// track "@+nick" as "+nick". Names are parsed here instead, and the library's state is left alone.
+type ircChannelMembers struct {
+	mutex sync.Mutex
+	// Lowercased channel -> lowercased nick -> nick
+	channels map[string]map[string]string
+}
+
+func newIRCChannelMembers() *ircChannelMembers {
+	return &ircChannelMembers{channels: make(map[string]map[string]string)}
+}
+
+// Updates who is where from a line, where ourNick is the nick we're using
+func (members *ircChannelMembers) handle(line *irc.Line, ourNick string) {
+	members.mutex.Lock()
+	defer members.mutex.Unlock()
+
+	isUs := strings.EqualFold(line.Nick, ourNick)
+
+	switch line.Cmd {
+	case "353":
+		// RPL_NAMREPLY: "nick = #channel :@+alice bob"
+		if len(line.Args) < 4 {
+			return
+		}
+		for _, name := range strings.Fields(line.Args[3]) {
+			members.add(line.Args[2], parseIRCName(name))
+		}
+	case irc.JOIN:
+		if len(line.Args) < 1 {
+			return
+		}
+		if isUs {
+			// The NAMES reply that follows tells us who else is there
+			delete(members.channels, strings.ToLower(line.Args[0]))
+		}
+		members.add(line.Args[0], line.Nick)
+	case irc.PART:
+		if len(line.Args) >= 1 {
+			members.remove(line.Args[0], line.Nick, isUs)
+		}
+	case irc.KICK:
+		if len(line.Args) >= 2 {
+			members.remove(line.Args[0], line.Args[1], strings.EqualFold(line.Args[1], ourNick))
+		}
+	case irc.QUIT:
+		for _, nicks := range members.channels {
+			delete(nicks, strings.ToLower(line.Nick))
+		}
+	case irc.NICK:
+		if len(line.Args) < 1 {
+			return
+		}
+		for _, nicks := range members.channels {
+			if _, ok := nicks[strings.ToLower(line.Nick)]; ok {
+				delete(nicks, strings.ToLower(line.Nick))
+				nicks[strings.ToLower(line.Args[0])] = line.Args[0]
+			}
+		}
+	}
+}
+
+// The caller must hold the mutex
+func (members *ircChannelMembers) add(channel string, nick string) {
+	key := strings.ToLower(channel)
+	if members.channels[key] == nil {
+		members.channels[key] = make(map[string]string)
+	}
+	members.channels[key][strings.ToLower(nick)] = nick
+}
+
+// Takes the nick out of the channel, or forgets the channel if it's us leaving.
+// The caller must hold the mutex.
+func (members *ircChannelMembers) remove(channel string, nick string, isUs bool) {
+	key := strings.ToLower(channel)
+	if isUs {
+		delete(members.channels, key)
+		return
+	}
+	delete(members.channels[key], strings.ToLower(nick))
+}
+
+// The nicks in the channel
+func (members *ircChannelMembers) names(channel IRCChannel) []string {
+	members.mutex.Lock()
+	defer members.mutex.Unlock()
+
+	var names []string
+	for _, nick := range members.channels[strings.ToLower(string(channel))] {
+		names = append(names, nick)
+	}
+
+	return names
+}
+
+// The channels the nick is in, as they were named when we joined them
+func (members *ircChannelMembers) channelsOf(nick string, channels map[IRCChannel]IRCChannelKey) []IRCChannel {
+	members.mutex.Lock()
+	defer members.mutex.Unlock()
+
+	var found []IRCChannel
+	for channel := range channels {
+		if _, ok := members.channels[strings.ToLower(string(channel))][strings.ToLower(nick)]; ok {
+			found = append(found, channel)
+		}
+	}
+
+	return found
+}
+
+// Forgets everyone, since we're in no channels once we're disconnected
+func (members *ircChannelMembers) reset() {
+	members.mutex.Lock()
+	defer members.mutex.Unlock()
+
+	members.channels = make(map[string]map[string]string)
+}
+
+// The nick from a name in a NAMES reply, without any of its prefixes, like "@+alice",
+// or the rest of its mask with userhost-in-names, like "alice!a@example.com"
+func parseIRCName(name string) string {
+	nick := strings.TrimLeft(name, "~&@%+")
+	if i := strings.Index(nick, "!"); i >= 0 {
+		nick = nick[:i]
+	}
+
+	return nick
+}
@@ -0,0 +1,229 @@
+package pino
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+func capLine(args ...string) *irc.Line {
+	return &irc.Line{Cmd: ircCapability, Args: append([]string{"pino"}, args...)}
+}
+
+func newTestIRCCapabilityNegotiator(t *testing.T, disabled []string) (*ircCapabilityNegotiator, *[]string) {
+	var sent []string
+	negotiator, err := newIRCCapabilityNegotiator(func(line string) { sent = append(sent, line) }, disabled)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return negotiator, &sent
+}
+
+func TestIRCCapabilityNegotiation(t *testing.T) {
+	negotiator, sent := newTestIRCCapabilityNegotiator(t, nil)
+
+	// A reply to CAP LS 302 that takes two lines
+	negotiator.handle(capLine("LS", "*", "multi-prefix sasl=PLAIN,EXTERNAL server-time"))
+	negotiator.handle(capLine("LS", "batch draft/chathistory"))
+
+	if negotiator.available["sasl"] != "PLAIN,EXTERNAL" || len(negotiator.available) != 5 {
+		t.Errorf("Unexpected available capabilities: %v", negotiator.available)
+	}
+	// The client library asks for them while registering
+	if len(*sent) != 0 {
+		t.Errorf("Expected nothing to be sent for CAP LS, got %v", *sent)
+	}
+
+	negotiator.handle(capLine("ACK", "multi-prefix server-time batch"))
+	negotiator.handle(capLine("NAK", "draft/chathistory"))
+
+	for capability, expected := range map[string]bool{"multi-prefix": true, "server-time": true, "batch": true, "draft/chathistory": false, "sasl": false} {
+		if negotiator.isEnabled(capability) != expected {
+			t.Errorf("Expected %v to be enabled: %v", capability, expected)
+		}
+	}
+
+	negotiator.handle(capLine("ACK", "-batch"))
+	if negotiator.isEnabled("batch") {
+		t.Error("Expected batch to be disabled")
+	}
+
+	// With cap-notify, capabilities can come and go
+	negotiator.handle(capLine("NEW", "echo-message unknown-cap away-notify multi-prefix"))
+	if fmt.Sprint(*sent) != "[CAP REQ :away-notify echo-message]" {
+		t.Errorf("Expected the new capabilities we want to be requested, got %v", *sent)
+	}
+
+	negotiator.handle(capLine("DEL", "server-time"))
+	if negotiator.isEnabled("server-time") {
+		t.Error("Expected server-time to be gone")
+	}
+
+	negotiator.reset()
+	if negotiator.isEnabled("multi-prefix") || len(negotiator.available) != 0 {
+		t.Error("Expected nothing to be left after a reset")
+	}
+}
+
+func TestIRCCapabilityNegotiationDisabledCapabilities(t *testing.T) {
+	negotiator, sent := newTestIRCCapabilityNegotiator(t, []string{"echo-message", "batch"})
+
+	for _, capability := range negotiator.wantedCapabilities() {
+		if capability == "echo-message" || capability == "batch" {
+			t.Errorf("Expected %v not to be asked for while registering", capability)
+		}
+	}
+	if len(negotiator.wantedCapabilities()) != len(ircSupportedCapabilities)-2 {
+		t.Errorf("Unexpected capabilities: %v", negotiator.wantedCapabilities())
+	}
+
+	negotiator.handle(capLine("NEW", "echo-message batch"))
+	if len(*sent) != 0 {
+		t.Errorf("Expected disabled capabilities not to be requested, got %v", *sent)
+	}
+
+	if _, err := newIRCCapabilityNegotiator(func(string) {}, []string{"no-such-cap"}); err == nil {
+		t.Error("Expected an unknown capability to be rejected")
+	}
+}
+
+func TestSplitIRCCapability(t *testing.T) {
+	tests := []struct {
+		capability string
+		name       string
+		value      string
+	}{
+		{"server-time", "server-time", ""},
+		{"sasl=PLAIN,EXTERNAL", "sasl", "PLAIN,EXTERNAL"},
+		{"draft/languages=2,en,~fr", "draft/languages", "2,en,~fr"},
+		{"empty=", "empty", ""},
+	}
+
+	for _, test := range tests {
+		if name, value := splitIRCCapability(test.capability); name != test.name || value != test.value {
+			t.Errorf("splitIRCCapability(%q) = %q, %q, expected %q, %q", test.capability, name, value, test.name, test.value)
+		}
+	}
+}
+
+func TestIRCLineTime(t *testing.T) {
+	received := time.Date(2016, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		tags     map[string]string
+		expected time.Time
+	}{
+		{nil, received},
+		{map[string]string{"time": "2016-10-18T11:59:58.123Z"}, time.Date(2016, 10, 18, 11, 59, 58, 123000000, time.UTC)},
+		{map[string]string{"time": "yesterday"}, received},
+	}
+
+	for _, test := range tests {
+		if lineTime := ircLineTime(&irc.Line{Tags: test.tags, Time: received}); !lineTime.Equal(test.expected) {
+			t.Errorf("ircLineTime(%v) = %v, expected %v", test.tags, lineTime, test.expected)
+		}
+	}
+}
+
+func TestFormatIRCTags(t *testing.T) {
+	tests := []struct {
+		tags     map[string]string
+		expected string
+	}{
+		{map[string]string{"+typing": "active"}, "@+typing=active"},
+		{map[string]string{"+typing": "done", "+draft/reply": "abc"}, "@+draft/reply=abc;+typing=done"},
+		{map[string]string{"flag": ""}, "@flag"},
+		{map[string]string{"+note": "a b;c\\d"}, `@+note=a\sb\:c\\d`},
+	}
+
+	for _, test := range tests {
+		if formatted := formatIRCTags(test.tags); formatted != test.expected {
+			t.Errorf("formatIRCTags(%v) = %q, expected %q", test.tags, formatted, test.expected)
+		}
+	}
+}
+
+func TestIRCBatchTracker(t *testing.T) {
+	tracker := newIRCBatchTracker()
+	tracker.handle(&irc.Line{Cmd: ircBatchCommand, Args: []string{"+abc", "chathistory", "#chat"}})
+
+	inside := &irc.Line{Cmd: irc.PRIVMSG, Tags: map[string]string{"batch": "abc"}}
+	if batch := tracker.batchOf(inside); batch == nil || batch.batchType != "chathistory" || fmt.Sprint(batch.params) != "[#chat]" {
+		t.Errorf("Unexpected batch: %+v", batch)
+	}
+	if tracker.batchOf(&irc.Line{Cmd: irc.PRIVMSG}) != nil {
+		t.Error("Expected a line without a batch tag not to be in a batch")
+	}
+
+	tracker.handle(&irc.Line{Cmd: ircBatchCommand, Args: []string{"-abc"}})
+	if tracker.batchOf(inside) != nil {
+		t.Error("Expected the batch to be closed")
+	}
+}
+
+func TestIRCAccountTracker(t *testing.T) {
+	tracker := newIRCAccountTracker()
+
+	lines := []*irc.Line{
+		{Cmd: irc.JOIN, Nick: "alice", Args: []string{"#chat", "alice_account", "Alice"}},
+		{Cmd: irc.JOIN, Nick: "bob", Args: []string{"#chat", "*", "Bob"}},
+		{Cmd: ircAccount, Nick: "carol", Args: []string{"carol_account"}},
+		{Cmd: irc.PRIVMSG, Nick: "dave", Tags: map[string]string{"account": "dave_account"}, Args: []string{"#chat", "hi"}},
+		{Cmd: irc.QUIT, Nick: "carol", Args: []string{"bye"}},
+	}
+	for _, line := range lines {
+		tracker.handle(line)
+	}
+
+	for nick, expected := range map[string]string{"Alice": "alice_account", "bob": "", "carol": "", "dave": "dave_account"} {
+		if account := tracker.accountFor(nick); account != expected {
+			t.Errorf("accountFor(%v) = %q, expected %q", nick, account, expected)
+		}
+	}
+}
+
+func TestIRCChannelMembers(t *testing.T) {
+	members := newIRCChannelMembers()
+
+	lines := []*irc.Line{
+		{Cmd: irc.JOIN, Nick: "pino", Args: []string{"#Chat"}},
+		// With multi-prefix and userhost-in-names
+		{Cmd: "353", Args: []string{"pino", "=", "#chat", "@+alice ~bob carol!c@example.com pino"}},
+		{Cmd: irc.JOIN, Nick: "dave", Args: []string{"#chat"}},
+		{Cmd: irc.NICK, Nick: "carol", Args: []string{"Carol2"}},
+		{Cmd: irc.PART, Nick: "bob", Args: []string{"#chat"}},
+		{Cmd: irc.KICK, Nick: "alice", Args: []string{"#chat", "dave"}},
+		{Cmd: irc.JOIN, Nick: "pino", Args: []string{"#other"}},
+		{Cmd: irc.JOIN, Nick: "alice", Args: []string{"#other"}},
+	}
+	for _, line := range lines {
+		members.handle(line, "pino")
+	}
+
+	names := members.names("#CHAT")
+	sort.Strings(names)
+	if fmt.Sprint(names) != "[Carol2 alice pino]" {
+		t.Errorf("Unexpected names in #chat: %v", names)
+	}
+
+	channels := members.channelsOf("ALICE", map[IRCChannel]IRCChannelKey{"#chat": "", "#other": "", "#elsewhere": ""})
+	sort.Slice(channels, func(i, j int) bool { return channels[i] < channels[j] })
+	if fmt.Sprint(channels) != "[#chat #other]" {
+		t.Errorf("Unexpected channels for alice: %v", channels)
+	}
+
+	members.handle(&irc.Line{Cmd: irc.QUIT, Nick: "alice", Args: []string{"bye"}}, "pino")
+	if channels := members.channelsOf("alice", map[IRCChannel]IRCChannelKey{"#chat": "", "#other": ""}); len(channels) != 0 {
+		t.Errorf("Expected alice to be gone, got %v", channels)
+	}
+
+	// We were kicked
+	members.handle(&irc.Line{Cmd: irc.KICK, Nick: "Carol2", Args: []string{"#chat", "pino"}}, "pino")
+	if names := members.names("#chat"); len(names) != 0 {
+		t.Errorf("Expected #chat to be forgotten, got %v", names)
+	}
+}
@@ -0,0 +1,99 @@
+package pino
+
+import (
+	"fmt"
+	"strings"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+// Human-readable explanations of the IRC error numerics that we tell the owner about
+var ircErrorDescriptions = map[string]string{
+	"401": "There's no such nick or channel",
+	"403": "The channel doesn't exist",
+	"404": "Pino isn't allowed to talk in the channel (it may be moderated, or Pino may be banned)",
+	"405": "Pino has joined too many channels",
+	"442": "Pino isn't in the channel",
+	"471": "The channel is full",
+	"473": "The channel is invite-only",
+	"474": "Pino is banned from the channel",
+	"475": "The channel key (password) is wrong",
+	"477": "The channel requires a nick registered with services",
+	"482": "Pino isn't a channel operator",
+}
+
+// Network services, whose notices (like NickServ asking us to identify) always go to the owner.
+// Q and X are QuakeNet's and Undernet's.
+var ircServicesNicks = map[string]bool{
+	"nickserv": true,
+	"chanserv": true,
+	"memoserv": true,
+	"operserv": true,
+	"hostserv": true,
+	"botserv":  true,
+	"saslserv": true,
+	"global":   true,
+	"q":        true,
+	"x":        true,
+}
+
+func isIRCServicesNick(nick string) bool {
+	return ircServicesNicks[strings.ToLower(nick)]
+}
+
+// Numerics that mean a JOIN didn't work
+var ircJoinErrorNumerics = map[string]bool{
+	"403": true,
+	"405": true,
+	"471": true,
+	"473": true,
+	"474": true,
+	"475": true,
+	"477": true,
+}
+
+// Numerics that can be the reply to a message we tried to send to a channel
+var ircDeliveryErrorNumerics = map[string]bool{
+	"403": true,
+	"404": true,
+	"442": true,
+	"477": true,
+}
+
+// Tells the owner about an IRC error. Errors about a mapped channel go to its Slack channels,
+// and everything else goes to the owner as a DM.
+func (pino *Pino) handleIRCErrorNumeric(network *ircNetwork, line *irc.Line) {
+	// Error numerics look like ":server 474 ourNick #channel :Cannot join channel (+b)"
+	var subject string
+	if len(line.Args) > 2 {
+		subject = line.Args[1]
+	}
+	channel := IRCChannel(subject)
+
+	reason := fmt.Sprintf("%v (%v: %v)", ircErrorDescriptions[line.Cmd], line.Cmd, line.Text())
+	fmt.Printf("ERROR: (%v) %v\n", subject, reason)
+
+	if ircDeliveryErrorNumerics[line.Cmd] && network.deliveries.fail(channel, reason) {
+		// The owner will see this on the Slack message that failed
+		return
+	}
+
+	data := &messageTemplateData{Network: network.name, Channel: channel, Server: network.config.Server, Reason: reason}
+	switch {
+	case ircJoinErrorNumerics[line.Cmd]:
+		data.Text = fmt.Sprintf("Couldn't join %v: %v", subject, reason)
+	case subject != "":
+		data.Text = fmt.Sprintf("%v: %v", subject, reason)
+	default:
+		data.Text = reason
+	}
+
+	if bridges := network.bridgesToSlack(channel); len(bridges) > 0 {
+		for _, bridge := range bridges {
+			bridge.sendMessageAsBot(bridge.render("error", data))
+		}
+		return
+	}
+
+	pino.slackProxy.sendMessageToOwner(pino.templates.render("owner-error", data))
+}
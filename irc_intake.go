@@ -0,0 +1,184 @@
+package pino
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+const (
+	defaultIRCIntakeQueueSize = 500
+	// How often we'll complain about a single queue overflowing
+	ircIntakeOverflowReportInterval = time.Minute
+)
+
+// An IRC line, along with the channel it's being handled for.
+// The channel is empty for lines that aren't about any channel (like CONNECTED).
+type ircEvent struct {
+	channel IRCChannel
+	line    *irc.Line
+	// The IRCv3 batch the line was part of, if any
+	batch *ircBatch
+}
+
+// The ircIntake takes lines from goirc's dispatcher and hands them off to worker goroutines,
+// so that a slow handler (like a Slack API call) never holds up goirc, which would delay PONGs.
+//
+// Every channel gets its own bounded queue and worker, so lines about a channel are handled in
+// the order they arrived. NICK and QUIT lines are delivered to every channel the user was in.
+// Lines that aren't about a channel share a separate queue.
+//
+// Overflow policy: when a queue is full, the new line is dropped and counted, and the drop is
+// logged at most once a minute per queue. CONNECTED and DISCONNECTED are never dropped; they
+// spill over into a list the worker gets to once the queue has drained, and everything else is
+// dropped until it has.
+//
+// The workers don't start until start is called, so nothing is handled before Slack is ready for it.
+type ircIntake struct {
+	proxy     *ircProxy
+	queueSize int
+	handler   func(*ircEvent)
+	ready     chan bool
+
+	mutex  sync.Mutex
+	queues map[string]*ircIntakeQueue
+}
+
+type ircIntakeQueue struct {
+	name   string
+	events chan *ircEvent
+	// Lines that didn't fit in events but mustn't be dropped, in the order they arrived
+	spilled    []*ircEvent
+	received   uint64
+	dropped    uint64
+	lastReport time.Time
+}
+
+func newIRCIntake(proxy *ircProxy, queueSize int, handler func(*ircEvent)) *ircIntake {
+	if queueSize <= 0 {
+		queueSize = defaultIRCIntakeQueueSize
+	}
+
+	return &ircIntake{
+		proxy:     proxy,
+		queueSize: queueSize,
+		handler:   handler,
+		ready:     make(chan bool),
+		queues:    make(map[string]*ircIntakeQueue),
+	}
+}
+
+// Lets the workers start handling lines. Until then, they wait in the queues.
+func (intake *ircIntake) start() {
+	close(intake.ready)
+}
+
+// Called by goirc for every line we're subscribed to. This must never block for long.
+func (intake *ircIntake) enqueue(line *irc.Line) {
+	// The batch has to be looked up now, since it may have ended by the time the line is handled
+	batch := intake.proxy.batches.batchOf(line)
+
+	for _, channel := range intake.channelsForLine(line) {
+		intake.enqueueEvent(&ircEvent{channel: channel, line: line, batch: batch})
+	}
+}
+
+// Figures out which channels a line should be handled for
+func (intake *ircIntake) channelsForLine(line *irc.Line) []IRCChannel {
+	switch line.Cmd {
+	case irc.NICK, irc.QUIT:
+		// The nick hasn't left its channels yet, since members are updated after this
+		channels := intake.proxy.channelsOf(line.Nick)
+		if len(channels) == 0 {
+			// Still let the line be logged
+			channels = append(channels, "")
+		}
+		return channels
+
+	case irc.JOIN, irc.PART, irc.KICK, irc.MODE, irc.TOPIC, irc.PRIVMSG, irc.ACTION, irc.NOTICE, ircTagMessage:
+		if len(line.Args) > 0 && isIRCChannelName(line.Args[0]) {
+			return []IRCChannel{IRCChannel(line.Args[0])}
+		}
+	}
+
+	return []IRCChannel{""}
+}
+
+func (intake *ircIntake) enqueueEvent(event *ircEvent) {
+	// IRC channel names are case insensitive
+	name := strings.ToLower(string(event.channel))
+
+	intake.mutex.Lock()
+	defer intake.mutex.Unlock()
+
+	queue, ok := intake.queues[name]
+	if !ok {
+		queue = &ircIntakeQueue{
+			name:   name,
+			events: make(chan *ircEvent, intake.queueSize),
+		}
+		intake.queues[name] = queue
+		go intake.work(queue)
+	}
+	queue.received++
+
+	// Anything that arrives while lines are spilled over would overtake them
+	if len(queue.spilled) == 0 {
+		select {
+		case queue.events <- event:
+			return
+		default:
+		}
+	}
+
+	if event.line.Cmd == irc.CONNECTED || event.line.Cmd == irc.DISCONNECTED {
+		queue.spilled = append(queue.spilled, event)
+		return
+	}
+
+	queue.dropped++
+	if time.Since(queue.lastReport) >= ircIntakeOverflowReportInterval {
+		queue.lastReport = time.Now()
+		fmt.Printf("IRC intake queue %q is full; dropped %v of %v lines so far\n", queue.name, queue.dropped, queue.received)
+	}
+}
+
+func (intake *ircIntake) work(queue *ircIntakeQueue) {
+	<-intake.ready
+
+	for {
+		select {
+		case event := <-queue.events:
+			intake.handler(event)
+			continue
+		default:
+		}
+
+		// The queue has drained, so the lines that spilled over get their turn
+		if event := intake.takeSpilled(queue); event != nil {
+			intake.handler(event)
+			continue
+		}
+
+		intake.handler(<-queue.events)
+	}
+}
+
+func (intake *ircIntake) takeSpilled(queue *ircIntakeQueue) *ircEvent {
+	intake.mutex.Lock()
+	defer intake.mutex.Unlock()
+
+	if len(queue.spilled) == 0 {
+		return nil
+	}
+	event := queue.spilled[0]
+	queue.spilled = queue.spilled[1:]
+	return event
+}
+
+func isIRCChannelName(name string) bool {
+	return name != "" && strings.ContainsRune("#&+!", rune(name[0]))
+}
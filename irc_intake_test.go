@@ -0,0 +1,69 @@
+package pino
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+func TestIRCIntakeWaitsUntilStarted(t *testing.T) {
+	handled := make(chan *ircEvent, 10)
+	intake := newIRCIntake(&ircProxy{}, 10, func(event *ircEvent) { handled <- event })
+
+	intake.enqueueEvent(&ircEvent{channel: "#chat", line: &irc.Line{Cmd: irc.PRIVMSG}})
+
+	select {
+	case <-handled:
+		t.Fatal("Expected nothing to be handled before the intake is started")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	intake.start()
+
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the line to be handled once the intake is started")
+	}
+}
+
+func TestIRCIntakeSpillsConnectionEvents(t *testing.T) {
+	handled := make(chan *ircEvent, 10)
+	intake := newIRCIntake(&ircProxy{}, 2, func(event *ircEvent) { handled <- event })
+
+	lines := []*irc.Line{
+		{Cmd: irc.PRIVMSG, Raw: "1"},
+		{Cmd: irc.PRIVMSG, Raw: "2"},
+		// The queue is full from here on, so these spill over
+		{Cmd: irc.DISCONNECTED, Raw: "3"},
+		{Cmd: irc.CONNECTED, Raw: "4"},
+	}
+	for _, line := range lines {
+		intake.enqueueEvent(&ircEvent{line: line})
+	}
+	// Dropped, since it would otherwise overtake the spilled lines
+	intake.enqueueEvent(&ircEvent{line: &irc.Line{Cmd: irc.PRIVMSG, Raw: "dropped"}})
+
+	intake.start()
+
+	var order []string
+	for range lines {
+		select {
+		case event := <-handled:
+			order = append(order, event.line.Raw)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out after handling %v", order)
+		}
+	}
+
+	if fmt.Sprint(order) != "[1 2 3 4]" {
+		t.Errorf("Expected lines to be handled in order, got %v", order)
+	}
+	intake.mutex.Lock()
+	defer intake.mutex.Unlock()
+	if dropped := intake.queues[""].dropped; dropped != 1 {
+		t.Errorf("Expected one dropped line, got %v", dropped)
+	}
+}
@@ -0,0 +1,27 @@
+package pino
+
+import (
+	"testing"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+func TestIsIRCPreRegistrationNotice(t *testing.T) {
+	tests := []struct {
+		line     *irc.Line
+		expected bool
+	}{
+		// Servers send these while we're still connecting, before we have a nick
+		{&irc.Line{Cmd: irc.NOTICE, Src: "irc.example.net", Args: []string{"*", "*** Looking up your hostname..."}}, true},
+		{&irc.Line{Cmd: irc.NOTICE, Src: "irc.example.net", Args: []string{"AUTH", "*** Checking Ident"}}, true},
+		{&irc.Line{Cmd: irc.NOTICE, Src: "irc.example.net", Args: []string{"pino", "*** You are connected"}}, false},
+		{&irc.Line{Cmd: irc.NOTICE, Nick: "NickServ", Src: "NickServ!services@services", Args: []string{"pino", "You are now identified"}}, false},
+		{&irc.Line{Cmd: irc.NOTICE}, false},
+	}
+
+	for _, test := range tests {
+		if isNotice := isIRCPreRegistrationNotice(test.line); isNotice != test.expected {
+			t.Errorf("isIRCPreRegistrationNotice(%q) = %v, expected %v", test.line.Args, isNotice, test.expected)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package pino
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	// Registers the "sqlite3" driver
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	messageStoreFilename = "messages.db"
+	// How many messages can wait to be written before new ones are dropped
+	messageStoreQueueSize = 1000
+	// How many results a history query returns if it doesn't say
+	defaultMessageQueryLimit = 500
+	maxMessageQueryLimit     = 5000
+)
+
+// Which side of the bridge a stored message was said on
+const (
+	storedMessageFromIRC   = "irc"
+	storedMessageFromSlack = "slack"
+)
+
+// Nicks and channels are compared case-insensitively, like IRC does.
+// The full-text index is an external content FTS4 table, kept in step with triggers.
+const messageStoreSchema = `
+CREATE TABLE IF NOT EXISTS messages (
+	id INTEGER PRIMARY KEY,
+	time INTEGER NOT NULL,
+	source TEXT NOT NULL,
+	network TEXT NOT NULL DEFAULT '' COLLATE NOCASE,
+	channel TEXT NOT NULL COLLATE NOCASE,
+	nick TEXT NOT NULL COLLATE NOCASE,
+	kind TEXT NOT NULL,
+	text TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS messages_by_channel ON messages (channel, time);
+CREATE INDEX IF NOT EXISTS messages_by_nick ON messages (nick, time);
+CREATE VIRTUAL TABLE IF NOT EXISTS messages_text USING fts4(content="messages", text);
+CREATE TRIGGER IF NOT EXISTS messages_text_insert AFTER INSERT ON messages BEGIN
+	INSERT INTO messages_text (docid, text) VALUES (new.id, new.text);
+END;
+CREATE TRIGGER IF NOT EXISTS messages_text_delete BEFORE DELETE ON messages BEGIN
+	DELETE FROM messages_text WHERE docid = old.id;
+END;
+`
+
+// A message in the store. Messages from Slack are stored under the IRC channel they were sent to,
+// so a channel's history has both sides of the conversation.
+type storedMessage struct {
+	time   time.Time
+	source string
+	// The name of the IRC network, which is empty for a config with a single network under IRC
+	network string
+	channel IRCChannel
+	nick    string
+	// One of the chatLogEntry kinds: message, action, or notice
+	kind string
+	text string
+}
+
+// What to look for in the store. Empty fields match everything.
+type messageQuery struct {
+	nick    string
+	network string
+	channel IRCChannel
+	after   time.Time
+	before  time.Time
+	// An FTS4 full-text query, like "kubernetes OR k8s"
+	text  string
+	limit int
+}
+
+// The messageStore keeps every message from both sides of the bridge in an SQLite database
+// in the StateDirectory, with a full-text index, so the owner can search it with "history".
+type messageStore struct {
+	db    *sql.DB
+	queue chan *storedMessage
+}
+
+// Returns a store that ignores everything if it's disabled or there's no StateDirectory to keep it in
+func newMessageStore(config *MessageStoreConfig, stateDirectory string) (*messageStore, error) {
+	store := &messageStore{}
+	if config.Disabled || stateDirectory == "" {
+		return store, nil
+	}
+
+	path := filepath.Join(stateDirectory, messageStoreFilename)
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open message store %v: %v", path, err)
+	}
+
+	if _, err := db.Exec(messageStoreSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Could not set up message store %v: %v", path, err)
+	}
+
+	store.db = db
+	store.queue = make(chan *storedMessage, messageStoreQueueSize)
+	go store.writeQueued()
+
+	return store, nil
+}
+
+func (store *messageStore) isEnabled() bool {
+	return store.db != nil
+}
+
+// Queues a message to be stored, without waiting for the database
+func (store *messageStore) add(message *storedMessage) {
+	if !store.isEnabled() {
+		return
+	}
+
+	select {
+	case store.queue <- message:
+	default:
+		fmt.Printf("Message store queue is full, dropping message from %v in %v\n", message.nick, message.channel)
+	}
+}
+
+// Writes queued messages, a transaction's worth at a time
+func (store *messageStore) writeQueued() {
+	for message := range store.queue {
+		batch := []*storedMessage{message}
+
+	collect:
+		for len(batch) < messageStoreQueueSize {
+			select {
+			case message := <-store.queue:
+				batch = append(batch, message)
+			default:
+				break collect
+			}
+		}
+
+		if err := store.insert(batch); err != nil {
+			fmt.Printf("Could not store %v messages: %v\n", len(batch), err)
+		}
+	}
+}
+
+func (store *messageStore) insert(messages []*storedMessage) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	statement, err := tx.Prepare("INSERT INTO messages (time, source, network, channel, nick, kind, text) VALUES (?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer statement.Close()
+
+	for _, message := range messages {
+		_, err := statement.Exec(message.time.UnixNano(), message.source, message.network, string(message.channel), message.nick, message.kind, message.text)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Finds the most recent messages matching the query, oldest first. Also returns whether
+// there were more matches than the query's limit.
+func (store *messageStore) search(query *messageQuery) ([]*storedMessage, bool, error) {
+	if !store.isEnabled() {
+		return nil, false, fmt.Errorf("The message store is disabled")
+	}
+
+	from := "messages"
+	var conditions []string
+	var args []interface{}
+
+	if query.text != "" {
+		from = "messages JOIN messages_text ON messages_text.docid = messages.id"
+		conditions = append(conditions, "messages_text MATCH ?")
+		args = append(args, query.text)
+	}
+	if query.nick != "" {
+		conditions = append(conditions, "messages.nick = ?")
+		args = append(args, query.nick)
+	}
+	if query.network != "" {
+		conditions = append(conditions, "messages.network = ?")
+		args = append(args, query.network)
+	}
+	if query.channel != "" {
+		conditions = append(conditions, "messages.channel = ?")
+		args = append(args, string(query.channel))
+	}
+	if !query.after.IsZero() {
+		conditions = append(conditions, "messages.time >= ?")
+		args = append(args, query.after.UnixNano())
+	}
+	if !query.before.IsZero() {
+		conditions = append(conditions, "messages.time < ?")
+		args = append(args, query.before.UnixNano())
+	}
+
+	statement := fmt.Sprintf("SELECT messages.time, messages.source, messages.network, messages.channel, messages.nick, messages.kind, messages.text FROM %v", from)
+	if len(conditions) > 0 {
+		statement += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	// Ask for one more than the limit, to find out whether there are more
+	statement += " ORDER BY messages.time DESC, messages.id DESC LIMIT ?"
+	args = append(args, query.limit+1)
+
+	rows, err := store.db.Query(statement, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	var messages []*storedMessage
+	for rows.Next() {
+		var nanoseconds int64
+		var channel string
+		message := &storedMessage{}
+		if err := rows.Scan(&nanoseconds, &message.source, &message.network, &channel, &message.nick, &message.kind, &message.text); err != nil {
+			return nil, false, err
+		}
+		message.time = time.Unix(0, nanoseconds)
+		message.channel = IRCChannel(channel)
+		messages = append(messages, message)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(messages) > query.limit
+	if hasMore {
+		messages = messages[:query.limit]
+	}
+
+	// They came newest first, but read better oldest first
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+
+	return messages, hasMore, nil
+}
+
+// Parses the arguments of a history command, like "nick:alice network:rizon channel:#go after:7d kubernetes".
+// Dates can be like 2016-10-18, 2016-10-18T15:04, or a time ago like 12h or 7d.
+func parseMessageQuery(args []string, now time.Time) (*messageQuery, error) {
+	query := &messageQuery{limit: defaultMessageQueryLimit}
+	var words []string
+
+	for _, arg := range args {
+		i := strings.Index(arg, ":")
+		if i < 0 {
+			words = append(words, arg)
+			continue
+		}
+
+		value := arg[i+1:]
+		switch strings.ToLower(arg[:i]) {
+		case "nick":
+			query.nick = value
+		case "network":
+			query.network = value
+		case "channel":
+			query.channel = IRCChannel(value)
+		case "after":
+			t, err := parseMessageQueryTime(value, now)
+			if err != nil {
+				return nil, err
+			}
+			query.after = t
+		case "before":
+			t, err := parseMessageQueryTime(value, now)
+			if err != nil {
+				return nil, err
+			}
+			query.before = t
+		case "limit":
+			var limit int
+			if _, err := fmt.Sscan(value, &limit); err != nil || limit < 1 || limit > maxMessageQueryLimit {
+				return nil, fmt.Errorf("Invalid limit '%v', expected a number from 1 to %v", value, maxMessageQueryLimit)
+			}
+			query.limit = limit
+		default:
+			// Not a filter, just a word with a colon in it
+			words = append(words, arg)
+		}
+	}
+
+	query.text = strings.Join(words, " ")
+	return query, nil
+}
+
+func parseMessageQueryTime(value string, now time.Time) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02", "2006-01-02T15:04"} {
+		if t, err := time.ParseInLocation(layout, value, now.Location()); err == nil {
+			return t, nil
+		}
+	}
+
+	if strings.HasSuffix(value, "d") {
+		var days int
+		if _, err := fmt.Sscan(strings.TrimSuffix(value, "d"), &days); err == nil {
+			return now.AddDate(0, 0, -days), nil
+		}
+	}
+	if duration, err := time.ParseDuration(value); err == nil {
+		return now.Add(-duration), nil
+	}
+
+	return time.Time{}, fmt.Errorf("Invalid date '%v', expected something like 2016-10-18, 2016-10-18T15:04, 12h, or 7d", value)
+}
+
+// Formats a stored message for a history result, like "2016-10-18 15:04:05 #go <alice> hello",
+// with the network before the channel if it has a name, like "[rizon] #go"
+func formatStoredMessage(message *storedMessage) string {
+	var text string
+	switch message.kind {
+	case chatLogAction:
+		text = fmt.Sprintf("* %v %v", message.nick, message.text)
+	case chatLogNotice:
+		text = fmt.Sprintf("-%v- %v", message.nick, message.text)
+	default:
+		text = fmt.Sprintf("<%v> %v", message.nick, message.text)
+	}
+
+	channel := string(message.channel)
+	if message.network != "" {
+		channel = fmt.Sprintf("[%v] %v", message.network, channel)
+	}
+
+	return fmt.Sprintf("%v %v %v", message.time.Local().Format("2006-01-02 15:04:05"), channel, text)
+}
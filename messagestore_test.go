@@ -0,0 +1,148 @@
+package pino
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMessageQuery(t *testing.T) {
+	now := time.Date(2016, 10, 18, 15, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		args     string
+		expected messageQuery
+	}{
+		{"", messageQuery{limit: defaultMessageQueryLimit}},
+		{"kubernetes OR k8s", messageQuery{text: "kubernetes OR k8s", limit: defaultMessageQueryLimit}},
+		{
+			"nick:alice network:rizon channel:#go limit:20 deploy",
+			messageQuery{nick: "alice", network: "rizon", channel: "#go", text: "deploy", limit: 20},
+		},
+		{
+			"after:7d before:2016-10-18",
+			messageQuery{after: now.AddDate(0, 0, -7), before: time.Date(2016, 10, 18, 0, 0, 0, 0, time.UTC), limit: defaultMessageQueryLimit},
+		},
+		// Not one of the filters
+		{"NICK:alice http://example.com", messageQuery{nick: "alice", text: "http://example.com", limit: defaultMessageQueryLimit}},
+	}
+
+	for _, test := range tests {
+		query, err := parseMessageQuery(strings.Fields(test.args), now)
+		if err != nil {
+			t.Errorf("parseMessageQuery(%q) returned %v", test.args, err)
+			continue
+		}
+		if fmt.Sprintf("%+v", *query) != fmt.Sprintf("%+v", test.expected) {
+			t.Errorf("parseMessageQuery(%q) = %+v, expected %+v", test.args, *query, test.expected)
+		}
+	}
+}
+
+func TestParseMessageQueryRejectsBadFilters(t *testing.T) {
+	now := time.Date(2016, 10, 18, 15, 4, 5, 0, time.UTC)
+
+	for _, args := range []string{"limit:0", "limit:many", fmt.Sprintf("limit:%v", maxMessageQueryLimit+1), "after:someday", "before:2016-13-01"} {
+		if _, err := parseMessageQuery([]string{args}, now); err == nil {
+			t.Errorf("Expected parseMessageQuery(%q) to fail", args)
+		}
+	}
+}
+
+func TestParseMessageQueryTime(t *testing.T) {
+	now := time.Date(2016, 10, 18, 15, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		value    string
+		expected time.Time
+	}{
+		{"2016-10-01", time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC)},
+		{"2016-10-01T09:30", time.Date(2016, 10, 1, 9, 30, 0, 0, time.UTC)},
+		{"7d", now.AddDate(0, 0, -7)},
+		{"12h", now.Add(-12 * time.Hour)},
+		{"90m", now.Add(-90 * time.Minute)},
+	}
+
+	for _, test := range tests {
+		parsed, err := parseMessageQueryTime(test.value, now)
+		if err != nil || !parsed.Equal(test.expected) {
+			t.Errorf("parseMessageQueryTime(%q) = %v, %v, expected %v", test.value, parsed, err, test.expected)
+		}
+	}
+
+	if _, err := parseMessageQueryTime("soon", now); err == nil {
+		t.Error("Expected an invalid time to be rejected")
+	}
+}
+
+func newTestMessageStore(t *testing.T) *messageStore {
+	directory, err := ioutil.TempDir("", "pino-messages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(directory) })
+
+	store, err := newMessageStore(&MessageStoreConfig{}, directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.db.Close() })
+
+	return store
+}
+
+func TestMessageStoreSearch(t *testing.T) {
+	store := newTestMessageStore(t)
+
+	start := time.Date(2016, 10, 18, 12, 0, 0, 0, time.UTC)
+	messages := []*storedMessage{
+		{time: start, source: storedMessageFromIRC, channel: "#go", nick: "alice", kind: chatLogMessage, text: "deploying kubernetes now"},
+		{time: start.Add(time.Minute), source: storedMessageFromSlack, channel: "#go", nick: "owner", kind: chatLogMessage, text: "good luck"},
+		{time: start.Add(2 * time.Minute), source: storedMessageFromIRC, network: "rizon", channel: "#GO", nick: "Bob", kind: chatLogAction, text: "waves at k8s"},
+		{time: start.Add(3 * time.Minute), source: storedMessageFromIRC, channel: "#rust", nick: "alice", kind: chatLogMessage, text: "kubernetes again"},
+	}
+	if err := store.insert(messages); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query   messageQuery
+		texts   string
+		hasMore bool
+	}{
+		{messageQuery{text: "kubernetes OR k8s", limit: 10}, "[deploying kubernetes now waves at k8s kubernetes again]", false},
+		{messageQuery{text: "kubernetes", channel: "#go", limit: 10}, "[deploying kubernetes now]", false},
+		{messageQuery{nick: "ALICE", limit: 10}, "[deploying kubernetes now kubernetes again]", false},
+		{messageQuery{network: "Rizon", limit: 10}, "[waves at k8s]", false},
+		{messageQuery{channel: "#go", after: start.Add(time.Minute), before: start.Add(3 * time.Minute), limit: 10}, "[good luck waves at k8s]", false},
+		// The most recent ones, oldest first
+		{messageQuery{limit: 2}, "[waves at k8s kubernetes again]", true},
+	}
+
+	for _, test := range tests {
+		found, hasMore, err := store.search(&test.query)
+		if err != nil {
+			t.Errorf("search(%+v) returned %v", test.query, err)
+			continue
+		}
+
+		var texts []string
+		for _, message := range found {
+			texts = append(texts, message.text)
+		}
+		if fmt.Sprint(texts) != test.texts || hasMore != test.hasMore {
+			t.Errorf("search(%+v) = %v, %v, expected %v, %v", test.query, texts, hasMore, test.texts, test.hasMore)
+		}
+	}
+
+	found, _, err := store.search(&messageQuery{nick: "bob", limit: 1})
+	if err != nil || len(found) != 1 {
+		t.Fatalf("Expected to find Bob's message, got %v, %v", found, err)
+	}
+	if message := found[0]; !message.time.Equal(messages[2].time) || message.source != storedMessageFromIRC || message.kind != chatLogAction || message.channel != "#GO" {
+		t.Errorf("Unexpected message: %+v", message)
+	}
+}
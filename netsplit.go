@@ -0,0 +1,188 @@
+package pino
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How long the quits (or rejoins) of a netsplit must stop before we summarize them
+	netsplitSettleDelay = 5 * time.Second
+	// How long we'll wait for the users lost in a netsplit to come back
+	netsplitRejoinTimeout = 30 * time.Minute
+	// How many nicks we'll list by name in a summary
+	netsplitMaxListedNicks = 10
+)
+
+// When a server splits from the network, its users quit with the names of the two servers
+// as the reason, like "hub.example.net leaf.example.net" (or "*.net *.split" on networks that hide them).
+var netsplitQuitReason = regexp.MustCompile(`^([a-zA-Z0-9*-]+(?:\.[a-zA-Z0-9*-]+)+) ([a-zA-Z0-9*-]+(?:\.[a-zA-Z0-9*-]+)+)$`)
+
+// The netsplitDetector notices netsplits and collects the flood of QUITs (and the JOINs when the
+// servers reconnect) into a single summary per channel, instead of one message per user.
+type netsplitDetector struct {
+	report func(channel IRCChannel, templateName string, data *messageTemplateData)
+
+	mutex  sync.Mutex
+	splits map[string]*netsplit
+	// Which netsplit each nick was lost in
+	splitNicks map[string]*netsplit
+}
+
+type netsplit struct {
+	servers string
+	started time.Time
+
+	// Nicks we haven't reported yet, by channel
+	quits   map[IRCChannel][]string
+	rejoins map[IRCChannel][]string
+
+	quitTimer   *time.Timer
+	rejoinTimer *time.Timer
+	expiryTimer *time.Timer
+}
+
+func newNetsplitDetector(report func(channel IRCChannel, templateName string, data *messageTemplateData)) *netsplitDetector {
+	return &netsplitDetector{
+		report:     report,
+		splits:     make(map[string]*netsplit),
+		splitNicks: make(map[string]*netsplit),
+	}
+}
+
+// Called for every QUIT, once per channel the user was in.
+// Returns true if the quit is part of a netsplit and will be reported in a summary.
+func (detector *netsplitDetector) handleQuit(channel IRCChannel, nick string, reason string) bool {
+	servers := netsplitQuitReason.FindStringSubmatch(reason)
+	if servers == nil {
+		return false
+	}
+	key := fmt.Sprintf("%v ↔ %v", servers[1], servers[2])
+
+	detector.mutex.Lock()
+	defer detector.mutex.Unlock()
+
+	split, ok := detector.splits[key]
+	if !ok {
+		split = &netsplit{
+			servers: key,
+			started: time.Now(),
+			quits:   make(map[IRCChannel][]string),
+			rejoins: make(map[IRCChannel][]string),
+		}
+		split.quitTimer = time.AfterFunc(netsplitSettleDelay, func() { detector.flushQuits(split) })
+		split.expiryTimer = time.AfterFunc(netsplitRejoinTimeout, func() { detector.expire(split) })
+		detector.splits[key] = split
+	} else {
+		split.quitTimer.Reset(netsplitSettleDelay)
+	}
+
+	split.quits[channel] = append(split.quits[channel], nick)
+	detector.splitNicks[nick] = split
+
+	return true
+}
+
+// Called for every JOIN. Returns true if the user is coming back from a netsplit,
+// in which case the join will be reported in a summary.
+func (detector *netsplitDetector) handleJoin(channel IRCChannel, nick string) bool {
+	detector.mutex.Lock()
+	defer detector.mutex.Unlock()
+
+	split, ok := detector.splitNicks[nick]
+	if !ok {
+		return false
+	}
+
+	split.rejoins[channel] = append(split.rejoins[channel], nick)
+	if split.rejoinTimer == nil {
+		split.rejoinTimer = time.AfterFunc(netsplitSettleDelay, func() { detector.flushRejoins(split) })
+	} else {
+		split.rejoinTimer.Reset(netsplitSettleDelay)
+	}
+
+	return true
+}
+
+func (detector *netsplitDetector) flushQuits(split *netsplit) {
+	detector.mutex.Lock()
+	quits := split.quits
+	split.quits = make(map[IRCChannel][]string)
+	detector.mutex.Unlock()
+
+	for channel, nicks := range quits {
+		detector.report(channel, "netsplit", &messageTemplateData{
+			Channel: channel,
+			Reason:  split.servers,
+			Text:    describeNetsplitNicks(nicks),
+		})
+	}
+}
+
+func (detector *netsplitDetector) flushRejoins(split *netsplit) {
+	detector.mutex.Lock()
+	rejoins := split.rejoins
+	split.rejoins = make(map[IRCChannel][]string)
+	split.rejoinTimer = nil
+	for _, nicks := range rejoins {
+		for _, nick := range nicks {
+			delete(detector.splitNicks, nick)
+		}
+	}
+	detector.mutex.Unlock()
+
+	elapsed := formatNetsplitDuration(time.Since(split.started))
+	for channel, nicks := range rejoins {
+		detector.report(channel, "netsplit-rejoin", &messageTemplateData{
+			Channel:  channel,
+			Reason:   split.servers,
+			Text:     describeNetsplitNicks(nicks),
+			Duration: elapsed,
+		})
+	}
+}
+
+// Forgets about a netsplit, so that users who come back much later are reported normally
+func (detector *netsplitDetector) expire(split *netsplit) {
+	detector.mutex.Lock()
+	defer detector.mutex.Unlock()
+
+	delete(detector.splits, split.servers)
+	for nick, nickSplit := range detector.splitNicks {
+		if nickSplit == split {
+			delete(detector.splitNicks, nick)
+		}
+	}
+}
+
+// Like "3 users (alice, bob, carol)", listing at most a handful of nicks
+func describeNetsplitNicks(nicks []string) string {
+	sorted := append([]string(nil), nicks...)
+	sort.Strings(sorted)
+
+	listed := sorted
+	if len(listed) > netsplitMaxListedNicks {
+		listed = append(listed[:netsplitMaxListedNicks:netsplitMaxListedNicks], "…")
+	}
+
+	noun := "users"
+	if len(sorted) == 1 {
+		noun = "user"
+	}
+
+	return fmt.Sprintf("%v %v (%v)", len(sorted), noun, strings.Join(listed, ", "))
+}
+
+// Like "45s" or "3m" or "1h12m"
+func formatNetsplitDuration(duration time.Duration) string {
+	if duration < time.Minute {
+		return duration.Round(time.Second).String()
+	}
+
+	formatted := duration.Round(time.Minute).String()
+	return strings.TrimSuffix(formatted, "0s")
+}
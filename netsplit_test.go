@@ -0,0 +1,83 @@
+package pino
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestNetsplitQuitReason(t *testing.T) {
+	tests := []struct {
+		reason     string
+		isNetsplit bool
+	}{
+		{"hub.example.net leaf.example.net", true},
+		{"*.net *.split", true},
+		{"irc-1.example.net irc-2.example.org", true},
+		{"Quit: leaving", false},
+		{"Ping timeout: 240 seconds", false},
+		{"hub.example.net", false},
+		{"see you at example.com tomorrow", false},
+		{"hub.example.net leaf.example.net extra", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		detector := newNetsplitDetector(func(IRCChannel, string, *messageTemplateData) {})
+		if isNetsplit := detector.handleQuit("#chat", "alice", test.reason); isNetsplit != test.isNetsplit {
+			t.Errorf("handleQuit(%q) = %v, expected %v", test.reason, isNetsplit, test.isNetsplit)
+		}
+	}
+}
+
+func TestNetsplitRejoins(t *testing.T) {
+	detector := newNetsplitDetector(func(IRCChannel, string, *messageTemplateData) {})
+
+	detector.handleQuit("#chat", "alice", "hub.example.net leaf.example.net")
+
+	if !detector.handleJoin("#chat", "alice") {
+		t.Error("Expected alice's join to be part of the netsplit")
+	}
+	if detector.handleJoin("#chat", "bob") {
+		t.Error("Expected bob's join not to be part of the netsplit")
+	}
+}
+
+func TestDescribeNetsplitNicks(t *testing.T) {
+	var many []string
+	for i := 12; i > 0; i-- {
+		many = append(many, fmt.Sprintf("user%02d", i))
+	}
+
+	tests := []struct {
+		nicks    []string
+		expected string
+	}{
+		{[]string{"alice"}, "1 user (alice)"},
+		{[]string{"carol", "alice", "bob"}, "3 users (alice, bob, carol)"},
+		{many, "12 users (user01, user02, user03, user04, user05, user06, user07, user08, user09, user10, …)"},
+	}
+
+	for _, test := range tests {
+		if described := describeNetsplitNicks(test.nicks); described != test.expected {
+			t.Errorf("describeNetsplitNicks(%v) = %q, expected %q", test.nicks, described, test.expected)
+		}
+	}
+}
+
+func TestFormatNetsplitDuration(t *testing.T) {
+	tests := []struct {
+		duration time.Duration
+		expected string
+	}{
+		{45*time.Second + 300*time.Millisecond, "45s"},
+		{3*time.Minute + 10*time.Second, "3m"},
+		{72 * time.Minute, "1h12m"},
+	}
+
+	for _, test := range tests {
+		if formatted := formatNetsplitDuration(test.duration); formatted != test.expected {
+			t.Errorf("formatNetsplitDuration(%v) = %q, expected %q", test.duration, formatted, test.expected)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package pino
+
+import (
+	"sync"
+	"time"
+)
+
+// An ircNetwork is one IRC connection, along with everything Pino keeps track of for it
+type ircNetwork struct {
+	// Empty for a config with a single network under IRC
+	name   string
+	config *IRCConfig
+	proxy  *ircProxy
+
+	deliveries      *ircDeliveryTracker
+	netsplits       *netsplitDetector
+	activity        *activityTracker
+	awayReplies     *awayAutoReplier
+	typing          *typingRelay
+	recentlyRelayed *recentlyRelayedMessages
+	history         *ircHistoryBackfill
+	seen            *seenTracker
+	seenCommands    *seenCommandLimiter
+
+	// An IRC channel can be bridged with Slack channels in more than one workspace
+	bridgesByIRCChannel map[IRCChannel][]*bridge
+
+	bufferPlaybackMutex  sync.Mutex
+	bufferPlaybackStates map[IRCChannel]*bufferPlaybackState
+}
+
+// Sets up everything for a network that doesn't need Slack. The rest is set up in NewPino,
+// once the Slack client exists.
+func newIRCNetwork(name string, config *IRCConfig, stateDirectory string, awayReplyInterval time.Duration, handleEvent func(*ircNetwork, *ircEvent)) (*ircNetwork, error) {
+	network := &ircNetwork{
+		name:                 name,
+		config:               config,
+		activity:             newActivityTracker(time.Duration(config.JoinPartFilter.ActivityWindowMinutes) * time.Minute),
+		awayReplies:          newAwayAutoReplier(awayReplyInterval),
+		recentlyRelayed:      newRecentlyRelayedMessages(),
+		seen:                 newSeenTracker(stateDirectory, namedStateFilename(ircSeenFilename, name)),
+		seenCommands:         newSeenCommandLimiter(),
+		bridgesByIRCChannel:  make(map[IRCChannel][]*bridge),
+		bufferPlaybackStates: make(map[IRCChannel]*bufferPlaybackState),
+	}
+
+	proxy, err := newIRCProxy(network.config, func(event *ircEvent) {
+		handleEvent(network, event)
+	})
+	if err != nil {
+		return nil, err
+	}
+	network.proxy = proxy
+	network.history = newIRCHistoryBackfill(stateDirectory, namedStateFilename(ircLastSeenFilename, name), proxy.requestHistoryAfter)
+
+	return network, nil
+}
+
+// The network's name as shown in logs and search results: its Name, or the server's host name if it has none
+func (network *ircNetwork) displayName() string {
+	if network.name != "" {
+		return network.name
+	}
+	return ircNetworkName(network.config)
+}
+
+func (network *ircNetwork) addBridge(bridge *bridge) {
+	key := ircChannelKey(bridge.ircChannel)
+	network.bridgesByIRCChannel[key] = append(network.bridgesByIRCChannel[key], bridge)
+}
+
+func (network *ircNetwork) bridgesForIRCChannel(channel IRCChannel) []*bridge {
+	return network.bridgesByIRCChannel[ircChannelKey(channel)]
+}
+
+// The bridges that relay the IRC channel to Slack
+func (network *ircNetwork) bridgesToSlack(channel IRCChannel) []*bridge {
+	var bridges []*bridge
+	for _, bridge := range network.bridgesForIRCChannel(channel) {
+		if bridge.relaysToSlack() {
+			bridges = append(bridges, bridge)
+		}
+	}
+	return bridges
+}
+
+// Whether to relay a join, part, quit, or nick change by the nick to the bridge, according to its JoinPartFilter
+func (network *ircNetwork) shouldRelayJoinPart(bridge *bridge, nick string) bool {
+	mode := network.config.JoinPartFilter.Default
+	if bridge.config.JoinPartFilter != "" {
+		mode = bridge.config.JoinPartFilter
+	}
+
+	switch mode {
+	case presenceFilterNone:
+		return false
+	case presenceFilterSmart:
+		return network.activity.isActive(bridge.ircChannel, nick)
+	}
+
+	return true
+}
+
+// Gets the buffer playback state of a channel, creating it if needed
+func (network *ircNetwork) bufferPlaybackStateFor(channel IRCChannel) *bufferPlaybackState {
+	network.bufferPlaybackMutex.Lock()
+	defer network.bufferPlaybackMutex.Unlock()
+
+	state, ok := network.bufferPlaybackStates[channel]
+	if !ok {
+		state = &bufferPlaybackState{}
+		network.bufferPlaybackStates[channel] = state
+	}
+
+	return state
+}
@@ -2,6 +2,11 @@ package pino
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	irc "github.com/fluffle/goirc/client"
 	"github.com/nlopes/slack"
@@ -10,263 +15,842 @@ import (
 
 // Pino is the central orchestrator
 type Pino struct {
-	config                   *Config
-	ircProxy                 *ircProxy
-	slackProxy               *slackProxy
-	slackChannelToIRCChannel map[SlackChannel]IRCChannel
-	ircChannelToSlackChannel map[IRCChannel]SlackChannel
+	config           *Config
+	networks         []*ircNetwork
+	networksByName   map[string]*ircNetwork
+	workspaces       []*slackProxy
+	workspacesByName map[string]*slackProxy
+	// The owner's own workspace, where they get DMs and send commands
+	slackProxy            *slackProxy
+	presence              *ownerPresenceTracker
+	digest                *highlightDigest
+	chatLog               *chatLogger
+	messages              *messageStore
+	bridgesBySlackChannel map[SlackChannel][]*bridge
+	threads               *slackThreadTracker
+	templates             messageTemplates
 }
 
 // NewPino creates a new Pino instance
 func NewPino(config *Config) (*Pino, error) {
 	pino := &Pino{
-		config: config,
+		config:           config,
+		networksByName:   make(map[string]*ircNetwork),
+		workspacesByName: make(map[string]*slackProxy),
 	}
 
-	ircProxy, err := newIRCProxy(&config.IRC)
-	if err != nil {
-		return pino, fmt.Errorf("Could not create IRC client: %v", err)
+	if config.StateDirectory != "" {
+		if err := os.MkdirAll(config.StateDirectory, 0700); err != nil {
+			return pino, fmt.Errorf("Could not create state directory %v: %v", config.StateDirectory, err)
+		}
+	}
+
+	awayReplyInterval := time.Duration(config.Away.AutoReplyIntervalMinutes) * time.Minute
+	networkNames := make([]string, 0, len(config.Networks))
+	for name := range config.Networks {
+		networkNames = append(networkNames, name)
+	}
+	sort.Strings(networkNames)
+
+	for _, name := range networkNames {
+		networkConfig := config.Networks[name]
+		network, err := newIRCNetwork(name, &networkConfig, config.StateDirectory, awayReplyInterval, pino.handleIRCEvent)
+		if err != nil {
+			return pino, fmt.Errorf("Could not create IRC client for %v: %v", describeNetwork(name), err)
+		}
+
+		pino.networks = append(pino.networks, network)
+		pino.networksByName[network.name] = network
 	}
-	pino.ircProxy = ircProxy
 
-	slackProxy, err := newSlackProxy(&config.Slack)
+	templates, err := newMessageTemplates(config.Templates)
 	if err != nil {
-		return pino, fmt.Errorf("Could not create Slack client: %v", err)
+		return pino, fmt.Errorf("Invalid Templates: %v", err)
 	}
-	pino.slackProxy = slackProxy
+	pino.templates = templates
 
-	pino.slackChannelToIRCChannel = make(map[SlackChannel]IRCChannel)
-	pino.ircChannelToSlackChannel = make(map[IRCChannel]SlackChannel)
-	// Set up the Slack channel -> IRC channel name mappings, and vice versa
-	for slackChannel, ircChannel := range pino.config.ChannelMapping {
-		pino.slackChannelToIRCChannel[slackChannel] = ircChannel
-		pino.ircChannelToSlackChannel[ircChannel] = slackChannel
+	// The owner's own workspace sorts first, since its channels don't have a workspace in front
+	mappedSlackChannels := make([]SlackChannel, 0, len(config.ChannelMapping))
+	coalesceWindows := make(map[string]map[SlackChannel]int)
+	for key, bridgeConfigs := range config.ChannelMapping {
+		mappedSlackChannels = append(mappedSlackChannels, key)
+
+		workspaceName, slackChannel := splitWorkspaceAndSlackChannel(key)
+		if coalesceWindows[workspaceName] == nil {
+			coalesceWindows[workspaceName] = make(map[SlackChannel]int)
+		}
+		// The bridges of a Slack channel all have the same window
+		coalesceWindows[workspaceName][slackChannel] = bridgeConfigs[0].CoalesceMilliseconds
+	}
+	sort.Slice(mappedSlackChannels, func(i, j int) bool { return mappedSlackChannels[i] < mappedSlackChannels[j] })
+
+	workspaceNames := []string{""}
+	for name := range config.Workspaces {
+		workspaceNames = append(workspaceNames, name)
 	}
+	sort.Strings(workspaceNames[1:])
+
+	for _, name := range workspaceNames {
+		workspaceConfig, _ := config.workspace(name)
+		workspace, err := newSlackProxy(name, workspaceConfig, config.StateDirectory, coalesceWindows[name])
+		if err != nil {
+			if name != "" {
+				err = fmt.Errorf("%v: %v", describeWorkspace(name), err)
+			}
+			return pino, fmt.Errorf("Could not create Slack client: %v", err)
+		}
+
+		workspace.dispatcher.onDropped = func(request *slackRequest, err error) {
+			channel := string(workspace.getChannelName(request.ChannelID))
+			if channel == "" {
+				channel = request.ChannelID
+			}
+			data := &messageTemplateData{Text: fmt.Sprintf("Couldn't send a message to %v on Slack: %v", joinWorkspaceAndSlackChannel(workspace.name, SlackChannel(channel)), err)}
+			pino.slackProxy.sendMessageToOwner(pino.templates.render("owner-error", data))
+		}
+
+		pino.workspaces = append(pino.workspaces, workspace)
+		pino.workspacesByName[name] = workspace
+	}
+	pino.slackProxy = pino.workspacesByName[""]
+
+	pino.bridgesBySlackChannel = make(map[SlackChannel][]*bridge)
+	pino.threads = newSlackThreadTracker(config.StateDirectory)
+	// Set up the Slack channel -> IRC channel bridges, and vice versa
+	for _, key := range mappedSlackChannels {
+		workspaceName, slackChannel := splitWorkspaceAndSlackChannel(key)
+		bridgeConfigs := config.ChannelMapping[key]
+
+		for i := range bridgeConfigs {
+			bridgeConfig := &bridgeConfigs[i]
+			network, ok := pino.networksByName[bridgeConfig.Network]
+			if !ok {
+				return pino, fmt.Errorf("Could not set up bridge for %v: unknown network '%v'", key, bridgeConfig.Network)
+			}
+
+			bridge, err := newBridge(pino.workspacesByName[workspaceName], slackChannel, network, bridgeConfig, config.Templates)
+			if err != nil {
+				return pino, fmt.Errorf("Could not set up bridge for %v: %v", key, err)
+			}
+			// A Slack channel with more than one IRC channel needs to say which one everything came from,
+			// unless each one has its own threads
+			if bridgeConfig.Threaded {
+				bridge.threads = pino.threads
+			} else {
+				bridge.isMerged = len(bridgeConfigs) > 1
+			}
+
+			pino.bridgesBySlackChannel[key] = append(pino.bridgesBySlackChannel[key], bridge)
+			network.addBridge(bridge)
+		}
+	}
+
+	for _, network := range pino.networks {
+		network := network
+		network.deliveries = newIRCDeliveryTracker(&config.DeliveryConfirmation)
+		network.typing = newTypingRelay(network.proxy.sendTyping)
+		network.netsplits = newNetsplitDetector(func(channel IRCChannel, templateName string, data *messageTemplateData) {
+			event := "quit"
+			if templateName == "netsplit-rejoin" {
+				event = "join"
+			}
+			pino.relayIRCEvent(network, channel, event, templateName, data)
+		})
+	}
+
+	pino.presence = newOwnerPresenceTracker(pino.slackProxy, pino.handleOwnerAvailabilityChange, pino.syncAway)
+	pino.digest = newHighlightDigest()
+	pino.chatLog = newChatLogger(&config.ChatLog)
+
+	messages, err := newMessageStore(&config.MessageStore, config.StateDirectory)
+	if err != nil {
+		return pino, err
+	}
+	pino.messages = messages
 
 	return pino, nil
 }
 
 // Run connects to IRC and Slack and runs the main loop
 func (pino *Pino) Run() error {
-	if err := pino.ircProxy.connect(); err != nil {
-		return fmt.Errorf("IRC connection error: %s", err.Error())
+	// Slack comes first, so its channels and users are known by the time IRC has anything to relay
+	for _, workspace := range pino.workspaces {
+		if err := workspace.connect(); err != nil {
+			return fmt.Errorf("Slack connection error on %v: %s", describeWorkspace(workspace.name), err.Error())
+		}
 	}
-	if err := pino.slackProxy.connect(); err != nil {
-		return fmt.Errorf("Slack connection error: %s", err.Error())
+	pino.presence.start()
+
+	for _, network := range pino.networks {
+		if err := network.proxy.connect(); err != nil {
+			return fmt.Errorf("IRC connection error on %v: %s", network.displayName(), err.Error())
+		}
+		network.proxy.intake.start()
 	}
 
 	// Channel to signal that the program should stop running
 	quit := make(chan bool)
 
-	go pino.handleIRCEvents(quit)
-	go pino.handleSlackEvents(quit)
+	for _, workspace := range pino.workspaces {
+		go pino.handleSlackEvents(workspace, quit)
+	}
 
 	<-quit
 
 	return nil
 }
 
-// Consumes incoming IRC events in a loop
-func (pino *Pino) handleIRCEvents(quit chan bool) {
-	previousNickMemberships := pino.ircProxy.snapshotOfNicksInChannels()
+// Handles a single IRC event from the network. Events for the same channel are handled in order,
+// but events for different channels or networks may be handled concurrently.
+func (pino *Pino) handleIRCEvent(network *ircNetwork, event *ircEvent) {
+	line := event.line
 
-	// For buffer playback, we care about whether the buffer playback mode changed in the previous line
-	// in deciding whether to print the subsequent lines
-	wasInBufferPlaybackMode := false
-	isInBufferPlaybackMode := false
+	playback := network.bufferPlaybackStateFor(event.channel)
 
-	for {
-		select {
-		case line := <-pino.ircProxy.incomingEvents:
-			switch line.Cmd {
-			case irc.CONNECTED:
-				fmt.Printf("Connected to IRC!\n")
-				ircChannels := pino.config.getUsedIRCChannels()
-				for _, ircChannel := range ircChannels {
-					fmt.Printf("Joining IRC channel: %v\n", ircChannel)
-					pino.ircProxy.join(ircChannel)
-				}
+	if isIRCHistoryBatch(event.batch) {
+		pino.handleIRCHistoryLine(network, line)
+		return
+	}
 
-				message := fmt.Sprintf("Connected to IRC on %v!", pino.ircProxy.config.Server)
-				pino.slackProxy.sendMessageToOwner(message)
+	switch line.Cmd {
+	case irc.CONNECTED:
+		fmt.Printf("Connected to IRC on %v!\n", network.displayName())
+		ircChannels := pino.config.getUsedIRCChannels(network.name)
+		for _, ircChannel := range ircChannels {
+			fmt.Printf("Joining IRC channel: %v\n", ircChannel)
+			network.proxy.join(ircChannel)
+		}
 
-			case irc.DISCONNECTED:
-				fmt.Printf("Disconnected from IRC!")
-				message := fmt.Sprintf("Disconnected from IRC on %v!", pino.ircProxy.config.Server)
-				pino.slackProxy.sendMessageToOwner(message)
+		data := &messageTemplateData{Network: network.name, Server: network.config.Server}
+		pino.slackProxy.sendMessageToOwner(pino.templates.render("connected", data))
 
-			case irc.ACTION:
-				channel := IRCChannel(line.Target())
-				action := line.Text()
-				username := line.Nick
+		pino.syncNetworkAway(network)
 
-				fmt.Printf("ACTION: %v %s\n", username, action)
-				message := fmt.Sprintf("> *%v %v*", username, action)
+	case irc.DISCONNECTED:
+		fmt.Printf("Disconnected from IRC on %v!\n", network.displayName())
+		data := &messageTemplateData{Network: network.name, Server: network.config.Server}
+		pino.slackProxy.sendMessageToOwner(pino.templates.render("disconnected", data))
 
-				if !isInBufferPlaybackMode {
-					pino.slackProxy.sendMessageAsUser(pino.ircChannelToSlackChannel[channel], username, message)
-				}
+		network.deliveries.failAll("IRC was disconnected")
 
-			case irc.JOIN:
-				channel := IRCChannel(line.Text())
-				username := line.Nick
-				usermask := line.Src
-
-				fmt.Printf("JOIN: %v(%v) has joined %v\n", line.Nick, line.Src, channel)
-				message := fmt.Sprintf("> *%v* (%v) joined the channel", username, usermask)
-				pino.slackProxy.sendMessageAsBot(pino.ircChannelToSlackChannel[channel], message)
-
-				previousNickMemberships = pino.ircProxy.snapshotOfNicksInChannels()
-			case irc.INVITE:
-				// Actually doing anything with invites has not been implemented yet.
-				channel := line.Args[1]
-				fmt.Printf("INVITE: %v(%v) invited you to %v\n", line.Nick, line.Src, channel)
-
-			case irc.KICK:
-				channel := IRCChannel(line.Target())
-				kicker := line.Nick
-				kickee := line.Args[1]
-				reason := line.Args[2]
-				fmt.Printf("KICK: (%v) %v has kicked %v (%v)\n", channel, kicker, kickee, reason)
-
-				message := fmt.Sprintf("> *%v* kicked *%v* from the channel (%v)", kicker, kickee, reason)
-				pino.slackProxy.sendMessageAsBot(pino.ircChannelToSlackChannel[channel], message)
-
-				previousNickMemberships = pino.ircProxy.snapshotOfNicksInChannels()
-			case irc.MODE:
-				username := line.Nick
-				mode := line.Args[1]
-
-				if len(line.Args) == 2 {
-					// This was a User mode command
-					destination := line.Args[0]
-					fmt.Printf("MODE: %v has set mode %v on %v\n", username, mode, destination)
-				} else {
-					// This was a Channel mode command
-					channel := IRCChannel(line.Args[0])
-					destination := line.Args[2]
-					fmt.Printf("MODE: (%v) %v sets %v %v\n", channel, username, mode, destination)
-
-					message := fmt.Sprintf("> *%v* sets *%v* *%v*", username, mode, destination)
-					pino.slackProxy.sendMessageAsBot(pino.ircChannelToSlackChannel[channel], message)
-				}
+	case irc.ACTION:
+		channel := IRCChannel(line.Target())
+		action := line.Text()
+		username := line.Nick
 
-			case irc.NICK:
-				oldNick := line.Nick
-				newNick := line.Text()
-				fmt.Printf("NICK: %v is now known as %v\n", oldNick, newNick)
+		fmt.Printf("ACTION: %v %s\n", username, action)
+		network.activity.recordMessage(channel, username)
 
-				message := fmt.Sprintf("> %v is now known as *%v*", oldNick, newNick)
-				for ircChannel, nicks := range previousNickMemberships {
-					if _, ok := nicks[oldNick]; !ok {
-						// The user was not in this channel
-						continue
-					}
+		if username == network.proxy.currentNick() && network.deliveries.confirm(channel, action) {
+			// The server echoed back an action we sent from Slack
+			break
+		}
 
-					slackChannel := pino.ircChannelToSlackChannel[ircChannel]
-					pino.slackProxy.sendMessageAsBot(slackChannel, message)
-				}
+		if playback.isActive {
+			pino.handleBufferPlaybackLine(network, channel, playback, line)
+			break
+		}
+		network.history.recordSeen(channel, ircLineTime(line))
+		pino.chatLog.log(network, &chatLogEntry{Time: ircLineTime(line), Channel: channel, Kind: chatLogAction, Nick: username, Text: action})
+		pino.messages.add(&storedMessage{time: ircLineTime(line), source: storedMessageFromIRC, network: network.name, channel: channel, nick: username, kind: chatLogAction, text: action})
+		if isIRCChannelName(string(channel)) {
+			network.seen.messageSent(channel, username, line.Src, "* "+username+" "+action, ircLineTime(line))
+		}
 
-				previousNickMemberships = pino.ircProxy.snapshotOfNicksInChannels()
-			case irc.PART:
-				channel := IRCChannel(line.Target())
-				reason := line.Text()
-				username := line.Nick
-				usermask := line.Src
-				fmt.Printf("PART: (%v) %v(%v) has left (%s)\n", channel, username, usermask, reason)
-
-				message := fmt.Sprintf("> *%v* (%v) left the channel", username, usermask)
-				pino.slackProxy.sendMessageAsBot(pino.ircChannelToSlackChannel[channel], message)
-
-				previousNickMemberships = pino.ircProxy.snapshotOfNicksInChannels()
-			case irc.PRIVMSG:
-				target := line.Target()
-				username := line.Nick
-				text := line.Text()
-
-				fmt.Printf("PRIVMSG: (%v) <%v> %v\n", target, username, text)
-
-				if isInBufferPlaybackMode {
-					if isBufferPlaybackEndLine(line) {
-						isInBufferPlaybackMode = false
-					}
-				} else {
-					if isBufferPlaybackStartLine(line) {
-						isInBufferPlaybackMode = true
-					}
-				}
+		if len(network.bridgesForIRCChannel(channel)) > 0 {
+			pino.relayIRCMessage(network, line, "action", false)
+		} else if !isIRCChannelName(string(channel)) {
+			pino.handleIRCPrivateMessage(network, line)
+		}
 
-				// Simply being out of buffer playback mode is not sufficient for deciding to output the line
-				// because we consider ourselves out of the buffer playback mode on the line where playback ends.
-				if !wasInBufferPlaybackMode && !isInBufferPlaybackMode {
+	case irc.JOIN:
+		channel := IRCChannel(line.Args[0])
+		username := line.Nick
+		usermask := line.Src
 
-					possibleChannel := IRCChannel(target)
-					if slackChannel, ok := pino.ircChannelToSlackChannel[possibleChannel]; ok {
+		fmt.Printf("JOIN: %v(%v) has joined %v\n", line.Nick, line.Src, channel)
+		pino.chatLog.log(network, &chatLogEntry{Time: ircLineTime(line), Channel: channel, Kind: chatLogJoin, Nick: username, Usermask: usermask})
+		network.seen.joined(channel, username, usermask, ircLineTime(line))
 
-						if pino.ircProxy.shouldHighlightOwnerOnMessageByNick(text, username) {
-							pino.slackProxy.sendMessageAsBot(
-								slackChannel,
-								fmt.Sprintf("@%v: you were pinged by %v", pino.slackProxy.config.Owner, username),
-							)
-						}
+		if username == network.proxy.currentNick() {
+			pino.catchUpOnIRCChannel(network, channel, ircLineTime(line))
+		}
 
-						pino.slackProxy.sendMessageAsUser(slackChannel, username, text)
-					}
-				}
+		if network.netsplits.handleJoin(channel, username) {
+			break
+		}
 
-				wasInBufferPlaybackMode = isInBufferPlaybackMode
+		data := &messageTemplateData{Nick: username, Usermask: usermask, Channel: channel}
+		pino.relayIRCJoinPart(network, channel, "join", data, username)
+
+	case irc.INVITE:
+		// Actually doing anything with invites has not been implemented yet.
+		channel := line.Args[1]
+		fmt.Printf("INVITE: %v(%v) invited you to %v\n", line.Nick, line.Src, channel)
+
+	case irc.KICK:
+		channel := IRCChannel(line.Target())
+		kicker := line.Nick
+		kickee := line.Args[1]
+		reason := line.Args[2]
+		fmt.Printf("KICK: (%v) %v has kicked %v (%v)\n", channel, kicker, kickee, reason)
+		pino.chatLog.log(network, &chatLogEntry{Time: ircLineTime(line), Channel: channel, Kind: chatLogKick, Nick: kicker, Usermask: line.Src, Target: kickee, Text: reason})
+
+		data := &messageTemplateData{Nick: kicker, Usermask: line.Src, Channel: channel, Target: kickee, Reason: reason}
+		pino.relayIRCEvent(network, channel, "kick", "kick", data)
+
+	case irc.MODE:
+		username := line.Nick
+		mode := line.Args[1]
+
+		if len(line.Args) == 2 {
+			// This was a User mode command
+			destination := line.Args[0]
+			fmt.Printf("MODE: %v has set mode %v on %v\n", username, mode, destination)
+		} else {
+			// This was a Channel mode command
+			channel := IRCChannel(line.Args[0])
+			destination := line.Args[2]
+			fmt.Printf("MODE: (%v) %v sets %v %v\n", channel, username, mode, destination)
+			pino.chatLog.log(network, &chatLogEntry{Time: ircLineTime(line), Channel: channel, Kind: chatLogMode, Nick: username, Usermask: line.Src, Target: destination, Value: mode})
+
+			data := &messageTemplateData{Nick: username, Usermask: line.Src, Channel: channel, Target: destination, Mode: mode}
+			pino.relayIRCEvent(network, channel, "mode", "mode", data)
+		}
 
-			case irc.QUIT:
-				username := line.Nick
-				usermask := line.Src
-				reason := line.Args[0]
+	case irc.NICK:
+		oldNick := line.Nick
+		newNick := line.Text()
+		fmt.Printf("NICK: (%v) %v is now known as %v\n", event.channel, oldNick, newNick)
+		pino.chatLog.log(network, &chatLogEntry{Time: ircLineTime(line), Channel: event.channel, Kind: chatLogNick, Nick: oldNick, Usermask: line.Src, Value: newNick})
+		network.seen.changedNick(oldNick, newNick, line.Src, ircLineTime(line))
+
+		// The intake delivers a NICK once for every channel the user was in.
+		// Either nick may be the one we've seen talking, depending on whether another channel got here first.
+		data := &messageTemplateData{Nick: oldNick, Usermask: line.Src, Channel: event.channel, NewNick: newNick}
+		pino.relayIRCJoinPart(network, event.channel, "nick", data, oldNick, newNick)
+		network.activity.renameNick(oldNick, newNick)
+
+	case irc.PART:
+		channel := IRCChannel(line.Target())
+		reason := line.Text()
+		username := line.Nick
+		usermask := line.Src
+		fmt.Printf("PART: (%v) %v(%v) has left (%s)\n", channel, username, usermask, reason)
+		pino.chatLog.log(network, &chatLogEntry{Time: ircLineTime(line), Channel: channel, Kind: chatLogPart, Nick: username, Usermask: usermask, Text: reason})
+		network.seen.parted(channel, username, usermask, reason, ircLineTime(line))
+
+		data := &messageTemplateData{Nick: username, Usermask: usermask, Channel: channel, Reason: reason}
+		pino.relayIRCJoinPart(network, channel, "part", data, username)
+
+	case irc.PRIVMSG:
+		target := line.Target()
+		username := line.Nick
+		text := line.Text()
+
+		fmt.Printf("PRIVMSG: (%v) <%v> %v\n", target, username, text)
+		network.activity.recordMessage(IRCChannel(target), username)
+
+		if username == network.proxy.currentNick() && network.deliveries.confirm(IRCChannel(target), text) {
+			// The server echoed back a message we sent from Slack
+			break
+		}
 
-				fmt.Printf("QUIT: %v(%v) has quit (%v)\n", username, usermask, reason)
+		if isBufferPlaybackStartLine(line) {
+			playback.isActive = true
+			playback.lines = nil
+			break
+		}
+		if playback.isActive {
+			if isBufferPlaybackEndLine(line) {
+				playback.isActive = false
+				pino.finishBufferPlayback(network, IRCChannel(target), playback)
+			} else {
+				pino.handleBufferPlaybackLine(network, IRCChannel(target), playback, line)
+			}
+			break
+		}
+		network.history.recordSeen(IRCChannel(target), ircLineTime(line))
+		pino.chatLog.log(network, &chatLogEntry{Time: ircLineTime(line), Channel: IRCChannel(target), Kind: chatLogMessage, Nick: username, Text: text})
+		pino.messages.add(&storedMessage{time: ircLineTime(line), source: storedMessageFromIRC, network: network.name, channel: IRCChannel(target), nick: username, kind: chatLogMessage, text: text})
+		if isIRCChannelName(target) {
+			network.seen.messageSent(IRCChannel(target), username, line.Src, text, ircLineTime(line))
+		}
+		if nick, ok := parseIRCSeenCommand(text); ok && !network.config.DisableSeenCommand {
+			pino.replyToIRCSeenCommand(network, line, nick)
+		}
 
-				message := fmt.Sprintf("> *%v* (%v) left IRC (%v)", username, usermask, reason)
-				for ircChannel, nicks := range previousNickMemberships {
-					if _, ok := nicks[username]; !ok {
-						// The user was not in this channel
-						continue
-					}
+		possibleChannel := IRCChannel(target)
+		if len(network.bridgesForIRCChannel(possibleChannel)) > 0 {
+			pino.relayIRCMessage(network, line, "message", true)
+		} else if !isIRCChannelName(target) {
+			pino.handleIRCPrivateMessage(network, line)
+		}
 
-					slackChannel := pino.ircChannelToSlackChannel[ircChannel]
-					pino.slackProxy.sendMessageAsBot(slackChannel, message)
-				}
+	case irc.QUIT:
+		username := line.Nick
+		usermask := line.Src
+		reason := line.Args[0]
 
-				previousNickMemberships = pino.ircProxy.snapshotOfNicksInChannels()
-			case irc.TOPIC:
-				channel := IRCChannel(line.Target())
-				username := line.Nick
-				topic := line.Text()
-				fmt.Printf("TOPIC: (%v) %v has changed the topic to \"%v\"\n", channel, username, topic)
+		fmt.Printf("QUIT: (%v) %v(%v) has quit (%v)\n", event.channel, username, usermask, reason)
+		pino.chatLog.log(network, &chatLogEntry{Time: ircLineTime(line), Channel: event.channel, Kind: chatLogQuit, Nick: username, Usermask: usermask, Text: reason})
+		network.seen.quit(username, usermask, reason, ircLineTime(line))
 
-				message := fmt.Sprintf("> *%v* changed the topic to *%v*", username, topic)
-				pino.slackProxy.sendMessageAsBot(pino.ircChannelToSlackChannel[channel], message)
+		if network.netsplits.handleQuit(event.channel, username, reason) {
+			break
+		}
 
-			default:
-				fmt.Printf("Received unrecognized line: %#v\n", line)
+		// The intake delivers a QUIT once for every channel the user was in
+		data := &messageTemplateData{Nick: username, Usermask: usermask, Channel: event.channel, Reason: reason}
+		pino.relayIRCJoinPart(network, event.channel, "quit", data, username)
+
+	case irc.TOPIC:
+		channel := IRCChannel(line.Target())
+		username := line.Nick
+		topic := line.Text()
+		fmt.Printf("TOPIC: (%v) %v has changed the topic to \"%v\"\n", channel, username, topic)
+		pino.chatLog.log(network, &chatLogEntry{Time: ircLineTime(line), Channel: channel, Kind: chatLogTopic, Nick: username, Usermask: line.Src, Text: topic})
+
+		data := &messageTemplateData{Nick: username, Usermask: line.Src, Channel: channel, Text: topic}
+		pino.relayIRCEvent(network, channel, "topic", "topic", data)
+
+	case ircTagMessage:
+		channel := IRCChannel(line.Target())
+		typing, ok := line.Tags["+typing"]
+		if !ok || network.config.DisableTypingIndicators || playback.isActive || line.Nick == network.proxy.currentNick() {
+			break
+		}
+
+		for _, bridge := range network.bridgesToSlack(channel) {
+			// Slack can only show typing in the channel, which wouldn't say which thread it's for
+			if bridge.threads == nil {
+				network.typing.ircUserTyping(bridge.slack, bridge.slackChannel, typing)
+			}
+		}
+
+	case irc.NOTICE:
+		target := line.Target()
+		text := line.Text()
+		fmt.Printf("NOTICE: (%v) -%v- %v\n", target, line.Src, text)
+
+		if isIRCChannelName(target) {
+			pino.chatLog.log(network, &chatLogEntry{Time: ircLineTime(line), Channel: IRCChannel(target), Kind: chatLogNotice, Nick: line.Nick, Usermask: line.Src, Text: text})
+			pino.messages.add(&storedMessage{time: ircLineTime(line), source: storedMessageFromIRC, network: network.name, channel: IRCChannel(target), nick: line.Nick, kind: chatLogNotice, text: text})
+		}
+
+		if len(network.bridgesForIRCChannel(IRCChannel(target))) > 0 {
+			for _, bridge := range network.bridgesToSlack(IRCChannel(target)) {
+				data := &messageTemplateData{Nick: line.Nick, Usermask: line.Src, Channel: IRCChannel(target), Text: bridge.formatForSlack(text)}
+				bridge.sendMessageAsBot(bridge.render("notice", data))
+			}
+			break
+		}
+
+		if isIRCPreRegistrationNotice(line) || isIRCChannelName(target) {
+			// Notices from before we've registered are just connection chatter,
+			// and we don't care about channels that aren't mapped.
+			break
+		}
+
+		data := &messageTemplateData{Network: network.name, Server: network.config.Server, Text: text}
+		if line.Src != "" && strings.Contains(line.Src, "!") {
+			if !isIRCServicesNick(line.Nick) {
+				// Anyone else's notices only reach the owner the way a private message would
+				pino.highlightIRCPrivateLine(network, line)
+				break
 			}
+			data.Nick = line.Nick
+			data.Usermask = line.Src
+		}
+		pino.slackProxy.sendMessageToOwner(pino.templates.render("owner-notice", data))
+
+	default:
+		if _, ok := ircErrorDescriptions[line.Cmd]; ok {
+			pino.handleIRCErrorNumeric(network, line)
+			break
+		}
+		fmt.Printf("Received unrecognized line: %#v\n", line)
+	}
+}
+
+// Posts a message about an IRC event (like a join) to the Slack channels bridged with the IRC channel,
+// if their bridges show this kind of event. The message is rendered from the named template.
+func (pino *Pino) relayIRCEvent(network *ircNetwork, channel IRCChannel, event string, templateName string, data *messageTemplateData) {
+	pino.relayIRCEventToBridges(network, network.bridgesForIRCChannel(channel), event, templateName, data)
+}
+
+// Like relayIRCEvent for a join, part, quit, or nick change, but only to the bridges whose
+// JoinPartFilter lets one of the nicks through
+func (pino *Pino) relayIRCJoinPart(network *ircNetwork, channel IRCChannel, event string, data *messageTemplateData, nicks ...string) {
+	var bridges []*bridge
+	for _, bridge := range network.bridgesForIRCChannel(channel) {
+		for _, nick := range nicks {
+			if network.shouldRelayJoinPart(bridge, nick) {
+				bridges = append(bridges, bridge)
+				break
+			}
+		}
+	}
+
+	pino.relayIRCEventToBridges(network, bridges, event, event, data)
+}
+
+func (pino *Pino) relayIRCEventToBridges(network *ircNetwork, bridges []*bridge, event string, templateName string, data *messageTemplateData) {
+	data.Network = network.name
+
+	for _, bridge := range bridges {
+		if bridge.showsEvent(event) {
+			bridge.sendMessageAsBot(bridge.render(templateName, data))
 		}
+	}
+}
+
+// Asks for whatever was said in the channel since we last saw it, if the server can tell us
+func (pino *Pino) catchUpOnIRCChannel(network *ircNetwork, channel IRCChannel, joinedAt time.Time) {
+	lastSeen, ok := network.history.joined(channel, joinedAt)
+	if !ok {
+		return
+	}
+
+	network.history.requestHistoryAfter(channel, lastSeen)
+}
+
+// Relays a message we missed, from the reply to a CHATHISTORY request, labelled with when it was sent
+func (pino *Pino) handleIRCHistoryLine(network *ircNetwork, line *irc.Line) {
+	var templateName, kind string
+	switch line.Cmd {
+	case irc.PRIVMSG:
+		templateName = "history-message"
+		kind = chatLogMessage
+	case irc.ACTION:
+		templateName = "history-action"
+		kind = chatLogAction
+	default:
+		return
+	}
+
+	channel := IRCChannel(line.Target())
+	sentAt := ircLineTime(line)
+
+	// Our own messages came from Slack in the first place
+	if line.Nick == network.proxy.currentNick() || !network.history.wasMissed(channel, sentAt) {
+		return
+	}
+	network.history.recordSeen(channel, sentAt)
+	pino.messages.add(&storedMessage{time: sentAt, source: storedMessageFromIRC, network: network.name, channel: channel, nick: line.Nick, kind: kind, text: line.Text()})
 
+	bridges := network.bridgesToSlack(channel)
+	if len(bridges) == 0 {
+		return
+	}
+	network.recentlyRelayed.record(channel, line.Nick, line.Text(), sentAt)
+
+	for _, bridge := range bridges {
+		data := &messageTemplateData{
+			Nick:     line.Nick,
+			Usermask: line.Src,
+			Channel:  channel,
+			Text:     bridge.formatForSlack(line.Text()),
+			Time:     formatSlackTime(sentAt),
+		}
+		bridge.sendMessageAsUser(line.Nick, bridge.render(templateName, data))
 	}
 }
 
-// Consumes incoming Slack events in a loop
-func (pino *Pino) handleSlackEvents(quit chan bool) {
+// Handles a line from the middle of a ZNC buffer playback, according to each bridge's playback mode
+func (pino *Pino) handleBufferPlaybackLine(network *ircNetwork, channel IRCChannel, playback *bufferPlaybackState, line *irc.Line) {
+	var bridges []*bridge
+	for _, bridge := range network.bridgesToSlack(channel) {
+		if bridge.playbackMode() != playbackModeDrop {
+			bridges = append(bridges, bridge)
+		}
+	}
+	if len(bridges) == 0 {
+		return
+	}
+
+	played := parsePlaybackLine(line, time.Now())
+	if pino.wasAlreadyRelayed(network, channel, played) {
+		return
+	}
+	network.history.recordSeen(channel, played.sentAt)
+	network.recentlyRelayed.record(channel, line.Nick, played.text, played.sentAt)
+
+	threaded := false
+	for _, bridge := range bridges {
+		if bridge.playbackMode() == playbackModeThread {
+			threaded = true
+			continue
+		}
+		bridge.sendMessageAsUser(line.Nick, bridge.render(playbackTemplateName(played), pino.playbackTemplateData(bridge, played)))
+	}
+
+	if threaded {
+		playback.lines = append(playback.lines, played)
+	}
+}
+
+// Posts the lines collected during a playback as a thread, for bridges that want that
+func (pino *Pino) finishBufferPlayback(network *ircNetwork, channel IRCChannel, playback *bufferPlaybackState) {
+	lines := playback.lines
+	playback.lines = nil
+
+	if len(lines) == 0 {
+		return
+	}
+
+	for _, bridge := range network.bridgesToSlack(channel) {
+		if bridge.playbackMode() != playbackModeThread {
+			continue
+		}
+
+		bridge := bridge
+		data := &messageTemplateData{Channel: channel, Count: len(lines)}
+		bridge.slack.sendMessageAsBotWithCallback(bridge.slackChannel, bridge.render("playback-thread", data), func(timestamp string) {
+			if timestamp == "" {
+				// Without a thread to put them in, the lines go in the channel
+				fmt.Printf("Could not start the playback thread for %v, so its %v lines go in the channel\n", bridge.slackChannel, len(lines))
+			}
+			for _, played := range lines {
+				message := bridge.render(playbackTemplateName(played), pino.playbackTemplateData(bridge, played))
+				bridge.slack.replyInThreadAsUser(bridge.slackChannel, timestamp, played.line.Nick, message)
+			}
+		})
+	}
+}
+
+// Whether Slack has already seen a played back line. ZNC plays back its whole buffer,
+// which can include lines we relayed before we were disconnected.
+func (pino *Pino) wasAlreadyRelayed(network *ircNetwork, channel IRCChannel, played *playbackLine) bool {
+	if played.line.Nick == network.proxy.currentNick() {
+		// Our own lines came from Slack in the first place
+		return true
+	}
+
+	if network.recentlyRelayed.contains(channel, played.line.Nick, played.text, played.sentAt) {
+		return true
+	}
+
+	// ZNC's timestamps only go down to the second, so anything in the same second as the last
+	// message we saw might be new
+	lastSeen, ok := network.history.lastSeenIn(channel)
+	return ok && played.sentAt.Before(lastSeen.Truncate(time.Second))
+}
+
+func (pino *Pino) playbackTemplateData(bridge *bridge, played *playbackLine) *messageTemplateData {
+	return &messageTemplateData{
+		Nick:     played.line.Nick,
+		Usermask: played.line.Src,
+		Channel:  bridge.ircChannel,
+		Text:     bridge.formatForSlack(played.text),
+		Time:     formatSlackTime(played.sentAt),
+	}
+}
+
+func playbackTemplateName(played *playbackLine) string {
+	if played.line.Cmd == irc.ACTION {
+		return "history-action"
+	}
+	return "history-message"
+}
+
+// Relays a message or action from an IRC channel to the Slack channels bridged with it.
+// The owner only hears about a highlight once, however many channels it shows up in.
+func (pino *Pino) relayIRCMessage(network *ircNetwork, line *irc.Line, templateName string, coalesce bool) {
+	notifiedOwner := false
+	for _, bridge := range network.bridgesToSlack(IRCChannel(line.Target())) {
+		if pino.relayIRCMessageToBridge(bridge, line, templateName, coalesce, !notifiedOwner) {
+			notifiedOwner = true
+		}
+	}
+}
+
+// Relays a message or action through a bridge, carrying out whatever highlight rule it matches.
+// Returns whether the owner was (or will be, in the digest) sent a DM about it, which only happens if notifyOwner.
+func (pino *Pino) relayIRCMessageToBridge(bridge *bridge, line *irc.Line, templateName string, coalesce bool, notifyOwner bool) bool {
+	network := bridge.network
+	channel := IRCChannel(line.Target())
+	text := line.Text()
+
+	data := &messageTemplateData{
+		Network:  network.name,
+		Nick:     line.Nick,
+		Usermask: line.Src,
+		Channel:  channel,
+		Text:     bridge.formatForSlack(text),
+		Owner:    bridge.slack.ownerID,
+	}
+
+	rule := network.proxy.highlightRuleFor(bridge.highlightRules, &ircHighlightCandidate{
+		channel:  channel,
+		nick:     line.Nick,
+		usermask: line.Src,
+		account:  network.proxy.accountForLine(line),
+		text:     text,
+	})
+
+	// While the owner isn't around, highlights wait for the digest instead of pinging them
+	digesting := (rule.has(highlightActionMention) || rule.has(highlightActionDM)) && pino.shouldDigestHighlights()
+	var digested *messageTemplateData
+	if digesting && notifyOwner {
+		digested = pino.digest.add(data)
+	}
+	sendDM := rule.has(highlightActionDM) && !digesting && notifyOwner
+
+	if rule.has(highlightActionMention) && !digesting {
+		bridge.sendMessageAsBot(bridge.render("highlight", data))
+	}
+
+	if rule.has(highlightActionSuppress) {
+		// There's no relayed message to link to, so the DM has to stand on its own
+		if sendDM {
+			pino.slackProxy.sendMessageToOwner(bridge.renderForOwner("highlight-dm", data))
+		}
+		return sendDM || digested != nil
+	}
+
+	var onDelivered func(timestamp string, threadTimestamp string)
+	if sendDM || rule.has(highlightActionReact) || digested != nil {
+		channelID := bridge.slack.getChannelID(bridge.slackChannel)
+		onDelivered = func(timestamp string, threadTimestamp string) {
+			if timestamp == "" {
+				// The message never made it to Slack, so there's nothing to react to or link to
+				if sendDM {
+					pino.slackProxy.sendMessageToOwner(bridge.renderForOwner("highlight-dm", data))
+				}
+				return
+			}
+
+			if rule.has(highlightActionReact) {
+				bridge.slack.addReaction(channelID, timestamp, rule.reaction)
+			}
+
+			link := bridge.slack.permalink(channelID, timestamp, threadTimestamp)
+			if digested != nil {
+				pino.digest.setLink(digested, link)
+			} else if sendDM {
+				dmData := *data
+				dmData.Link = link
+				pino.slackProxy.sendMessageToOwner(bridge.renderForOwner("highlight-dm", &dmData))
+			}
+		}
+	}
+
+	network.recentlyRelayed.record(channel, line.Nick, text, ircLineTime(line))
+
+	bridge.relayMessageAsUser(line.Nick, bridge.render(templateName, data), coalesce, onDelivered)
+
+	return sendDM || digested != nil
+}
+
+// Private messages aren't bridged to any Slack channel, so they only reach the owner
+// when a highlight rule scoped to them says to mention or DM. If the owner is away,
+// the sender may get an auto-reply saying so.
+func (pino *Pino) handleIRCPrivateMessage(network *ircNetwork, line *irc.Line) {
+	pino.replyWhileAway(network, line.Nick)
+	pino.highlightIRCPrivateLine(network, line)
+}
+
+// Tells the owner about a private message or notice, if a highlight rule says to
+func (pino *Pino) highlightIRCPrivateLine(network *ircNetwork, line *irc.Line) {
+	text := line.Text()
+
+	rule := network.proxy.highlightRuleFor(network.proxy.highlightRules, &ircHighlightCandidate{
+		nick:     line.Nick,
+		usermask: line.Src,
+		account:  network.proxy.accountForLine(line),
+		text:     text,
+	})
+	if !rule.has(highlightActionMention) && !rule.has(highlightActionDM) {
+		return
+	}
+
+	data := &messageTemplateData{
+		Network:  network.name,
+		Nick:     line.Nick,
+		Usermask: line.Src,
+		Text:     formatIRCTextForSlack(text, formattingConvert),
+		Owner:    pino.slackProxy.ownerID,
+	}
+
+	if pino.shouldDigestHighlights() {
+		pino.digest.add(data)
+		return
+	}
+	pino.slackProxy.sendMessageToOwner(pino.templates.render("highlight-dm", data))
+}
+
+func (pino *Pino) shouldDigestHighlights() bool {
+	return !pino.config.Slack.DisableHighlightDigest && !pino.presence.isAvailable()
+}
+
+// When the owner comes back, they get one DM with everything that highlighted them while they were gone
+func (pino *Pino) handleOwnerAvailabilityChange(available bool) {
+	if !available {
+		return
+	}
+
+	highlights := pino.digest.take()
+	if len(highlights) == 0 {
+		return
+	}
+
+	lines := []string{pino.templates.render("highlight-digest", &messageTemplateData{})}
+	for i := range highlights {
+		network := pino.networksByName[highlights[i].Network]
+		lines = append(lines, pino.renderForIRCChannel(network, highlights[i].Channel, "highlight-digest-entry", &highlights[i]))
+	}
+
+	for _, message := range joinLinesIntoMessages(lines, maxDigestMessageLength) {
+		pino.slackProxy.sendMessageToOwner(message)
+	}
+}
+
+// Renders a template for the owner with the overrides of the channel's first bridge, if it has one
+func (pino *Pino) renderForIRCChannel(network *ircNetwork, channel IRCChannel, templateName string, data *messageTemplateData) string {
+	if bridges := network.bridgesForIRCChannel(channel); len(bridges) > 0 {
+		return bridges[0].renderForOwner(templateName, data)
+	}
+
+	return pino.templates.render(templateName, data)
+}
+
+// Consumes incoming events from a Slack workspace in a loop. Only the owner's own workspace
+// tells us whether they're around.
+func (pino *Pino) handleSlackEvents(workspace *slackProxy, quit chan bool) {
+	isOwner := func(userID string) bool {
+		return workspace == pino.slackProxy && userID == workspace.ownerID
+	}
+
 	for {
 		select {
-		case msg := <-pino.slackProxy.rtm.IncomingEvents:
+		case msg := <-workspace.rtm.IncomingEvents:
 			switch event := msg.Data.(type) {
 			case *slack.MessageEvent:
-				pino.handleSlackMessageEvent(event, quit)
+				pino.handleSlackMessageEvent(workspace, event, quit)
 			case *slack.ConnectingEvent:
 			case *slack.ConnectedEvent:
 			case *slack.HelloEvent:
-				fmt.Printf("Connected to Slack!\n")
+				fmt.Printf("Connected to %v!\n", describeWorkspace(workspace.name))
+			case *slack.UserChangeEvent:
+				workspace.updateUser(event.User)
+				if isOwner(event.User.ID) {
+					pino.presence.setStatusText(event.User.Profile.StatusText)
+				}
+			case *slack.TeamJoinEvent:
+				workspace.updateUser(event.User)
 			case *slack.UserTypingEvent:
+				pino.handleSlackTypingEvent(workspace, event)
 			case *slack.LatencyReport:
 			case *slack.PresenceChangeEvent:
+				if isOwner(event.User) {
+					pino.presence.setPresence(event.Presence)
+				}
+			case *slack.DNDUpdatedEvent:
+				if isOwner(event.User) {
+					status := event.Status
+					pino.presence.setDNDStatus(&status)
+				}
 			case *slack.ReconnectUrlEvent:
 			case *slack.AckMessage:
 			default:
@@ -276,15 +860,52 @@ func (pino *Pino) handleSlackEvents(quit chan bool) {
 	}
 }
 
-func (pino *Pino) handleSlackMessageEvent(event *slack.MessageEvent, quit chan bool) {
+// The bridge that relays a message in a Slack channel in the workspace to IRC. Even a Slack channel
+// with more than one IRC channel only has one of those, unless its bridges are Threaded, in which case
+// it's the one whose thread the message is a reply in.
+func (pino *Pino) bridgeToIRCForSlackMessage(workspace *slackProxy, channelID string, threadTimestamp string) (*bridge, bool) {
+	key := joinWorkspaceAndSlackChannel(workspace.name, workspace.getChannelName(channelID))
+	bridges := pino.bridgesBySlackChannel[key]
+
+	var threadKey string
+	if len(bridges) > 0 && bridges[0].threads != nil {
+		var ok bool
+		if threadKey, ok = pino.threads.bridgeKeyForThread(threadTimestamp); !ok {
+			return nil, false
+		}
+	}
+
+	for _, bridge := range bridges {
+		if bridge.relaysToIRC() && (threadKey == "" || bridge.threadKey() == threadKey) {
+			return bridge, true
+		}
+	}
+	return nil, false
+}
+
+func (pino *Pino) handleSlackMessageEvent(workspace *slackProxy, event *slack.MessageEvent, quit chan bool) {
 	// For development, we'll still want to print out all received messages
 	//fmt.Printf("Message: %#v\n", event)
 
-	slackChannel := pino.slackProxy.getChannelName(event.Channel)
-	destinationIRCChannel := pino.slackChannelToIRCChannel[slackChannel]
+	if workspace == pino.slackProxy && event.Channel == workspace.ownerIMChannelID {
+		// DMs from the owner are commands. Searching history can take a while, so don't hold up other events.
+		if event.User == workspace.ownerID && event.SubType == "" {
+			text := decodeSlackHTMLEntities(workspace.renderFormattedMessageForDisplay(event.Text))
+			go pino.handleOwnerCommand(text)
+		}
+		return
+	}
+
+	bridge, ok := pino.bridgeToIRCForSlackMessage(workspace, event.Channel, event.ThreadTimestamp)
+	if !ok {
+		return
+	}
+	network := bridge.network
+	destinationIRCChannel := bridge.ircChannel
 
 	if event.BotID != "" {
-		// Sending any messages from a bot to IRC might cause a vicious cycle
+		// Sending any messages from a bot to IRC might cause a vicious cycle. That includes
+		// our own posts in the other workspaces, so this also keeps fanned out messages from looping.
 		return
 	}
 
@@ -296,18 +917,86 @@ func (pino *Pino) handleSlackMessageEvent(event *slack.MessageEvent, quit chan b
 		return
 	}
 
-	text := pino.slackProxy.renderFormattedMessageForDisplay(event.Text)
+	text := workspace.renderFormattedMessageForDisplay(event.Text)
+	// Other Slack channels on the IRC channel see the message whether or not IRC does
+	pino.relaySlackMessageToOtherBridges(bridge, workspace.getUserName(event.User), text, event.SubType == "me_message")
 
 	text = decodeSlackHTMLEntities(text)
 
 	// Convert stuff like ":pizza:" to the actual pizza emoji
 	text = emoji.Sprint(text)
 
+	if !network.proxy.isConnected() {
+		network.deliveries.failImmediately(bridge, event.Channel, event.Timestamp, event.ThreadTimestamp, "IRC is disconnected")
+		return
+	}
+
+	data := &messageTemplateData{
+		Nick:    sanitizeIRCNick(workspace.getUserName(event.User)),
+		Channel: destinationIRCChannel,
+		Text:    text,
+	}
+
+	kind := chatLogMessage
+	var sentLines []string
 	if event.SubType == "me_message" {
-		pino.ircProxy.sendAction(destinationIRCChannel, text)
+		sentLines = network.proxy.sendAction(destinationIRCChannel, bridge.templates.renderLines("slack-action", data))
+		kind = chatLogAction
+	} else {
+		// In the normal case, it's a normal message
+		sentLines = network.proxy.sendMessage(destinationIRCChannel, bridge.templates.renderLines("slack-message", data))
+	}
+
+	for _, sentLine := range sentLines {
+		pino.chatLog.log(network, &chatLogEntry{Time: time.Now(), Channel: destinationIRCChannel, Kind: kind, Nick: network.proxy.currentNick(), Text: sentLine})
+	}
+	pino.messages.add(&storedMessage{time: time.Now(), source: storedMessageFromSlack, network: network.name, channel: destinationIRCChannel, nick: data.Nick, kind: kind, text: data.Text})
+
+	network.typing.slackMessageSent(destinationIRCChannel)
+	network.deliveries.track(bridge, event.Channel, event.Timestamp, event.ThreadTimestamp, sentLines, network.proxy.hasCapability("echo-message"))
+}
+
+// Posts a message from a Slack channel to the other Slack channels bridged with the same IRC channel,
+// as though it had come from IRC. The text is still in Slack's markup, which is what they want.
+func (pino *Pino) relaySlackMessageToOtherBridges(from *bridge, nick string, text string, isAction bool) {
+	templateName := "message"
+	if isAction {
+		templateName = "action"
+	}
+
+	for _, bridge := range from.network.bridgesToSlack(from.ircChannel) {
+		if bridge == from {
+			continue
+		}
+
+		data := &messageTemplateData{
+			Network: from.network.name,
+			Nick:    nick,
+			Channel: from.ircChannel,
+			Text:    text,
+			Owner:   bridge.slack.ownerID,
+		}
+		bridge.sendMessageAsUser(nick, bridge.render(templateName, data))
+	}
+}
+
+func (pino *Pino) handleSlackTypingEvent(workspace *slackProxy, event *slack.UserTypingEvent) {
+	// Typing events don't say which thread they're in, so they can't go to a Threaded bridge
+	bridge, ok := pino.bridgeToIRCForSlackMessage(workspace, event.Channel, "")
+	if !ok || bridge.network.config.DisableTypingIndicators {
 		return
 	}
 
-	// In the normal case, it's a normal message
-	pino.ircProxy.sendMessage(destinationIRCChannel, text)
+	bridge.network.typing.slackUserTyping(bridge.ircChannel)
+}
+
+// The name of a state file for a network or workspace. The unnamed one keeps the name it had before
+// there could be more than one, like "irc-seen.json", and others get theirs added, like "irc-seen-rizon.json".
+func namedStateFilename(filename string, name string) string {
+	if name == "" {
+		return filename
+	}
+
+	extension := filepath.Ext(filename)
+	return fmt.Sprintf("%v-%v%v", strings.TrimSuffix(filename, extension), name, extension)
 }
@@ -0,0 +1,139 @@
+package pino
+
+import (
+	"testing"
+	"time"
+
+	slack "github.com/nlopes/slack"
+)
+
+// A workspace that posts to the fake API, with Slack channels by name and ID
+func newTestSlackProxy(t *testing.T, name string, api slackMessageAPI, channels map[SlackChannel]string) *slackProxy {
+	proxy := &slackProxy{
+		name:            name,
+		dispatcher:      newTestSlackDispatcher(t, api, 10),
+		channelNameToID: make(map[SlackChannel]string),
+		channelIDToName: make(map[string]SlackChannel),
+		userIDToName:    map[string]string{"U1": "alice"},
+	}
+	for channelName, channelID := range channels {
+		proxy.channelNameToID[channelName] = channelID
+		proxy.channelIDToName[channelID] = channelName
+	}
+	return proxy
+}
+
+func newTestIRCNetwork(name string) *ircNetwork {
+	return &ircNetwork{
+		name:                name,
+		proxy:               &ircProxy{nick: "pino"},
+		bridgesByIRCChannel: make(map[IRCChannel][]*bridge),
+	}
+}
+
+// Bridges the Slack channel in the workspace with the IRC channel, the way NewPino does
+func addTestBridge(t *testing.T, pino *Pino, workspace *slackProxy, slackChannel SlackChannel, network *ircNetwork, config *BridgeConfig) *bridge {
+	bridge, err := newBridge(workspace, slackChannel, network, config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Threaded {
+		bridge.threads = pino.threads
+	}
+
+	key := joinWorkspaceAndSlackChannel(workspace.name, slackChannel)
+	pino.bridgesBySlackChannel[key] = append(pino.bridgesBySlackChannel[key], bridge)
+	network.addBridge(bridge)
+	return bridge
+}
+
+func TestBridgeToIRCForSlackMessage(t *testing.T) {
+	pino := &Pino{
+		bridgesBySlackChannel: make(map[SlackChannel][]*bridge),
+		threads:               newSlackThreadTracker(""),
+	}
+	workspace := newTestSlackProxy(t, "", newFakeSlackMessageAPI(), map[SlackChannel]string{"#irc": "C1", "#solo": "C2", "#readonly": "C3"})
+	network := newTestIRCNetwork("")
+
+	// Threaded bridges share a Slack channel, and replies go to whichever IRC channel the thread is for
+	a := addTestBridge(t, pino, workspace, "#irc", network, &BridgeConfig{IRCChannel: "#a", Threaded: true})
+	b := addTestBridge(t, pino, workspace, "#irc", network, &BridgeConfig{IRCChannel: "#b", Threaded: true})
+	solo := addTestBridge(t, pino, workspace, "#solo", network, &BridgeConfig{IRCChannel: "#c"})
+	addTestBridge(t, pino, workspace, "#readonly", network, &BridgeConfig{IRCChannel: "#d", Direction: bridgeDirectionIRCToSlack})
+
+	now := time.Now()
+	pino.threads.threads["1.000"] = &slackThread{Bridge: a.threadKey(), Day: now.Format("2006-01-02"), Timestamp: "1.000", Started: now}
+	// Replies in the last week's threads still reach IRC
+	pino.threads.threads["2.000"] = &slackThread{Bridge: b.threadKey(), Day: now.AddDate(0, 0, -3).Format("2006-01-02"), Timestamp: "2.000", Started: now.AddDate(0, 0, -3)}
+
+	tests := []struct {
+		channelID       string
+		threadTimestamp string
+		expected        *bridge
+	}{
+		{"C1", "1.000", a},
+		{"C1", "2.000", b},
+		// A threaded channel's top level doesn't belong to any one IRC channel
+		{"C1", "", nil},
+		{"C1", "9.000", nil},
+		{"C2", "", solo},
+		// Threads in a channel that isn't Threaded are just conversations
+		{"C2", "9.000", solo},
+		{"C3", "", nil},
+		{"C4", "", nil},
+	}
+
+	for _, test := range tests {
+		bridge, ok := pino.bridgeToIRCForSlackMessage(workspace, test.channelID, test.threadTimestamp)
+		if bridge != test.expected || ok != (test.expected != nil) {
+			t.Errorf("bridgeToIRCForSlackMessage(%v, %q) = %v, %v, expected %v", test.channelID, test.threadTimestamp, bridge, ok, test.expected)
+		}
+	}
+}
+
+// Two workspaces and a third that only sends to IRC, all bridged with the same IRC channel
+func newTestFanOut(t *testing.T) (*Pino, map[string]*fakeSlackMessageAPI, *bridge) {
+	pino := &Pino{bridgesBySlackChannel: make(map[SlackChannel][]*bridge)}
+	network := newTestIRCNetwork("")
+	apis := map[string]*fakeSlackMessageAPI{"": newFakeSlackMessageAPI(), "partner": newFakeSlackMessageAPI(), "quiet": newFakeSlackMessageAPI()}
+
+	own := newTestSlackProxy(t, "", apis[""], map[SlackChannel]string{"#go": "C1"})
+	own.ownerIMChannelID = "D1"
+	pino.slackProxy = own
+	partner := newTestSlackProxy(t, "partner", apis["partner"], map[SlackChannel]string{"#go-partner": "C2"})
+	quiet := newTestSlackProxy(t, "quiet", apis["quiet"], map[SlackChannel]string{"#go-quiet": "C3"})
+
+	from := addTestBridge(t, pino, own, "#go", network, &BridgeConfig{IRCChannel: "#go"})
+	addTestBridge(t, pino, partner, "#go-partner", network, &BridgeConfig{IRCChannel: "#go"})
+	addTestBridge(t, pino, quiet, "#go-quiet", network, &BridgeConfig{IRCChannel: "#go", Direction: bridgeDirectionSlackToIRC})
+
+	return pino, apis, from
+}
+
+func TestRelaySlackMessageToOtherBridges(t *testing.T) {
+	pino, apis, from := newTestFanOut(t)
+
+	pino.relaySlackMessageToOtherBridges(from, "alice", "hi", false)
+
+	expectSlackPosts(t, waitForSlackPosts(t, apis["partner"], 1), []string{"hi"})
+	expectSlackPosts(t, apis["partner"].postedDestinations(), []string{"C2"})
+	// Not back where it came from, and not to a bridge that doesn't relay to Slack
+	time.Sleep(50 * time.Millisecond)
+	expectSlackPosts(t, apis[""].postedMessages(), nil)
+	expectSlackPosts(t, apis["quiet"].postedMessages(), nil)
+}
+
+func TestHandleSlackMessageEventIgnoresBots(t *testing.T) {
+	pino, apis, _ := newTestFanOut(t)
+
+	// Our own fanned out posts come back to us as bot messages, which mustn't be relayed again
+	event := &slack.MessageEvent{Msg: slack.Msg{Channel: "C1", User: "U1", Text: "hi", Timestamp: "1.000", BotID: "B1"}}
+	pino.handleSlackMessageEvent(pino.slackProxy, event, nil)
+
+	time.Sleep(50 * time.Millisecond)
+	for name, api := range apis {
+		if posted := api.postedMessages(); len(posted) != 0 {
+			t.Errorf("Expected nothing to be posted in workspace %q, got %v", name, posted)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package pino
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+// What a bridge does with the lines of a ZNC buffer playback
+const (
+	// Don't relay them at all
+	playbackModeDrop = "drop"
+	// Collect them into a single Slack thread once playback ends
+	playbackModeThread = "thread"
+	// Relay them as they arrive, labelled with when they were originally sent
+	playbackModeInline = "inline"
+)
+
+// How many recently relayed messages per channel we remember, to recognize them in a playback
+const maxRecentlyRelayedMessages = 500
+
+// ZNC prefixes played back lines with when they were sent, unless it can use server-time instead
+var zncTimestampPrefix = regexp.MustCompile(`^\[(\d{2}):(\d{2}):(\d{2})\] `)
+
+// A line from a ZNC buffer playback, with ZNC's timestamp taken out
+type playbackLine struct {
+	line   *irc.Line
+	text   string
+	sentAt time.Time
+}
+
+// Tracks whether a channel is in the middle of a ZNC buffer playback
+type bufferPlaybackState struct {
+	isActive bool
+	// The lines collected so far, for bridges that relay playback into a thread
+	lines []*playbackLine
+}
+
+func isBufferPlaybackStartLine(line *irc.Line) bool {
+	if line.Cmd != irc.PRIVMSG {
+		return false
+	}
+
+	if line.Nick != "***" {
+		return false
+	}
+
+	return line.Text() == "Buffer Playback..."
+}
+
+func isBufferPlaybackEndLine(line *irc.Line) bool {
+	if line.Cmd != irc.PRIVMSG {
+		return false
+	}
+
+	if line.Nick != "***" {
+		return false
+	}
+
+	return line.Text() == "Playback Complete."
+}
+
+// Takes ZNC's timestamp off a played back line, and works out when it was sent.
+// The server-time tag is used if there is one. Otherwise the "[HH:MM:SS]" prefix is taken
+// to be in our timezone and within the last day.
+func parsePlaybackLine(line *irc.Line, now time.Time) *playbackLine {
+	text := line.Text()
+	sentAt := ircLineTime(line)
+	_, hasServerTime := line.Tags["time"]
+
+	if match := zncTimestampPrefix.FindStringSubmatch(text); match != nil {
+		text = text[len(match[0]):]
+
+		if !hasServerTime {
+			hour, _ := strconv.Atoi(match[1])
+			minute, _ := strconv.Atoi(match[2])
+			second, _ := strconv.Atoi(match[3])
+
+			sentAt = time.Date(now.Year(), now.Month(), now.Day(), hour, minute, second, 0, now.Location())
+			if sentAt.After(now) {
+				sentAt = sentAt.AddDate(0, 0, -1)
+			}
+		}
+	}
+
+	return &playbackLine{line: line, text: text, sentAt: sentAt}
+}
+
+// The recentlyRelayedMessages remembers the last few messages relayed from each IRC channel,
+// so that a buffer playback doesn't post them to Slack a second time. Messages are told apart by
+// who sent them, what they said, and when, to the second, since that's all a ZNC timestamp has.
+// Someone saying the same thing again later is a new message.
+type recentlyRelayedMessages struct {
+	mutex    sync.Mutex
+	messages map[IRCChannel][]string
+}
+
+func newRecentlyRelayedMessages() *recentlyRelayedMessages {
+	return &recentlyRelayedMessages{messages: make(map[IRCChannel][]string)}
+}
+
+func recentlyRelayedKey(nick string, text string, sentAt time.Time) string {
+	return fmt.Sprintf("%v %v %v", sentAt.Unix(), strings.ToLower(nick), text)
+}
+
+func (recent *recentlyRelayedMessages) record(channel IRCChannel, nick string, text string, sentAt time.Time) {
+	key := ircChannelKey(channel)
+
+	recent.mutex.Lock()
+	defer recent.mutex.Unlock()
+
+	messages := append(recent.messages[key], recentlyRelayedKey(nick, text, sentAt))
+	if len(messages) > maxRecentlyRelayedMessages {
+		messages = messages[len(messages)-maxRecentlyRelayedMessages:]
+	}
+	recent.messages[key] = messages
+}
+
+func (recent *recentlyRelayedMessages) contains(channel IRCChannel, nick string, text string, sentAt time.Time) bool {
+	key := recentlyRelayedKey(nick, text, sentAt)
+
+	recent.mutex.Lock()
+	defer recent.mutex.Unlock()
+
+	for _, message := range recent.messages[ircChannelKey(channel)] {
+		if message == key {
+			return true
+		}
+	}
+
+	return false
+}
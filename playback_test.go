@@ -0,0 +1,77 @@
+package pino
+
+import (
+	"testing"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+func TestParsePlaybackLine(t *testing.T) {
+	now := time.Date(2016, 10, 18, 12, 0, 0, 0, time.Local)
+	received := now.Add(-time.Second)
+
+	tests := []struct {
+		line   *irc.Line
+		text   string
+		sentAt time.Time
+	}{
+		{
+			&irc.Line{Cmd: irc.PRIVMSG, Args: []string{"#chat", "[11:58:30] hello"}, Time: received},
+			"hello",
+			time.Date(2016, 10, 18, 11, 58, 30, 0, time.Local),
+		},
+		{
+			// Later in the day than now, so it was yesterday
+			&irc.Line{Cmd: irc.PRIVMSG, Args: []string{"#chat", "[23:15:00] late"}, Time: received},
+			"late",
+			time.Date(2016, 10, 17, 23, 15, 0, 0, time.Local),
+		},
+		{
+			&irc.Line{Cmd: irc.PRIVMSG, Args: []string{"#chat", "[11:58:30] tagged"}, Time: received, Tags: map[string]string{"time": "2016-10-18T10:58:31.000Z"}},
+			"tagged",
+			time.Date(2016, 10, 18, 10, 58, 31, 0, time.UTC),
+		},
+		{
+			&irc.Line{Cmd: irc.PRIVMSG, Args: []string{"#chat", "no timestamp"}, Time: received},
+			"no timestamp",
+			received,
+		},
+	}
+
+	for _, test := range tests {
+		played := parsePlaybackLine(test.line, now)
+		if played.text != test.text || !played.sentAt.Equal(test.sentAt) {
+			t.Errorf("parsePlaybackLine(%q) = %q at %v, expected %q at %v", test.line.Args[1], played.text, played.sentAt, test.text, test.sentAt)
+		}
+	}
+}
+
+func TestRecentlyRelayedMessages(t *testing.T) {
+	recent := newRecentlyRelayedMessages()
+	sentAt := time.Date(2016, 10, 18, 12, 0, 5, 400000000, time.UTC)
+	recent.record("#Chat", "Alice", "hi", sentAt)
+
+	tests := []struct {
+		channel  IRCChannel
+		nick     string
+		text     string
+		sentAt   time.Time
+		expected bool
+	}{
+		// ZNC's timestamp for the same line only has the second
+		{"#chat", "alice", "hi", sentAt.Truncate(time.Second), true},
+		{"#chat", "alice", "hi", sentAt, true},
+		// Saying it again later is a new message
+		{"#chat", "alice", "hi", sentAt.Add(time.Minute), false},
+		{"#chat", "bob", "hi", sentAt, false},
+		{"#chat", "alice", "hello", sentAt, false},
+		{"#other", "alice", "hi", sentAt, false},
+	}
+
+	for _, test := range tests {
+		if contains := recent.contains(test.channel, test.nick, test.text, test.sentAt); contains != test.expected {
+			t.Errorf("contains(%v, %v, %q, %v) = %v, expected %v", test.channel, test.nick, test.text, test.sentAt, contains, test.expected)
+		}
+	}
+}
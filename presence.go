@@ -0,0 +1,176 @@
+package pino
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	slack "github.com/nlopes/slack"
+)
+
+const (
+	// How often to re-check whether a Do Not Disturb schedule has started or ended
+	ownerPresenceCheckInterval = time.Minute
+	// How often to ask Slack for the owner's presence, in case we missed an event
+	ownerPresencePollInterval = 5 * time.Minute
+)
+
+// The ownerPresenceTracker follows whether the owner is around on Slack,
+// from presence, DND, and profile events plus a periodic check with the Slack API.
+type ownerPresenceTracker struct {
+	proxy *slackProxy
+	// Called whenever the owner becomes available or unavailable
+	onAvailabilityChange func(available bool)
+	// Called whenever the owner's presence or status text changes
+	onStatusChange func()
+
+	mutex      sync.Mutex
+	isActive   bool
+	dndStatus  *slack.DNDStatus
+	statusText string
+	// What we last told onAvailabilityChange
+	wasAvailable bool
+}
+
+func newOwnerPresenceTracker(proxy *slackProxy, onAvailabilityChange func(available bool), onStatusChange func()) *ownerPresenceTracker {
+	// Until we hear otherwise, assume the owner is watching
+	return &ownerPresenceTracker{
+		proxy:                proxy,
+		onAvailabilityChange: onAvailabilityChange,
+		onStatusChange:       onStatusChange,
+		isActive:             true,
+		wasAvailable:         true,
+	}
+}
+
+// Fetches the owner's current presence and keeps checking it in the background.
+// Must be called after the Slack proxy has connected.
+func (tracker *ownerPresenceTracker) start() {
+	owner, err := tracker.proxy.client.GetUserInfo(tracker.proxy.ownerID)
+	if err != nil {
+		fmt.Printf("Could not get the owner's Slack status: %v\n", err)
+	} else {
+		tracker.setStatusText(owner.Profile.StatusText)
+	}
+
+	tracker.poll()
+
+	go func() {
+		checkTicker := time.NewTicker(ownerPresenceCheckInterval)
+		pollTicker := time.NewTicker(ownerPresencePollInterval)
+		for {
+			select {
+			case <-checkTicker.C:
+				tracker.update()
+			case <-pollTicker.C:
+				tracker.poll()
+			}
+		}
+	}()
+}
+
+func (tracker *ownerPresenceTracker) poll() {
+	ownerID := tracker.proxy.ownerID
+
+	presence, err := tracker.proxy.client.GetUserPresence(ownerID)
+	if err != nil {
+		fmt.Printf("Could not get the owner's Slack presence: %v\n", err)
+	} else {
+		tracker.setPresence(presence.Presence)
+	}
+
+	dndStatus, err := tracker.proxy.client.GetDNDInfo(&ownerID)
+	if err != nil {
+		fmt.Printf("Could not get the owner's Slack DND status: %v\n", err)
+	} else {
+		tracker.setDNDStatus(dndStatus)
+	}
+}
+
+// Records the owner's Slack presence, which is either "active" or "away"
+func (tracker *ownerPresenceTracker) setPresence(presence string) {
+	isActive := presence == "active"
+
+	tracker.mutex.Lock()
+	changed := isActive != tracker.isActive
+	tracker.isActive = isActive
+	tracker.mutex.Unlock()
+
+	if changed {
+		tracker.onStatusChange()
+	}
+	tracker.update()
+}
+
+// Records the status text from the owner's Slack profile, like "Out to lunch"
+func (tracker *ownerPresenceTracker) setStatusText(text string) {
+	tracker.mutex.Lock()
+	changed := text != tracker.statusText
+	tracker.statusText = text
+	tracker.mutex.Unlock()
+
+	if changed {
+		tracker.onStatusChange()
+	}
+}
+
+func (tracker *ownerPresenceTracker) setDNDStatus(status *slack.DNDStatus) {
+	tracker.mutex.Lock()
+	tracker.dndStatus = status
+	tracker.mutex.Unlock()
+
+	tracker.update()
+}
+
+// Whether Slack says the owner is active, regardless of Do Not Disturb
+func (tracker *ownerPresenceTracker) isOwnerActive() bool {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	return tracker.isActive
+}
+
+func (tracker *ownerPresenceTracker) getStatusText() string {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	return tracker.statusText
+}
+
+// Whether the owner is active on Slack and not in Do Not Disturb
+func (tracker *ownerPresenceTracker) isAvailable() bool {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	return tracker.isActive && !isDNDActive(tracker.dndStatus, time.Now())
+}
+
+// Tells onAvailabilityChange if the owner's availability has changed since we last told it
+func (tracker *ownerPresenceTracker) update() {
+	tracker.mutex.Lock()
+	available := tracker.isActive && !isDNDActive(tracker.dndStatus, time.Now())
+	changed := available != tracker.wasAvailable
+	tracker.wasAvailable = available
+	tracker.mutex.Unlock()
+
+	if changed {
+		fmt.Printf("Owner is now available on Slack: %v\n", available)
+		tracker.onAvailabilityChange(available)
+	}
+}
+
+// Whether Do Not Disturb is on, either because the owner snoozed notifications or
+// because we're inside their scheduled DND hours
+func isDNDActive(status *slack.DNDStatus, now time.Time) bool {
+	if status == nil {
+		return false
+	}
+
+	if status.SnoozeEnabled && now.Unix() < int64(status.SnoozeEndTime) {
+		return true
+	}
+
+	return status.Enabled &&
+		int64(status.NextStartTimestamp) <= now.Unix() &&
+		now.Unix() < int64(status.NextEndTimestamp)
+}
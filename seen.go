@@ -0,0 +1,352 @@
+package pino
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ircSeenFilename = "irc-seen.json"
+	// How often the seen records are written to disk, if they've changed
+	ircSeenSaveInterval = 30 * time.Second
+	// How many hostmasks and nick changes we remember for each nick
+	maxSeenHistory = 10
+	// How many nicks we remember. Past this, whoever was seen least recently is forgotten.
+	maxSeenRecords = 10000
+	// How often one nick can ask "!seen", and how often it's answered in any one channel
+	seenCommandNickInterval    = 30 * time.Second
+	seenCommandChannelInterval = 10 * time.Second
+)
+
+// Something a nick did, and when
+type seenEvent struct {
+	Time    time.Time  `json:"time"`
+	Channel IRCChannel `json:"channel,omitempty"`
+	// The message, or the part or quit reason
+	Text string `json:"text,omitempty"`
+}
+
+type seenNickChange struct {
+	Time    time.Time `json:"time"`
+	OldNick string    `json:"old_nick"`
+	NewNick string    `json:"new_nick"`
+}
+
+// Everything we remember about a nick
+type seenRecord struct {
+	// The nick as it was last written
+	Nick        string           `json:"nick"`
+	LastMessage *seenEvent       `json:"last_message,omitempty"`
+	LastJoin    *seenEvent       `json:"last_join,omitempty"`
+	LastPart    *seenEvent       `json:"last_part,omitempty"`
+	LastQuit    *seenEvent       `json:"last_quit,omitempty"`
+	Hostmasks   []string         `json:"hostmasks,omitempty"`
+	NickChanges []seenNickChange `json:"nick_changes,omitempty"`
+}
+
+// The seenTracker remembers the last thing each nick did in our channels, across restarts,
+// so that "seen nick" still has an answer long after they've left.
+type seenTracker struct {
+	mutex sync.Mutex
+	// Keyed by lowercased nick
+	records map[string]*seenRecord
+	state   *jsonStateFile
+}
+
+func newSeenTracker(stateDirectory string, filename string) *seenTracker {
+	tracker := &seenTracker{records: make(map[string]*seenRecord)}
+	tracker.state = newJSONStateFile(stateDirectory, filename, "IRC seen records", &tracker.mutex, func() interface{} {
+		return tracker.records
+	})
+
+	tracker.state.load(&tracker.records)
+	tracker.state.saveRegularly(ircSeenSaveInterval)
+
+	return tracker
+}
+
+// Gets the record for a nick, creating it if needed. The caller must hold the mutex.
+func (tracker *seenTracker) recordFor(nick string, usermask string) *seenRecord {
+	key := strings.ToLower(nick)
+	record, ok := tracker.records[key]
+	if !ok {
+		if len(tracker.records) >= maxSeenRecords {
+			tracker.forgetLeastRecentlySeen()
+		}
+		record = &seenRecord{}
+		tracker.records[key] = record
+	}
+	record.Nick = nick
+
+	if usermask != "" {
+		// Keep the most recently used hostmask last
+		for i, hostmask := range record.Hostmasks {
+			if hostmask == usermask {
+				record.Hostmasks = append(record.Hostmasks[:i], record.Hostmasks[i+1:]...)
+				break
+			}
+		}
+		record.Hostmasks = append(record.Hostmasks, usermask)
+		if len(record.Hostmasks) > maxSeenHistory {
+			record.Hostmasks = record.Hostmasks[len(record.Hostmasks)-maxSeenHistory:]
+		}
+	}
+
+	tracker.state.changed()
+	return record
+}
+
+// Makes room for another nick. The caller must hold the mutex.
+func (tracker *seenTracker) forgetLeastRecentlySeen() {
+	var oldestKey string
+	var oldest time.Time
+	for key, record := range tracker.records {
+		if lastSeen := record.lastSeen(); oldestKey == "" || lastSeen.Before(oldest) {
+			oldestKey = key
+			oldest = lastSeen
+		}
+	}
+	delete(tracker.records, oldestKey)
+}
+
+func (tracker *seenTracker) messageSent(channel IRCChannel, nick string, usermask string, text string, t time.Time) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.recordFor(nick, usermask).LastMessage = &seenEvent{Time: t, Channel: channel, Text: text}
+}
+
+func (tracker *seenTracker) joined(channel IRCChannel, nick string, usermask string, t time.Time) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.recordFor(nick, usermask).LastJoin = &seenEvent{Time: t, Channel: channel}
+}
+
+func (tracker *seenTracker) parted(channel IRCChannel, nick string, usermask string, reason string, t time.Time) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.recordFor(nick, usermask).LastPart = &seenEvent{Time: t, Channel: channel, Text: reason}
+}
+
+// A quit isn't about any one channel, even though the intake hands it to us once per channel
+func (tracker *seenTracker) quit(nick string, usermask string, reason string, t time.Time) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.recordFor(nick, usermask).LastQuit = &seenEvent{Time: t, Text: reason}
+}
+
+// Records a nick change under both nicks, so either one can be looked up
+func (tracker *seenTracker) changedNick(oldNick string, newNick string, usermask string, t time.Time) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	change := seenNickChange{Time: t, OldNick: oldNick, NewNick: newNick}
+	oldRecord := tracker.records[strings.ToLower(oldNick)]
+	newRecord := tracker.recordFor(newNick, usermask)
+
+	records := []*seenRecord{newRecord}
+	if oldRecord != nil && oldRecord != newRecord {
+		records = append(records, oldRecord)
+	}
+
+	for _, record := range records {
+		// The intake delivers a NICK once for every channel the user was in
+		if n := len(record.NickChanges); n > 0 {
+			last := record.NickChanges[n-1]
+			if last.OldNick == oldNick && last.NewNick == newNick && last.Time.Equal(t) {
+				continue
+			}
+		}
+
+		record.NickChanges = append(record.NickChanges, change)
+		if len(record.NickChanges) > maxSeenHistory {
+			record.NickChanges = record.NickChanges[len(record.NickChanges)-maxSeenHistory:]
+		}
+	}
+}
+
+// Returns a copy of what we know about the nick, or nil if we've never seen them
+func (tracker *seenTracker) lookup(nick string) *seenRecord {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	record, ok := tracker.records[strings.ToLower(nick)]
+	if !ok {
+		return nil
+	}
+
+	copied := *record
+	copied.Hostmasks = append([]string(nil), record.Hostmasks...)
+	copied.NickChanges = append([]seenNickChange(nil), record.NickChanges...)
+	return &copied
+}
+
+// When the nick last did anything we know about
+func (record *seenRecord) lastSeen() time.Time {
+	var lastSeen time.Time
+	for _, event := range []*seenEvent{record.LastMessage, record.LastJoin, record.LastPart, record.LastQuit} {
+		if event != nil && event.Time.After(lastSeen) {
+			lastSeen = event.Time
+		}
+	}
+	if n := len(record.NickChanges); n > 0 && record.NickChanges[n-1].Time.After(lastSeen) {
+		lastSeen = record.NickChanges[n-1].Time
+	}
+	return lastSeen
+}
+
+// One line about the last thing the nick did, like "alice was last seen 3h ago in #go, saying: hi"
+func (record *seenRecord) summary(now time.Time) string {
+	type activity struct {
+		event       *seenEvent
+		description string
+	}
+
+	var latest *activity
+	consider := func(event *seenEvent, description string) {
+		if event != nil && (latest == nil || event.Time.After(latest.event.Time)) {
+			latest = &activity{event: event, description: description}
+		}
+	}
+
+	if record.LastMessage != nil {
+		consider(record.LastMessage, fmt.Sprintf("in %v, saying: %v", record.LastMessage.Channel, record.LastMessage.Text))
+	}
+	if record.LastJoin != nil {
+		consider(record.LastJoin, fmt.Sprintf("joining %v", record.LastJoin.Channel))
+	}
+	if record.LastPart != nil {
+		consider(record.LastPart, fmt.Sprintf("leaving %v%v", record.LastPart.Channel, formatSeenReason(record.LastPart.Text)))
+	}
+	if record.LastQuit != nil {
+		consider(record.LastQuit, fmt.Sprintf("quitting%v", formatSeenReason(record.LastQuit.Text)))
+	}
+
+	if n := len(record.NickChanges); n > 0 {
+		change := record.NickChanges[n-1]
+		if latest == nil || change.Time.After(latest.event.Time) {
+			return fmt.Sprintf("%v was last seen %v changing nick from %v to %v", record.Nick, formatSeenAgo(now.Sub(change.Time)), change.OldNick, change.NewNick)
+		}
+	}
+
+	if latest == nil {
+		return fmt.Sprintf("%v has been seen, but not doing anything", record.Nick)
+	}
+	return fmt.Sprintf("%v was last seen %v %v", record.Nick, formatSeenAgo(now.Sub(latest.event.Time)), latest.description)
+}
+
+// Everything we know about the nick, one thing per line
+func (record *seenRecord) details(now time.Time) []string {
+	lines := []string{record.summary(now)}
+
+	describe := func(label string, event *seenEvent, text string) {
+		if event == nil {
+			return
+		}
+		line := fmt.Sprintf("%v: %v", label, formatSeenTime(event.Time, now))
+		if event.Channel != "" {
+			line += " in " + string(event.Channel)
+		}
+		lines = append(lines, line+text)
+	}
+
+	if record.LastMessage != nil {
+		describe("Last message", record.LastMessage, ": "+record.LastMessage.Text)
+	}
+	describe("Last join", record.LastJoin, "")
+	if record.LastPart != nil {
+		describe("Last part", record.LastPart, formatSeenReason(record.LastPart.Text))
+	}
+	if record.LastQuit != nil {
+		describe("Last quit", record.LastQuit, formatSeenReason(record.LastQuit.Text))
+	}
+
+	if len(record.Hostmasks) > 0 {
+		lines = append(lines, "Hostmasks: "+strings.Join(record.Hostmasks, ", "))
+	}
+	for _, change := range record.NickChanges {
+		lines = append(lines, fmt.Sprintf("Nick change: %v, %v → %v", formatSeenTime(change.Time, now), change.OldNick, change.NewNick))
+	}
+
+	return lines
+}
+
+func formatSeenReason(reason string) string {
+	if reason == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (%v)", reason)
+}
+
+func formatSeenTime(t time.Time, now time.Time) string {
+	return fmt.Sprintf("%v (%v)", t.Local().Format("2006-01-02 15:04:05"), formatSeenAgo(now.Sub(t)))
+}
+
+// Like "just now", "5m ago", "3h ago", or "12d ago"
+func formatSeenAgo(duration time.Duration) string {
+	switch {
+	case duration < time.Minute:
+		return "just now"
+	case duration < time.Hour:
+		return fmt.Sprintf("%vm ago", int(duration/time.Minute))
+	case duration < 48*time.Hour:
+		return fmt.Sprintf("%vh ago", int(duration/time.Hour))
+	}
+	return fmt.Sprintf("%vd ago", int(duration/(24*time.Hour)))
+}
+
+// The seenCommandLimiter keeps "!seen" from being used to flood a channel, or to make us flood
+// the server, by answering each nick and each channel at most once per interval.
+type seenCommandLimiter struct {
+	mutex sync.Mutex
+	// When we last answered each lowercased nick and channel
+	lastNick    map[string]time.Time
+	lastChannel map[string]time.Time
+}
+
+func newSeenCommandLimiter() *seenCommandLimiter {
+	return &seenCommandLimiter{
+		lastNick:    make(map[string]time.Time),
+		lastChannel: make(map[string]time.Time),
+	}
+}
+
+// Whether the nick's "!seen" in the channel (or a private message, if the channel is empty)
+// should be answered. If so, it counts against both of them.
+func (limiter *seenCommandLimiter) allow(channel IRCChannel, nick string, now time.Time) bool {
+	nickKey := strings.ToLower(nick)
+	channelKey := strings.ToLower(string(channel))
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	if last, ok := limiter.lastNick[nickKey]; ok && now.Sub(last) < seenCommandNickInterval {
+		return false
+	}
+	if last, ok := limiter.lastChannel[channelKey]; ok && channel != "" && now.Sub(last) < seenCommandChannelInterval {
+		return false
+	}
+
+	// Nobody who asked long enough ago needs remembering
+	for key, last := range limiter.lastNick {
+		if now.Sub(last) >= seenCommandNickInterval {
+			delete(limiter.lastNick, key)
+		}
+	}
+	for key, last := range limiter.lastChannel {
+		if now.Sub(last) >= seenCommandChannelInterval {
+			delete(limiter.lastChannel, key)
+		}
+	}
+
+	limiter.lastNick[nickKey] = now
+	if channel != "" {
+		limiter.lastChannel[channelKey] = now
+	}
+	return true
+}
@@ -0,0 +1,141 @@
+package pino
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSeenTrackerChangedNickOnce(t *testing.T) {
+	tracker := newSeenTracker("", ircSeenFilename)
+	now := time.Date(2016, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	tracker.messageSent("#go", "alice", "alice!a@example.com", "hi", now)
+	// The intake hands us the NICK once for each channel alice is in
+	tracker.changedNick("alice", "alice_", "alice!a@example.com", now.Add(time.Minute))
+	tracker.changedNick("alice", "alice_", "alice!a@example.com", now.Add(time.Minute))
+	// A later change back is a change of its own
+	tracker.changedNick("alice_", "alice", "alice_!a@example.com", now.Add(2*time.Minute))
+
+	for _, nick := range []string{"alice", "ALICE_"} {
+		record := tracker.lookup(nick)
+		if record == nil {
+			t.Fatalf("Expected a record for %v", nick)
+		}
+		if len(record.NickChanges) != 2 {
+			t.Errorf("Expected two nick changes for %v, got %+v", nick, record.NickChanges)
+		}
+	}
+
+	record := tracker.lookup("alice")
+	if len(record.Hostmasks) != 2 || record.Hostmasks[1] != "alice_!a@example.com" {
+		t.Errorf("Expected the most recent hostmask last, got %v", record.Hostmasks)
+	}
+	if tracker.lookup("bob") != nil {
+		t.Error("Expected no record for bob")
+	}
+}
+
+func TestSeenTrackerForgetsLeastRecentlySeen(t *testing.T) {
+	tracker := newSeenTracker("", ircSeenFilename)
+	now := time.Date(2016, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	tracker.messageSent("#go", "old", "", "hi", now.Add(-time.Hour))
+	for i := 1; i < maxSeenRecords; i++ {
+		tracker.joined("#go", fmt.Sprintf("nick%v", i), "", now)
+	}
+	// Seeing old again keeps it around
+	tracker.joined("#go", "old", "", now.Add(time.Minute))
+	tracker.joined("#go", "new", "", now.Add(time.Minute))
+
+	if len(tracker.records) != maxSeenRecords {
+		t.Errorf("Expected %v records, got %v", maxSeenRecords, len(tracker.records))
+	}
+	if tracker.lookup("old") == nil || tracker.lookup("new") == nil {
+		t.Error("Expected the most recently seen nicks to be kept")
+	}
+}
+
+func TestSeenRecordSummary(t *testing.T) {
+	now := time.Date(2016, 10, 18, 12, 0, 0, 0, time.UTC)
+	at := func(ago time.Duration) time.Time { return now.Add(-ago) }
+
+	tests := []struct {
+		record   *seenRecord
+		expected string
+	}{
+		{
+			&seenRecord{Nick: "alice"},
+			"alice has been seen, but not doing anything",
+		},
+		{
+			&seenRecord{
+				Nick:        "alice",
+				LastMessage: &seenEvent{Time: at(3 * time.Hour), Channel: "#go", Text: "hi"},
+				LastJoin:    &seenEvent{Time: at(5 * time.Hour), Channel: "#go"},
+			},
+			"alice was last seen 3h ago in #go, saying: hi",
+		},
+		{
+			&seenRecord{
+				Nick:        "alice",
+				LastMessage: &seenEvent{Time: at(3 * time.Hour), Channel: "#go", Text: "hi"},
+				LastPart:    &seenEvent{Time: at(2 * time.Hour), Channel: "#go", Text: "bye"},
+				LastQuit:    &seenEvent{Time: at(72 * time.Hour), Text: "Ping timeout"},
+			},
+			"alice was last seen 2h ago leaving #go (bye)",
+		},
+		{
+			&seenRecord{
+				Nick:     "alice",
+				LastJoin: &seenEvent{Time: at(10 * time.Minute), Channel: "#go"},
+				LastQuit: &seenEvent{Time: at(5 * time.Minute)},
+			},
+			"alice was last seen 5m ago quitting",
+		},
+		{
+			&seenRecord{
+				Nick:        "alice_",
+				LastMessage: &seenEvent{Time: at(time.Hour), Channel: "#go", Text: "brb"},
+				NickChanges: []seenNickChange{{Time: at(30 * time.Second), OldNick: "alice", NewNick: "alice_"}},
+			},
+			"alice_ was last seen just now changing nick from alice to alice_",
+		},
+	}
+
+	for _, test := range tests {
+		if summary := test.record.summary(now); summary != test.expected {
+			t.Errorf("summary() = %q, expected %q", summary, test.expected)
+		}
+	}
+}
+
+func TestSeenCommandLimiter(t *testing.T) {
+	limiter := newSeenCommandLimiter()
+	now := time.Date(2016, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		channel  IRCChannel
+		nick     string
+		after    time.Duration
+		expected bool
+	}{
+		{"#go", "alice", 0, true},
+		// Alice asked too recently
+		{"#rust", "Alice", time.Second, false},
+		// Someone else asked in #go too recently
+		{"#GO", "bob", 2 * time.Second, false},
+		{"#rust", "bob", 3 * time.Second, true},
+		// Private messages only count against the nick
+		{"", "carol", 4 * time.Second, true},
+		{"", "carol", 5 * time.Second, false},
+		{"#go", "dave", seenCommandChannelInterval, true},
+		{"#rust", "alice", seenCommandNickInterval, true},
+	}
+
+	for _, test := range tests {
+		if allowed := limiter.allow(test.channel, test.nick, now.Add(test.after)); allowed != test.expected {
+			t.Errorf("allow(%q, %v) after %v = %v, expected %v", test.channel, test.nick, test.after, allowed, test.expected)
+		}
+	}
+}
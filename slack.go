@@ -5,23 +5,36 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+	"sync"
+	"unicode"
 
 	slack "github.com/nlopes/slack"
 )
 
+// A connection to one Slack workspace
 type slackProxy struct {
-	config           *SlackConfig
-	client           *slack.Client
-	rtm              *slack.RTM
-	channelNameToID  map[SlackChannel]string
-	channelIDToName  map[string]SlackChannel
+	// Empty for the owner's own workspace, configured under Slack
+	name            string
+	config          *SlackConfig
+	client          *slack.Client
+	rtm             *slack.RTM
+	dispatcher      *slackDispatcher
+	coalescer       *ircLineCoalescer
+	channelNameToID map[SlackChannel]string
+	channelIDToName map[string]SlackChannel
+	// Written from the RTM event loop as users change, and read from everywhere else
+	usersMutex       sync.RWMutex
 	userIDToName     map[string]string
+	nameOrder        []string
 	ownerID          string
 	ownerIMChannelID string
+	// Like "https://example.slack.com/", for building permalinks
+	teamURL string
 }
 
-func newSlackProxy(config *SlackConfig) (*slackProxy, error) {
+func newSlackProxy(name string, config *SlackConfig, stateDirectory string, coalesceWindows map[SlackChannel]int) (*slackProxy, error) {
 	proxy := new(slackProxy)
+	proxy.name = name
 	proxy.config = config
 
 	token := config.Token
@@ -31,12 +44,26 @@ func newSlackProxy(config *SlackConfig) (*slackProxy, error) {
 
 	proxy.client = slack.New(token)
 	proxy.rtm = proxy.client.NewRTM()
+	proxy.dispatcher = newSlackDispatcher(proxy.rtm, &config.Outbox, stateDirectory, namedStateFilename(slackSpoolFilename, name))
+	proxy.coalescer = newIRCLineCoalescer(proxy, coalesceWindows)
 
 	proxy.channelNameToID = make(map[SlackChannel]string)
 	proxy.channelIDToName = make(map[string]SlackChannel)
 
 	proxy.userIDToName = make(map[string]string)
 
+	proxy.nameOrder = config.NameOrder
+	if len(proxy.nameOrder) == 0 {
+		proxy.nameOrder = []string{"DisplayName", "RealName", "Name"}
+	}
+	for _, field := range proxy.nameOrder {
+		switch field {
+		case "DisplayName", "RealName", "Name":
+		default:
+			return nil, fmt.Errorf("Unknown Slack name field in NameOrder: %v", field)
+		}
+	}
+
 	return proxy, nil
 }
 
@@ -64,18 +91,20 @@ func (proxy *slackProxy) connect() error {
 
 	foundOwner := false
 	for _, user := range users {
-		if user.Name == proxy.config.Owner {
+		if proxy.isOwner(user) {
 			// We found the user struct representing the owner!
 			foundOwner = true
 			proxy.ownerID = user.ID
 		}
 
-		proxy.userIDToName[user.ID] = user.Name
+		proxy.updateUser(user)
 	}
 	if !foundOwner {
 		return fmt.Errorf("Could not find a Slack user that matched the configured owner: %v", proxy.config.Owner)
 	}
+	proxy.usersMutex.RLock()
 	fmt.Printf("Generated the following Slack user ID to name mapping: %v\n", proxy.userIDToName)
+	proxy.usersMutex.RUnlock()
 
 	_, _, imChannelID, err := proxy.rtm.OpenIMChannel(proxy.ownerID)
 	if err != nil {
@@ -83,47 +112,231 @@ func (proxy *slackProxy) connect() error {
 	}
 	proxy.ownerIMChannelID = imChannelID
 
+	auth, err := proxy.rtm.AuthTest()
+	if err != nil {
+		return fmt.Errorf("Could not get the Slack team URL: %v", err)
+	}
+	proxy.teamURL = auth.URL
+
+	proxy.dispatcher.restoreSpool()
+
 	return nil
 }
 
+// Owner can be configured by user ID, email, or legacy username
+func (proxy *slackProxy) isOwner(user slack.User) bool {
+	owner := proxy.config.Owner
+	if owner == "" {
+		return false
+	}
+
+	return user.ID == owner || user.Name == owner || strings.EqualFold(user.Profile.Email, owner)
+}
+
+// Records (or refreshes) the display name we use for a Slack user
+func (proxy *slackProxy) updateUser(user slack.User) {
+	name := proxy.resolveUserName(user)
+
+	proxy.usersMutex.Lock()
+	defer proxy.usersMutex.Unlock()
+
+	proxy.userIDToName[user.ID] = name
+}
+
+// Picks the first non-empty name according to the configured name order.
+// The legacy username is always the last resort, since it's the only name guaranteed to exist.
+func (proxy *slackProxy) resolveUserName(user slack.User) string {
+	for _, field := range proxy.nameOrder {
+		var name string
+		switch field {
+		case "DisplayName":
+			name = user.Profile.DisplayName
+		case "RealName":
+			name = user.Profile.RealName
+			if name == "" {
+				name = user.RealName
+			}
+		case "Name":
+			name = user.Name
+		}
+
+		if name = strings.TrimSpace(name); name != "" {
+			return name
+		}
+	}
+
+	return user.Name
+}
+
+// Turns a Slack name (which may contain spaces, punctuation, or non-ASCII characters)
+// into something that reads as a single nick-like token on IRC.
+func sanitizeIRCNick(name string) string {
+	var sanitized []rune
+	lastWasUnderscore := false
+
+	for _, r := range name {
+		switch {
+		case r <= unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+		case strings.ContainsRune("-[]\\`^{}|", r):
+		case unicode.IsSpace(r) || r == '_' || r == '.':
+			if lastWasUnderscore || len(sanitized) == 0 {
+				continue
+			}
+			r = '_'
+		default:
+			continue
+		}
+
+		sanitized = append(sanitized, r)
+		lastWasUnderscore = r == '_'
+	}
+
+	result := strings.TrimRight(string(sanitized), "_")
+	// Nicks can't start with a digit or a dash
+	if result != "" && (unicode.IsDigit(rune(result[0])) || result[0] == '-') {
+		result = "_" + result
+	}
+
+	return result
+}
+
 func generateUserIconURL(username string) string {
 	return fmt.Sprintf("http://www.gravatar.com/avatar/%x?d=identicon", md5.Sum([]byte(username)))
 }
 
 func (proxy *slackProxy) sendMessageAsUser(channelName SlackChannel, username string, text string) {
+	proxy.sendMessageAsUserWithCallback(channelName, username, text, nil)
+}
+
+// Like sendMessageAsUser, but merges the text with the user's previous lines if the channel has coalescing enabled.
+// If onDelivered isn't nil, it's called with the timestamp of the Slack message that holds the text.
+func (proxy *slackProxy) sendCoalescedMessageAsUser(channelName SlackChannel, username string, text string, onDelivered func(timestamp string)) {
+	if !proxy.coalescer.add(channelName, username, text, onDelivered) {
+		proxy.sendMessageAsUserWithCallback(channelName, username, text, onDelivered)
+	}
+}
+
+func (proxy *slackProxy) sendMessageAsUserWithCallback(channelName SlackChannel, username string, text string, onDelivered func(timestamp string)) {
 	channelID := proxy.channelNameToID[channelName]
 	params := slack.NewPostMessageParameters()
 	params.Username = username
 	params.AsUser = false
 	params.IconURL = generateUserIconURL(username)
 
-	_, _, err := proxy.rtm.PostMessage(channelID, text, params)
-	if err != nil {
-		fmt.Printf("Error while sending message: %v\n", err)
-	}
+	proxy.dispatcher.enqueue(&slackRequest{ChannelID: channelID, Text: text, Params: params, onDelivered: onDelivered})
+}
+
+// Replaces the text of a message we've previously posted
+func (proxy *slackProxy) updateMessage(channelName SlackChannel, timestamp string, text string) {
+	channelID := proxy.channelNameToID[channelName]
+	proxy.dispatcher.enqueue(&slackRequest{ChannelID: channelID, Text: text, Timestamp: timestamp})
+}
+
+// Adds an emoji reaction (like "warning", without colons) to a message
+func (proxy *slackProxy) addReaction(channelID string, timestamp string, reaction string) {
+	proxy.dispatcher.enqueue(&slackRequest{ChannelID: channelID, Timestamp: timestamp, Reaction: reaction})
+}
+
+// Replies to a message in its thread as the bot
+func (proxy *slackProxy) replyInThread(channelID string, timestamp string, text string) {
+	params := slack.NewPostMessageParameters()
+	params.Username = "IRC"
+	params.AsUser = false
+	params.ThreadTimestamp = timestamp
+
+	proxy.dispatcher.enqueue(&slackRequest{ChannelID: channelID, Text: text, Params: params})
 }
 
 func (proxy *slackProxy) sendMessageAsBot(channelName SlackChannel, text string) {
+	proxy.sendMessageAsBotWithCallback(channelName, text, nil)
+}
+
+func (proxy *slackProxy) sendMessageAsBotWithCallback(channelName SlackChannel, text string, onDelivered func(timestamp string)) {
 	channelID := proxy.channelNameToID[channelName]
 	params := slack.NewPostMessageParameters()
 	params.Username = "IRC"
 	params.AsUser = false
 	params.LinkNames = 1
 
-	_, _, err := proxy.rtm.PostMessage(channelID, text, params)
-	if err != nil {
-		fmt.Printf("Error while sending message: %v\n", err)
-	}
+	proxy.dispatcher.enqueue(&slackRequest{ChannelID: channelID, Text: text, Params: params, onDelivered: onDelivered})
+}
+
+// Posts in a thread as the bot, like sendMessageAsBot does in the channel
+func (proxy *slackProxy) replyInThreadAsBot(channelName SlackChannel, threadTimestamp string, text string) {
+	channelID := proxy.channelNameToID[channelName]
+	params := slack.NewPostMessageParameters()
+	params.Username = "IRC"
+	params.AsUser = false
+	params.LinkNames = 1
+	params.ThreadTimestamp = threadTimestamp
+
+	proxy.dispatcher.enqueue(&slackRequest{ChannelID: channelID, Text: text, Params: params})
+}
+
+// Replies to a message in its thread as an IRC user
+func (proxy *slackProxy) replyInThreadAsUser(channelName SlackChannel, threadTimestamp string, username string, text string) {
+	proxy.replyInThreadAsUserWithCallback(channelName, threadTimestamp, username, text, nil)
+}
+
+func (proxy *slackProxy) replyInThreadAsUserWithCallback(channelName SlackChannel, threadTimestamp string, username string, text string, onDelivered func(timestamp string)) {
+	channelID := proxy.channelNameToID[channelName]
+	params := slack.NewPostMessageParameters()
+	params.Username = username
+	params.AsUser = false
+	params.IconURL = generateUserIconURL(username)
+	params.ThreadTimestamp = threadTimestamp
+
+	proxy.dispatcher.enqueue(&slackRequest{ChannelID: channelID, Text: text, Params: params, onDelivered: onDelivered})
+}
+
+// Shows the bot typing in the channel for a few seconds
+func (proxy *slackProxy) sendTyping(channelName SlackChannel) {
+	channelID := proxy.channelNameToID[channelName]
+	proxy.rtm.SendMessage(proxy.rtm.NewTypingMessage(channelID))
 }
 
 func (proxy *slackProxy) sendMessageToOwner(text string) {
 	proxy.rtm.SendMessage(proxy.rtm.NewOutgoingMessage(text, proxy.ownerIMChannelID))
 }
 
+func (proxy *slackProxy) getChannelID(channelName SlackChannel) string {
+	return proxy.channelNameToID[channelName]
+}
+
+// Builds a link to a message, like https://example.slack.com/archives/C024BE91L/p1355517523000008.
+// A reply in a thread also needs the timestamp of the thread, which is otherwise empty.
+func (proxy *slackProxy) permalink(channelID string, timestamp string, threadTimestamp string) string {
+	teamURL := strings.TrimSuffix(proxy.teamURL, "/")
+	link := fmt.Sprintf("%v/archives/%v/p%v", teamURL, channelID, strings.Replace(timestamp, ".", "", 1))
+	if threadTimestamp != "" {
+		link += fmt.Sprintf("?thread_ts=%v&cid=%v", threadTimestamp, channelID)
+	}
+	return link
+}
+
 func (proxy *slackProxy) getChannelName(channelID string) SlackChannel {
 	return proxy.channelIDToName[channelID]
 }
 
+func (proxy *slackProxy) getUserName(userID string) string {
+	proxy.usersMutex.RLock()
+	defer proxy.usersMutex.RUnlock()
+
+	return proxy.userIDToName[userID]
+}
+
+// Uploads a text file to the DM channel with the owner
+func (proxy *slackProxy) uploadFileToOwner(filename string, title string, content string) error {
+	_, err := proxy.client.UploadFile(slack.FileUploadParameters{
+		Content:  content,
+		Filename: filename,
+		Filetype: "text",
+		Title:    title,
+		Channels: []string{proxy.ownerIMChannelID},
+	})
+	return err
+}
+
 // Slack decodes '&', '<', and '>' per https://api.slack.com/docs/formatting#how_to_escape_characters
 // so we need to decode them.
 func decodeSlackHTMLEntities(input string) string {
@@ -136,6 +349,17 @@ func decodeSlackHTMLEntities(input string) string {
 	return output
 }
 
+// The reverse of decodeSlackHTMLEntities, for text that shouldn't be taken as Slack markup
+func encodeSlackHTMLEntities(input string) string {
+	output := input
+
+	output = strings.Replace(output, "&", "&amp;", -1)
+	output = strings.Replace(output, "<", "&lt;", -1)
+	output = strings.Replace(output, ">", "&gt;", -1)
+
+	return output
+}
+
 // Slack has advice on how to display formatted messages from the Slack backend,
 // so we should follow it: https://api.slack.com/docs/formatting#how_to_display_formatted_messages
 func (proxy *slackProxy) renderFormattedMessageForDisplay(input string) string {
@@ -155,9 +379,17 @@ func (proxy *slackProxy) renderSlackBracketSequence(input string) string {
 		return fmt.Sprintf("%v", proxy.channelIDToName[channelID])
 	}
 
-	if strings.HasPrefix(body, "@U") {
+	if strings.HasPrefix(body, "@U") || strings.HasPrefix(body, "@W") {
 		userID := body[1:len(body)]
-		return fmt.Sprintf("@%v", proxy.userIDToName[userID])
+		if indexOfPipe := strings.Index(userID, "|"); indexOfPipe >= 0 {
+			userID = userID[:indexOfPipe]
+		}
+
+		name := sanitizeIRCNick(proxy.getUserName(userID))
+		if name == "" {
+			name = userID
+		}
+		return fmt.Sprintf("@%v", name)
 	}
 
 	// For special sequences (ex: "<!here|@here>" or "<!channel>"), return the label
@@ -0,0 +1,441 @@
+package pino
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	slack "github.com/nlopes/slack"
+)
+
+const (
+	defaultSlackMaxRetries = 5
+	defaultSlackQueueSize  = 1000
+	slackSpoolFilename     = "slack-outbox.jsonl"
+	maxSlackRetryBackoff   = time.Minute
+)
+
+// Slack API errors that trying again won't fix
+var permanentSlackErrors = map[string]bool{
+	"account_inactive":    true,
+	"cant_update_message": true,
+	"channel_not_found":   true,
+	"edit_window_closed":  true,
+	"invalid_auth":        true,
+	"invalid_name":        true,
+	"is_archived":         true,
+	"message_not_found":   true,
+	"missing_scope":       true,
+	"msg_too_long":        true,
+	"no_text":             true,
+	"not_authed":          true,
+	"not_in_channel":      true,
+	"restricted_action":   true,
+	"token_revoked":       true,
+	"too_many_reactions":  true,
+}
+
+// The parts of the Slack Web API the dispatcher uses
+type slackMessageAPI interface {
+	PostMessage(channel string, text string, params slack.PostMessageParameters) (string, string, error)
+	UpdateMessage(channel string, timestamp string, text string) (string, string, string, error)
+	AddReaction(name string, item slack.ItemRef) error
+}
+
+// A message waiting to be posted to Slack.
+// If Timestamp is set, the existing message with that timestamp is edited instead,
+// or if Reaction is also set, the reaction is added to that message.
+type slackRequest struct {
+	// Requests are numbered as they're queued, so the ones saved to disk can be put back in order
+	ID        uint64                      `json:"id,omitempty"`
+	ChannelID string                      `json:"channel"`
+	Text      string                      `json:"text"`
+	Params    slack.PostMessageParameters `json:"params"`
+	Timestamp string                      `json:"update_ts,omitempty"`
+	Reaction  string                      `json:"reaction,omitempty"`
+
+	// Called with the timestamp of the Slack message once it's delivered, or with an empty
+	// timestamp if it's given up on. This survives being saved to disk, but not a restart.
+	onDelivered func(timestamp string)
+}
+
+// The slackDispatcher posts messages to Slack in the background, so that nobody
+// handling IRC events ever has to wait on the Slack Web API.
+//
+// Each channel's messages are delivered in order. Once a channel has QueueSize messages waiting,
+// the ones after that are saved to the outbox on disk, and so is a message that keeps failing,
+// along with everything queued behind it. The channel's worker reads them back once its queue
+// has drained, so nothing overtakes a message that's waiting on disk.
+type slackDispatcher struct {
+	api        slackMessageAPI
+	maxRetries int
+	queueSize  int
+	spoolPath  string
+	// How long to wait after the first failed attempt, which doubles with every attempt after that
+	retryBackoff time.Duration
+	// How long a channel waits before trying again once it's given up on a message
+	retryPause time.Duration
+	// Called when a message is dropped because Slack will never accept it, like when the channel is archived
+	onDropped func(request *slackRequest, err error)
+
+	// Guards everything below, and the outbox on disk
+	mutex  sync.Mutex
+	queues map[string]*slackChannelQueue
+	nextID uint64
+	// The callbacks of requests saved to disk, by request ID
+	spooledCallbacks map[uint64]func(timestamp string)
+}
+
+// Messages for a single Slack channel, which are delivered strictly in order by one worker
+type slackChannelQueue struct {
+	channelID string
+	pending   []*slackRequest
+	// How many of the channel's messages are waiting in the outbox on disk
+	spooled int
+	wakeup  chan bool
+}
+
+func newSlackDispatcher(api slackMessageAPI, config *SlackOutboxConfig, stateDirectory string, spoolFilename string) *slackDispatcher {
+	dispatcher := &slackDispatcher{
+		api:              api,
+		maxRetries:       config.MaxRetries,
+		queueSize:        config.QueueSize,
+		retryBackoff:     time.Second,
+		retryPause:       maxSlackRetryBackoff,
+		queues:           make(map[string]*slackChannelQueue),
+		nextID:           uint64(time.Now().UnixNano()),
+		spooledCallbacks: make(map[uint64]func(timestamp string)),
+	}
+
+	if dispatcher.maxRetries <= 0 {
+		dispatcher.maxRetries = defaultSlackMaxRetries
+	}
+	if dispatcher.queueSize <= 0 {
+		dispatcher.queueSize = defaultSlackQueueSize
+	}
+	if stateDirectory != "" {
+		dispatcher.spoolPath = filepath.Join(stateDirectory, spoolFilename)
+	}
+
+	return dispatcher
+}
+
+// Queue up a message for delivery. This never blocks on the network.
+func (dispatcher *slackDispatcher) enqueue(request *slackRequest) {
+	dispatcher.mutex.Lock()
+	defer dispatcher.mutex.Unlock()
+
+	dispatcher.nextID++
+	request.ID = dispatcher.nextID
+
+	queue := dispatcher.queueFor(request.ChannelID)
+	if queue.spooled > 0 || len(queue.pending) >= dispatcher.queueSize {
+		if queue.spooled == 0 {
+			fmt.Printf("Slack queue for %v is full, saving messages for later\n", request.ChannelID)
+		}
+		dispatcher.spool(queue, []*slackRequest{request})
+		return
+	}
+
+	queue.pending = append(queue.pending, request)
+	queue.wake()
+}
+
+// The caller must hold the mutex
+func (dispatcher *slackDispatcher) queueFor(channelID string) *slackChannelQueue {
+	queue, ok := dispatcher.queues[channelID]
+	if !ok {
+		queue = &slackChannelQueue{channelID: channelID, wakeup: make(chan bool, 1)}
+		dispatcher.queues[channelID] = queue
+		go dispatcher.work(queue)
+	}
+	return queue
+}
+
+func (queue *slackChannelQueue) wake() {
+	select {
+	case queue.wakeup <- true:
+	default:
+	}
+}
+
+// Delivers the messages of one channel queue, one at a time, forever
+func (dispatcher *slackDispatcher) work(queue *slackChannelQueue) {
+	for {
+		dispatcher.mutex.Lock()
+		if len(queue.pending) == 0 && queue.spooled > 0 {
+			dispatcher.unspool(queue)
+		}
+		if len(queue.pending) == 0 {
+			dispatcher.mutex.Unlock()
+			<-queue.wakeup
+			continue
+		}
+		request := queue.pending[0]
+		dispatcher.mutex.Unlock()
+
+		timestamp, err := dispatcher.deliver(request)
+		if err == nil {
+			dispatcher.mutex.Lock()
+			queue.pending = queue.pending[1:]
+			dispatcher.mutex.Unlock()
+
+			if request.onDelivered != nil {
+				request.onDelivered(timestamp)
+			}
+			continue
+		}
+
+		if permanentSlackErrors[err.Error()] {
+			fmt.Printf("Dropping message to Slack channel %v: %v\n", request.ChannelID, err)
+			dispatcher.mutex.Lock()
+			queue.pending = queue.pending[1:]
+			dispatcher.mutex.Unlock()
+
+			if dispatcher.onDropped != nil {
+				dispatcher.onDropped(request, err)
+			}
+			request.giveUp()
+			continue
+		}
+
+		// Everything behind the message goes to disk with it, to keep the channel in order
+		fmt.Printf("Giving up on sending message to Slack for now after %v attempts: %v\n", dispatcher.maxRetries, err)
+		dispatcher.mutex.Lock()
+		dispatcher.spool(queue, queue.pending)
+		queue.pending = nil
+		dispatcher.mutex.Unlock()
+
+		time.Sleep(dispatcher.retryPause)
+	}
+}
+
+// Posts the message, retrying on failure. Slack's Retry-After is honored when we're rate limited,
+// and other errors back off exponentially. Errors that won't go away aren't retried.
+func (dispatcher *slackDispatcher) deliver(request *slackRequest) (string, error) {
+	backoff := dispatcher.retryBackoff
+
+	var timestamp string
+	var err error
+	for attempt := 1; attempt <= dispatcher.maxRetries; attempt++ {
+		if request.Reaction != "" {
+			timestamp = request.Timestamp
+			err = dispatcher.api.AddReaction(request.Reaction, slack.NewRefToMessage(request.ChannelID, request.Timestamp))
+			if err != nil && err.Error() == "already_reacted" {
+				// Probably from an attempt that worked without us hearing back
+				err = nil
+			}
+		} else if request.Timestamp != "" {
+			_, timestamp, _, err = dispatcher.api.UpdateMessage(request.ChannelID, request.Timestamp, request.Text)
+		} else {
+			_, timestamp, err = dispatcher.api.PostMessage(request.ChannelID, request.Text, request.Params)
+		}
+		if err == nil {
+			return timestamp, nil
+		}
+		if permanentSlackErrors[err.Error()] {
+			return "", err
+		}
+
+		wait := backoff
+		if rateLimitedError, ok := err.(*slack.RateLimitedError); ok {
+			wait = rateLimitedError.RetryAfter
+		} else {
+			backoff *= 2
+			if backoff > maxSlackRetryBackoff {
+				backoff = maxSlackRetryBackoff
+			}
+		}
+
+		fmt.Printf("Error while sending message (attempt %v, retrying in %v): %v\n", attempt, wait, err)
+		if attempt < dispatcher.maxRetries {
+			time.Sleep(wait)
+		}
+	}
+
+	return "", err
+}
+
+// Lets whoever's waiting on the message know it's not going to be delivered
+func (request *slackRequest) giveUp() {
+	if request.onDelivered != nil {
+		request.onDelivered("")
+	}
+}
+
+// Saves messages for the queue's channel to the outbox on disk, after the ones already there.
+// Without a StateDirectory, they're dropped instead. The caller must hold the mutex.
+func (dispatcher *slackDispatcher) spool(queue *slackChannelQueue, requests []*slackRequest) {
+	if len(requests) == 0 {
+		return
+	}
+
+	err := dispatcher.appendToSpool(requests)
+	if err != nil {
+		fmt.Printf("Could not save %v Slack messages, dropping them: %v\n", len(requests), err)
+		for _, request := range requests {
+			// Whoever's waiting on these might want the lock we're holding
+			go request.giveUp()
+		}
+		return
+	}
+
+	for _, request := range requests {
+		if request.onDelivered != nil {
+			dispatcher.spooledCallbacks[request.ID] = request.onDelivered
+		}
+	}
+	queue.spooled += len(requests)
+}
+
+func (dispatcher *slackDispatcher) appendToSpool(requests []*slackRequest) error {
+	if dispatcher.spoolPath == "" {
+		return fmt.Errorf("No StateDirectory configured")
+	}
+
+	file, err := os.OpenFile(dispatcher.spoolPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("Could not open Slack outbox %v: %v", dispatcher.spoolPath, err)
+	}
+	defer file.Close()
+
+	for _, request := range requests {
+		data, err := json.Marshal(request)
+		if err != nil {
+			return fmt.Errorf("Could not serialize Slack message: %v", err)
+		}
+		if _, err := file.Write(append(data, '\n')); err != nil {
+			return fmt.Errorf("Could not write to Slack outbox %v: %v", dispatcher.spoolPath, err)
+		}
+	}
+
+	return nil
+}
+
+// Reads everything in the outbox on disk. The caller must hold the mutex.
+func (dispatcher *slackDispatcher) readSpool() ([]*slackRequest, error) {
+	file, err := os.Open(dispatcher.spoolPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Could not open Slack outbox %v: %v", dispatcher.spoolPath, err)
+	}
+	defer file.Close()
+
+	var requests []*slackRequest
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		request := &slackRequest{}
+		if err := json.Unmarshal(scanner.Bytes(), request); err != nil {
+			fmt.Printf("Skipping unreadable entry in Slack outbox: %v\n", err)
+			continue
+		}
+		requests = append(requests, request)
+	}
+
+	return requests, scanner.Err()
+}
+
+// Replaces the outbox on disk. The caller must hold the mutex.
+func (dispatcher *slackDispatcher) writeSpool(requests []*slackRequest) error {
+	if len(requests) == 0 {
+		if err := os.Remove(dispatcher.spoolPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Could not clear Slack outbox %v: %v", dispatcher.spoolPath, err)
+		}
+		return nil
+	}
+
+	var contents []byte
+	for _, request := range requests {
+		data, err := json.Marshal(request)
+		if err != nil {
+			return fmt.Errorf("Could not serialize Slack message: %v", err)
+		}
+		contents = append(contents, data...)
+		contents = append(contents, '\n')
+	}
+
+	if err := writeStateFileAtomically(dispatcher.spoolPath, contents); err != nil {
+		return fmt.Errorf("Could not write Slack outbox %v: %v", dispatcher.spoolPath, err)
+	}
+	return nil
+}
+
+// Moves up to QueueSize of the channel's saved messages from disk back into its queue,
+// oldest first. The caller must hold the mutex.
+func (dispatcher *slackDispatcher) unspool(queue *slackChannelQueue) {
+	requests, err := dispatcher.readSpool()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+	}
+
+	var taken, kept []*slackRequest
+	for _, request := range requests {
+		if request.ChannelID == queue.channelID {
+			taken = append(taken, request)
+		} else {
+			kept = append(kept, request)
+		}
+	}
+
+	// A message that failed goes back to disk after messages that were saved behind it
+	sort.SliceStable(taken, func(i, j int) bool { return taken[i].ID < taken[j].ID })
+	saved := len(taken)
+	if len(taken) > dispatcher.queueSize {
+		kept = append(kept, taken[dispatcher.queueSize:]...)
+		taken = taken[:dispatcher.queueSize]
+	}
+
+	if err := dispatcher.writeSpool(kept); err != nil {
+		// Better to send something twice than to lose it, so the messages are sent anyway
+		fmt.Printf("%v\n", err)
+	}
+
+	for _, request := range taken {
+		if callback, ok := dispatcher.spooledCallbacks[request.ID]; ok {
+			request.onDelivered = callback
+			delete(dispatcher.spooledCallbacks, request.ID)
+		}
+	}
+
+	queue.pending = append(queue.pending, taken...)
+	queue.spooled = saved - len(taken)
+}
+
+// Hands the messages left on disk by a previous run to their channels' workers
+func (dispatcher *slackDispatcher) restoreSpool() {
+	if dispatcher.spoolPath == "" {
+		return
+	}
+
+	dispatcher.mutex.Lock()
+	defer dispatcher.mutex.Unlock()
+
+	requests, err := dispatcher.readSpool()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	if len(requests) == 0 {
+		return
+	}
+
+	fmt.Printf("Re-sending %v saved Slack messages\n", len(requests))
+	for _, request := range requests {
+		// Anything queued from now on has to come after what's on disk
+		if request.ID > dispatcher.nextID {
+			dispatcher.nextID = request.ID
+		}
+
+		queue := dispatcher.queueFor(request.ChannelID)
+		queue.spooled++
+		queue.wake()
+	}
+}
@@ -0,0 +1,259 @@
+package pino
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	slack "github.com/nlopes/slack"
+)
+
+// A Slack API that records what's posted, and fails the way it's told to
+type fakeSlackMessageAPI struct {
+	mutex  sync.Mutex
+	posted []string
+	// Where each posted text went, like "C1", or "C1 1.000" for a reply in a thread
+	postedTo []string
+	// Like "1.000 new text"
+	updated []string
+	// Errors to return for the next attempts at posting a text, in order
+	failures map[string][]error
+	attempts map[string]int
+	// While set, posting waits until it's closed
+	blocked chan bool
+}
+
+func newFakeSlackMessageAPI() *fakeSlackMessageAPI {
+	return &fakeSlackMessageAPI{
+		failures: make(map[string][]error),
+		attempts: make(map[string]int),
+	}
+}
+
+func (api *fakeSlackMessageAPI) PostMessage(channel string, text string, params slack.PostMessageParameters) (string, string, error) {
+	api.mutex.Lock()
+	blocked := api.blocked
+	api.mutex.Unlock()
+	if blocked != nil {
+		<-blocked
+	}
+
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+
+	api.attempts[text]++
+	if failures := api.failures[text]; len(failures) > 0 {
+		api.failures[text] = failures[1:]
+		return "", "", failures[0]
+	}
+
+	api.posted = append(api.posted, text)
+	api.postedTo = append(api.postedTo, strings.TrimSpace(channel+" "+params.ThreadTimestamp))
+	return channel, fmt.Sprintf("%v.000", len(api.posted)), nil
+}
+
+func (api *fakeSlackMessageAPI) UpdateMessage(channel string, timestamp string, text string) (string, string, string, error) {
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+
+	api.updated = append(api.updated, timestamp+" "+text)
+	return channel, timestamp, text, nil
+}
+
+func (api *fakeSlackMessageAPI) AddReaction(name string, item slack.ItemRef) error {
+	return nil
+}
+
+func (api *fakeSlackMessageAPI) postedMessages() []string {
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+
+	return append([]string(nil), api.posted...)
+}
+
+func (api *fakeSlackMessageAPI) postedDestinations() []string {
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+
+	return append([]string(nil), api.postedTo...)
+}
+
+func newTestSlackDispatcher(t *testing.T, api slackMessageAPI, queueSize int) *slackDispatcher {
+	directory, err := ioutil.TempDir("", "pino-outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(directory) })
+
+	dispatcher := newSlackDispatcher(api, &SlackOutboxConfig{MaxRetries: 2, QueueSize: queueSize}, directory, slackSpoolFilename)
+	dispatcher.retryBackoff = time.Millisecond
+	dispatcher.retryPause = time.Millisecond
+	return dispatcher
+}
+
+func waitForSlackPosts(t *testing.T, api *fakeSlackMessageAPI, count int) []string {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if posted := api.postedMessages(); len(posted) >= count {
+			return posted
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatalf("Timed out waiting for %v posts, got %v", count, api.postedMessages())
+	return nil
+}
+
+func expectSlackPosts(t *testing.T, posted []string, expected []string) {
+	if fmt.Sprint(posted) != fmt.Sprint(expected) {
+		t.Errorf("Expected posts %v, got %v", expected, posted)
+	}
+}
+
+func TestSlackDispatcherKeepsOverflowInOrder(t *testing.T) {
+	api := newFakeSlackMessageAPI()
+	api.blocked = make(chan bool)
+	dispatcher := newTestSlackDispatcher(t, api, 2)
+
+	var mutex sync.Mutex
+	delivered := make(map[string]string)
+
+	var expected []string
+	for i := 1; i <= 7; i++ {
+		text := fmt.Sprintf("line %v", i)
+		expected = append(expected, text)
+		dispatcher.enqueue(&slackRequest{ChannelID: "C1", Text: text, onDelivered: func(timestamp string) {
+			mutex.Lock()
+			delivered[text] = timestamp
+			mutex.Unlock()
+		}})
+	}
+
+	api.mutex.Lock()
+	close(api.blocked)
+	api.blocked = nil
+	api.mutex.Unlock()
+
+	expectSlackPosts(t, waitForSlackPosts(t, api, len(expected)), expected)
+
+	// The callbacks of the lines that were saved to disk still run
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		mutex.Lock()
+		count := len(delivered)
+		mutex.Unlock()
+		if count == len(expected) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, text := range expected {
+		if delivered[text] == "" {
+			t.Errorf("Expected %q to be delivered, got %v", text, delivered)
+		}
+	}
+}
+
+func TestSlackDispatcherRetries(t *testing.T) {
+	api := newFakeSlackMessageAPI()
+	dispatcher := newTestSlackDispatcher(t, api, 10)
+
+	// The first line fails every attempt, so it gets saved with the line behind it and tried again
+	api.failures["first"] = []error{errors.New("internal_error"), errors.New("internal_error"), errors.New("internal_error")}
+	api.failures["second"] = []error{&slack.RateLimitedError{RetryAfter: time.Millisecond}}
+
+	dispatcher.enqueue(&slackRequest{ChannelID: "C1", Text: "first"})
+	dispatcher.enqueue(&slackRequest{ChannelID: "C1", Text: "second"})
+	dispatcher.enqueue(&slackRequest{ChannelID: "C1", Text: "third"})
+
+	expectSlackPosts(t, waitForSlackPosts(t, api, 3), []string{"first", "second", "third"})
+
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+	if api.attempts["first"] != 4 || api.attempts["second"] != 2 || api.attempts["third"] != 1 {
+		t.Errorf("Unexpected attempts: %v", api.attempts)
+	}
+}
+
+func TestSlackDispatcherDropsPermanentErrors(t *testing.T) {
+	api := newFakeSlackMessageAPI()
+	dispatcher := newTestSlackDispatcher(t, api, 10)
+
+	api.failures["archived"] = []error{errors.New("is_archived")}
+
+	dropped := make(chan error, 1)
+	dispatcher.onDropped = func(request *slackRequest, err error) { dropped <- err }
+	delivered := make(chan string, 1)
+
+	dispatcher.enqueue(&slackRequest{ChannelID: "C1", Text: "archived", onDelivered: func(timestamp string) { delivered <- timestamp }})
+	dispatcher.enqueue(&slackRequest{ChannelID: "C1", Text: "next"})
+
+	expectSlackPosts(t, waitForSlackPosts(t, api, 1), []string{"next"})
+
+	if err := <-dropped; err.Error() != "is_archived" {
+		t.Errorf("Expected the owner to hear about is_archived, got %v", err)
+	}
+	if timestamp := <-delivered; timestamp != "" {
+		t.Errorf("Expected the dropped message to have no timestamp, got %v", timestamp)
+	}
+
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+	if api.attempts["archived"] != 1 {
+		t.Errorf("Expected a permanent error not to be retried, got %v attempts", api.attempts["archived"])
+	}
+}
+
+func TestSlackDispatcherRestoresSpool(t *testing.T) {
+	api := newFakeSlackMessageAPI()
+	dispatcher := newTestSlackDispatcher(t, api, 10)
+
+	// Saved by an earlier run, which may not have numbered its messages
+	old := []*slackRequest{
+		{ChannelID: "C1", Text: "saved one"},
+		{ChannelID: "C2", Text: "saved elsewhere"},
+		{ChannelID: "C1", Text: "saved two"},
+	}
+	dispatcher.mutex.Lock()
+	if err := dispatcher.writeSpool(old); err != nil {
+		t.Fatal(err)
+	}
+	dispatcher.mutex.Unlock()
+
+	dispatcher.restoreSpool()
+	dispatcher.enqueue(&slackRequest{ChannelID: "C1", Text: "new"})
+
+	posted := waitForSlackPosts(t, api, 4)
+	var inC1 []string
+	for _, text := range posted {
+		if text != "saved elsewhere" {
+			inC1 = append(inC1, text)
+		}
+	}
+	expectSlackPosts(t, inC1, []string{"saved one", "saved two", "new"})
+
+	if _, err := os.Stat(dispatcher.spoolPath); !os.IsNotExist(err) {
+		t.Errorf("Expected the outbox to be cleared, got %v", err)
+	}
+}
+
+func TestSlackRequestReadsOldOutboxEntries(t *testing.T) {
+	// Written before requests were numbered
+	line := `{"channel":"C1","text":"edited","params":{},"update_ts":"1.000"}`
+
+	request := &slackRequest{}
+	if err := json.Unmarshal([]byte(line), request); err != nil {
+		t.Fatal(err)
+	}
+	if request.Timestamp != "1.000" || request.Text != "edited" {
+		t.Errorf("Unexpected request: %#v", request)
+	}
+}
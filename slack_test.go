@@ -0,0 +1,58 @@
+package pino
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	slack "github.com/nlopes/slack"
+)
+
+func TestResolveSlackUserName(t *testing.T) {
+	user := slack.User{ID: "U1", Name: "jdoe", RealName: "Jane Doe", Profile: slack.UserProfile{DisplayName: " janey "}}
+	noDisplayName := slack.User{ID: "U2", Name: "jdoe", Profile: slack.UserProfile{RealName: "Jane Doe"}}
+
+	tests := []struct {
+		nameOrder []string
+		user      slack.User
+		expected  string
+	}{
+		{[]string{"DisplayName", "RealName", "Name"}, user, "janey"},
+		{[]string{"DisplayName", "RealName", "Name"}, noDisplayName, "Jane Doe"},
+		{[]string{"RealName"}, user, "Jane Doe"},
+		{[]string{"DisplayName"}, slack.User{Name: "jdoe"}, "jdoe"},
+	}
+
+	for _, test := range tests {
+		proxy := &slackProxy{nameOrder: test.nameOrder}
+		if name := proxy.resolveUserName(test.user); name != test.expected {
+			t.Errorf("resolveUserName(%+v) with %v = %q, expected %q", test.user, test.nameOrder, name, test.expected)
+		}
+	}
+}
+
+func TestSlackUserNamesCanChangeWhileInUse(t *testing.T) {
+	proxy := &slackProxy{nameOrder: []string{"Name"}, userIDToName: make(map[string]string)}
+
+	// Users change on the RTM event loop while IRC lines are being relayed
+	var wait sync.WaitGroup
+	wait.Add(2)
+	go func() {
+		defer wait.Done()
+		for i := 0; i < 100; i++ {
+			proxy.updateUser(slack.User{ID: fmt.Sprintf("U%v", i%10), Name: fmt.Sprintf("user%v", i)})
+		}
+	}()
+	go func() {
+		defer wait.Done()
+		for i := 0; i < 100; i++ {
+			proxy.getUserName(fmt.Sprintf("U%v", i%10))
+			proxy.renderSlackBracketSequence("<@U1>")
+		}
+	}()
+	wait.Wait()
+
+	if name := proxy.getUserName("U9"); name != "user99" {
+		t.Errorf("Expected the latest name, got %q", name)
+	}
+}
@@ -0,0 +1,114 @@
+package pino
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// A jsonStateFile keeps something in the StateDirectory as JSON, so it survives a restart.
+// It shares its owner's lock, since the owner changes what it saves.
+type jsonStateFile struct {
+	// Empty when there's no StateDirectory, in which case nothing is read or written
+	path string
+	// What's in the file, like "IRC seen records", for error messages
+	description string
+
+	lock sync.Locker
+	// Returns what to save. It's called with the lock held, and encoded before the lock is released.
+	snapshot func() interface{}
+	// Whether there are changes that haven't been saved yet. Guarded by the lock.
+	dirty bool
+}
+
+func newJSONStateFile(stateDirectory string, filename string, description string, lock sync.Locker, snapshot func() interface{}) *jsonStateFile {
+	file := &jsonStateFile{
+		description: description,
+		lock:        lock,
+		snapshot:    snapshot,
+	}
+
+	if stateDirectory != "" {
+		file.path = filepath.Join(stateDirectory, filename)
+	}
+
+	return file
+}
+
+// Reads the file into value. A missing file is left alone, since it just means there's nothing saved yet.
+func (file *jsonStateFile) load(value interface{}) bool {
+	if file.path == "" {
+		return false
+	}
+
+	contents, err := ioutil.ReadFile(file.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Printf("Could not read %v %v: %v\n", file.description, file.path, err)
+		}
+		return false
+	}
+
+	if err := json.Unmarshal(contents, value); err != nil {
+		fmt.Printf("Could not parse %v %v: %v\n", file.description, file.path, err)
+		return false
+	}
+	return true
+}
+
+// Notes that there's something new to save. The caller must hold the lock.
+func (file *jsonStateFile) changed() {
+	file.dirty = true
+}
+
+// Saves every interval, if anything has changed since the last time
+func (file *jsonStateFile) saveRegularly(interval time.Duration) {
+	if file.path == "" {
+		return
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			file.save()
+		}
+	}()
+}
+
+// Writes the file now, if anything has changed since it was last written
+func (file *jsonStateFile) save() {
+	if file.path == "" {
+		return
+	}
+
+	file.lock.Lock()
+	if !file.dirty {
+		file.lock.Unlock()
+		return
+	}
+	contents, err := json.Marshal(file.snapshot())
+	file.dirty = false
+	file.lock.Unlock()
+
+	if err != nil {
+		fmt.Printf("Could not encode %v: %v\n", file.description, err)
+		return
+	}
+
+	if err := writeStateFileAtomically(file.path, contents); err != nil {
+		fmt.Printf("Could not write %v %v: %v\n", file.description, file.path, err)
+	}
+}
+
+// Replaces the file at path with contents. They're written to a temporary file first,
+// so a crash can't leave us with half a file.
+func writeStateFileAtomically(path string, contents []byte) error {
+	temporaryPath := path + ".tmp"
+	if err := ioutil.WriteFile(temporaryPath, contents, 0600); err != nil {
+		return err
+	}
+	return os.Rename(temporaryPath, path)
+}
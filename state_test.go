@@ -0,0 +1,56 @@
+package pino
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestJSONStateFileSavesOnlyChanges(t *testing.T) {
+	directory, err := ioutil.TempDir("", "pino-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	var mutex sync.Mutex
+	values := map[string]int{"a": 1}
+	file := newJSONStateFile(directory, "values.json", "test values", &mutex, func() interface{} { return values })
+	path := filepath.Join(directory, "values.json")
+
+	// Nothing has changed yet
+	file.save()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing to be written before a change, got %v", err)
+	}
+
+	mutex.Lock()
+	values["b"] = 2
+	file.changed()
+	mutex.Unlock()
+	file.save()
+
+	loaded := make(map[string]int)
+	if !file.load(&loaded) {
+		t.Fatal("Expected the saved values to load")
+	}
+	if len(loaded) != 2 || loaded["b"] != 2 {
+		t.Errorf("Expected the saved values back, got %v", loaded)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("Expected the temporary file to be gone, got %v", err)
+	}
+}
+
+func TestJSONStateFileWithoutStateDirectory(t *testing.T) {
+	var mutex sync.Mutex
+	file := newJSONStateFile("", "values.json", "test values", &mutex, func() interface{} { return nil })
+
+	file.changed()
+	file.save()
+	if file.load(&map[string]int{}) {
+		t.Error("Expected nothing to load without a StateDirectory")
+	}
+}
@@ -0,0 +1,152 @@
+package pino
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"text/template"
+)
+
+// The text of every message Pino generates, as Go text/template templates.
+// Any of them can be overridden in the config, globally under Templates or per channel
+// in the ChannelMapping. Templates are rendered with a messageTemplateData.
+var defaultMessageTemplates = map[string]string{
+	// Relayed from IRC to Slack, and between Slack channels bridged with the same IRC channel
+	"message":         "{{.Text}}",
+	"action":          "> *{{.Nick}} {{.Text}}*",
+	"join":            "> *{{.Nick}}* ({{.Usermask}}) joined the channel",
+	"part":            "> *{{.Nick}}* ({{.Usermask}}) left the channel",
+	"quit":            "> *{{.Nick}}* ({{.Usermask}}) left IRC ({{.Reason}})",
+	"kick":            "> *{{.Nick}}* kicked *{{.Target}}* from the channel ({{.Reason}})",
+	"mode":            "> *{{.Nick}}* sets *{{.Mode}}* *{{.Target}}*",
+	"nick":            "> {{.Nick}} is now known as *{{.NewNick}}*",
+	"topic":           "> *{{.Nick}}* changed the topic to *{{.Text}}*",
+	"notice":          "> -*{{.Nick}}*- {{.Text}}",
+	"netsplit":        "> Netsplit ({{.Reason}}): {{.Text}} split",
+	"netsplit-rejoin": "> Netsplit ({{.Reason}}): {{.Text}} rejoined after {{.Duration}}",
+	"highlight":       "<@{{.Owner}}>: you were pinged by {{.Nick}}",
+	"error":           "> {{.Text}}",
+	"history-message": "[{{.Time}}] {{.Text}}",
+	"history-action":  "[{{.Time}}] > *{{.Nick}} {{.Text}}*",
+	"playback-thread": "Playback ({{.Count}} lines)",
+	// Put in front of everything relayed to a Slack channel that's bridged with more than one IRC channel
+	"channel-prefix": "[{{if .Network}}{{.Network}}/{{end}}{{.Channel}}] ",
+	// Starts the day's thread for an IRC channel, in a Slack channel with Threaded bridges. Time is the day.
+	"thread-start": "*{{if .Network}}{{.Network}}/{{end}}{{.Channel}}* for {{.Time}}",
+
+	// Sent to the owner as a DM, tagged with the network if it has a name
+	"connected":              "{{if .Network}}[{{.Network}}] {{end}}Connected to IRC on {{.Server}}!",
+	"disconnected":           "{{if .Network}}[{{.Network}}] {{end}}Disconnected from IRC on {{.Server}}!",
+	"owner-error":            "{{if .Network}}[{{.Network}}] {{end}}{{.Text}}",
+	"owner-notice":           "{{if .Network}}[{{.Network}}] {{end}}{{if .Nick}}-{{.Nick}}- {{else}}Notice from {{.Server}}: {{end}}{{.Text}}",
+	"highlight-digest":       "While you were away, you were highlighted in:",
+	"highlight-digest-entry": "• {{.Time}} {{if .Network}}[{{.Network}}] {{end}}{{if .Channel}}{{.Channel}}{{else}}a private message{{end}} <{{.Nick}}> {{.Text}}{{if .Link}} {{.Link}}{{end}}",
+	"highlight-dm":           "{{if .Network}}[{{.Network}}] {{end}}{{if .Channel}}{{.Nick}} mentioned you in {{.Channel}}{{else}}{{.Nick}} messaged you{{end}}: {{.Text}}{{if .Link}} {{.Link}}{{end}}",
+
+	// Sent to IRC while the owner is away on Slack. Reason is their Slack status text.
+	"away":       "{{if .Reason}}{{.Reason}}{{else}}Away from Slack{{end}}",
+	"away-reply": "{{.Nick}}: I'm away from Slack right now{{if .Reason}} ({{.Reason}}){{end}}, but I'll see your message when I'm back.",
+
+	// Replied in the thread of a Slack message that couldn't be sent to IRC
+	"delivery-failed": "Couldn't deliver this to {{.Channel}}: {{.Reason}}",
+
+	// Relayed from Slack to IRC, one line at a time
+	"slack-message": "{{.Text}}",
+	"slack-action":  "{{.Text}}",
+}
+
+// The values available to message templates. Fields that don't apply to a message are empty.
+type messageTemplateData struct {
+	// The IRC nick (or Slack name, for messages going to IRC) of whoever caused the message
+	Nick string
+	// The nick!user@host of the IRC user
+	Usermask string
+	// The IRC channel the message is about
+	Channel IRCChannel
+	// Who was kicked, or what a mode was set on
+	Target string
+	// The new nick, for nick changes
+	NewNick string
+	// The mode that was set, like "+o"
+	Mode string
+	// Why someone quit, parted, or was kicked, why a message couldn't be delivered,
+	// or the servers involved in a netsplit
+	Reason string
+	// The message, action, topic, or notice text
+	Text string
+	// The Slack user ID of the owner, for mentions like "<@{{.Owner}}>"
+	Owner string
+	// The IRC server we're connected to
+	Server string
+	// The name of the IRC network, which is empty for a config with a single network under IRC
+	Network string
+	// How long something took, like a netsplit
+	Duration string
+	// A link to the relayed Slack message, for highlight DMs
+	Link string
+	// When a highlight happened, for highlight digests, or when a message from history was sent
+	Time string
+	// How many lines there are, for playback threads
+	Count int
+}
+
+// A complete set of message templates, with any overrides applied
+type messageTemplates map[string]*template.Template
+
+// Builds the templates from the defaults, with each set of overrides applied on top of the last
+func newMessageTemplates(overrides ...map[string]string) (messageTemplates, error) {
+	texts := make(map[string]string)
+	for name, text := range defaultMessageTemplates {
+		texts[name] = text
+	}
+	for _, override := range overrides {
+		for name, text := range override {
+			if _, ok := defaultMessageTemplates[name]; !ok {
+				return nil, fmt.Errorf("Unknown template '%v'", name)
+			}
+			texts[name] = text
+		}
+	}
+
+	templates := make(messageTemplates)
+	for name, text := range texts {
+		tmpl, err := template.New(name).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse template '%v': %v", name, err)
+		}
+
+		// Catch references to fields that don't exist now, rather than when the message is sent
+		if err := tmpl.Execute(ioutil.Discard, &messageTemplateData{}); err != nil {
+			return nil, fmt.Errorf("Invalid template '%v': %v", name, err)
+		}
+
+		templates[name] = tmpl
+	}
+
+	return templates, nil
+}
+
+func (templates messageTemplates) render(name string, data *messageTemplateData) string {
+	var buffer bytes.Buffer
+	if err := templates[name].Execute(&buffer, data); err != nil {
+		fmt.Printf("Could not render '%v' template: %v\n", name, err)
+		// Fall back to the default, which we know works
+		buffer.Reset()
+		template.Must(template.New(name).Parse(defaultMessageTemplates[name])).Execute(&buffer, data)
+	}
+
+	return buffer.String()
+}
+
+// Renders a template for each line of the text, for messages going to IRC
+func (templates messageTemplates) renderLines(name string, data *messageTemplateData) string {
+	lines := strings.Split(data.Text, "\n")
+	for i, line := range lines {
+		lineData := *data
+		lineData.Text = line
+		lines[i] = templates.render(name, &lineData)
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,97 @@
+package pino
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMessageTemplateOverrides(t *testing.T) {
+	global := map[string]string{
+		"join":   "{{.Nick}} joined",
+		"action": "* {{.Nick}} {{.Text}}",
+	}
+	channel := map[string]string{
+		"join": "{{.Nick}} is here",
+	}
+
+	templates, err := newMessageTemplates(global, channel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := &messageTemplateData{Nick: "alice", Usermask: "alice!a@example.com", Text: "waves", Reason: "bye"}
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		// Overridden for the channel, on top of the global override
+		{"join", "alice is here"},
+		// Overridden globally
+		{"action", "* alice waves"},
+		// Left alone
+		{"part", "> *alice* (alice!a@example.com) left the channel"},
+	}
+
+	for _, test := range tests {
+		if rendered := templates.render(test.name, data); rendered != test.expected {
+			t.Errorf("render(%v) = %q, expected %q", test.name, rendered, test.expected)
+		}
+	}
+}
+
+func TestMessageTemplateDefaults(t *testing.T) {
+	templates, err := newMessageTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		data     *messageTemplateData
+		expected string
+	}{
+		{"connected", &messageTemplateData{Server: "irc.example.net"}, "Connected to IRC on irc.example.net!"},
+		{"connected", &messageTemplateData{Server: "irc.example.net", Network: "libera"}, "[libera] Connected to IRC on irc.example.net!"},
+		{"away", &messageTemplateData{}, "Away from Slack"},
+		{"away", &messageTemplateData{Reason: "Lunch"}, "Lunch"},
+		{"channel-prefix", &messageTemplateData{Channel: "#go"}, "[#go] "},
+		{"owner-notice", &messageTemplateData{Server: "irc.example.net", Text: "hi"}, "Notice from irc.example.net: hi"},
+		{"owner-notice", &messageTemplateData{Nick: "NickServ", Text: "hi"}, "-NickServ- hi"},
+	}
+
+	for _, test := range tests {
+		if rendered := templates.render(test.name, test.data); rendered != test.expected {
+			t.Errorf("render(%v, %+v) = %q, expected %q", test.name, test.data, rendered, test.expected)
+		}
+	}
+}
+
+func TestMessageTemplateRenderLines(t *testing.T) {
+	templates, err := newMessageTemplates(map[string]string{"slack-message": "<{{.Nick}}> {{.Text}}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rendered := templates.renderLines("slack-message", &messageTemplateData{Nick: "bob", Text: "one\ntwo"})
+	if rendered != "<bob> one\n<bob> two" {
+		t.Errorf("Unexpected lines: %q", rendered)
+	}
+}
+
+func TestInvalidMessageTemplates(t *testing.T) {
+	tests := []struct {
+		overrides map[string]string
+		expected  string
+	}{
+		{map[string]string{"no-such-template": "hi"}, "Unknown template 'no-such-template'"},
+		{map[string]string{"join": "{{.Nick"}, "Could not parse template 'join'"},
+		{map[string]string{"join": "{{.NoSuchField}}"}, "Invalid template 'join'"},
+	}
+
+	for _, test := range tests {
+		_, err := newMessageTemplates(test.overrides)
+		if err == nil || !strings.HasPrefix(err.Error(), test.expected) {
+			t.Errorf("newMessageTemplates(%v) returned %v, expected %q", test.overrides, err, test.expected)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package pino
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	slackThreadsFilename = "slack-threads.json"
+	// How long replies in a day's thread still reach IRC after it's been rotated out
+	slackThreadRetention = 7 * 24 * time.Hour
+	// How long to wait for Slack to post the first message of a thread before trying again
+	slackThreadStartTimeout = time.Minute
+)
+
+// The day's thread for the IRC channel of a Threaded bridge
+type slackThread struct {
+	// See bridge.threadKey
+	Bridge string `json:"bridge"`
+	// Like "2016-10-18", in local time
+	Day string `json:"day"`
+	// The timestamp of the thread's first message, which Slack uses to identify the thread
+	Timestamp string    `json:"timestamp"`
+	Started   time.Time `json:"started"`
+}
+
+// A thread whose first message has been sent, but that Slack hasn't told us the timestamp of yet
+type startingSlackThread struct {
+	day     string
+	since   time.Time
+	waiting []func(threadTimestamp string)
+}
+
+// The slackThreadTracker keeps the daily thread of each IRC channel in a Slack channel with Threaded
+// bridges. Everything from IRC goes into today's thread, which is started on the first message of the day,
+// and replies in any thread from the last week go back to its IRC channel. Threads are remembered
+// across restarts, so Pino doesn't start a second one on the same day.
+type slackThreadTracker struct {
+	mutex sync.Mutex
+	// By timestamp
+	threads map[string]*slackThread
+	// By bridge
+	starting map[string]*startingSlackThread
+	state    *jsonStateFile
+}
+
+func newSlackThreadTracker(stateDirectory string) *slackThreadTracker {
+	tracker := &slackThreadTracker{
+		threads:  make(map[string]*slackThread),
+		starting: make(map[string]*startingSlackThread),
+	}
+	tracker.state = newJSONStateFile(stateDirectory, slackThreadsFilename, "Slack threads", &tracker.mutex, func() interface{} {
+		threads := make([]*slackThread, 0, len(tracker.threads))
+		for _, thread := range tracker.threads {
+			threads = append(threads, thread)
+		}
+		return threads
+	})
+
+	var threads []*slackThread
+	if tracker.state.load(&threads) {
+		for _, thread := range threads {
+			tracker.threads[thread.Timestamp] = thread
+		}
+	}
+
+	return tracker
+}
+
+// Calls send with the timestamp of the bridge's thread for today, starting the thread first if need be.
+// Messages sent while the thread is starting are held until Slack says where it is, and then sent in order.
+func (tracker *slackThreadTracker) post(bridge *bridge, send func(threadTimestamp string)) {
+	now := time.Now()
+	day := now.Local().Format("2006-01-02")
+	key := bridge.threadKey()
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	if thread := tracker.current(key, day); thread != nil {
+		send(thread.Timestamp)
+		return
+	}
+
+	starting, ok := tracker.starting[key]
+	if ok && starting.day == day && now.Sub(starting.since) < slackThreadStartTimeout {
+		starting.waiting = append(starting.waiting, send)
+		return
+	}
+
+	// Either there's no thread yet, or Slack never told us about the last try
+	if !ok || starting.day != day {
+		starting = &startingSlackThread{day: day}
+		tracker.starting[key] = starting
+	}
+	starting.since = now
+	starting.waiting = append(starting.waiting, send)
+
+	data := &messageTemplateData{Network: bridge.network.name, Channel: bridge.ircChannel, Time: now.Local().Format("Monday, January 2")}
+	bridge.slack.sendMessageAsBotWithCallback(bridge.slackChannel, bridge.render("thread-start", data), func(timestamp string) {
+		tracker.started(key, starting, timestamp)
+	})
+}
+
+// Called once Slack has posted the first message of a thread, or with an empty timestamp if it couldn't
+func (tracker *slackThreadTracker) started(key string, starting *startingSlackThread, timestamp string) {
+	tracker.mutex.Lock()
+	if timestamp != "" {
+		tracker.threads[timestamp] = &slackThread{Bridge: key, Day: starting.day, Timestamp: timestamp, Started: time.Now()}
+	} else {
+		// The messages go in the channel instead, and the next one tries to start the thread again
+		fmt.Printf("Could not start the Slack thread for %v, posting %v messages in the channel\n", key, len(starting.waiting))
+	}
+	if tracker.starting[key] == starting {
+		delete(tracker.starting, key)
+	}
+
+	// Sending only queues the messages up, so it's fine to do while holding the mutex
+	for _, send := range starting.waiting {
+		send(timestamp)
+	}
+	starting.waiting = nil
+
+	tracker.deleteOldThreads()
+	tracker.state.changed()
+	tracker.mutex.Unlock()
+
+	tracker.state.save()
+}
+
+// The bridge's thread for the day, if it's been started. The caller must hold the mutex.
+func (tracker *slackThreadTracker) current(key string, day string) *slackThread {
+	var current *slackThread
+	for _, thread := range tracker.threads {
+		// If a retry started a second thread, stick with the first
+		if thread.Bridge == key && thread.Day == day && (current == nil || thread.Started.Before(current.Started)) {
+			current = thread
+		}
+	}
+	return current
+}
+
+// The key of the bridge whose thread has the timestamp
+func (tracker *slackThreadTracker) bridgeKeyForThread(threadTimestamp string) (string, bool) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	thread, ok := tracker.threads[threadTimestamp]
+	if !ok {
+		return "", false
+	}
+	return thread.Bridge, true
+}
+
+// The caller must hold the mutex
+func (tracker *slackThreadTracker) deleteOldThreads() {
+	cutoff := time.Now().Add(-slackThreadRetention)
+	for timestamp, thread := range tracker.threads {
+		if thread.Started.Before(cutoff) {
+			delete(tracker.threads, timestamp)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package pino
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSlackThreadTrackerStartsADailyThread(t *testing.T) {
+	pino := &Pino{
+		bridgesBySlackChannel: make(map[SlackChannel][]*bridge),
+		threads:               newSlackThreadTracker(""),
+	}
+	api := newFakeSlackMessageAPI()
+	workspace := newTestSlackProxy(t, "", api, map[SlackChannel]string{"#irc": "C1"})
+	bridge := addTestBridge(t, pino, workspace, "#irc", newTestIRCNetwork(""), &BridgeConfig{IRCChannel: "#go", Threaded: true})
+
+	now := time.Now()
+	yesterday := now.AddDate(0, 0, -1)
+	lastMonth := now.AddDate(0, -1, 0)
+	pino.threads.threads["0.100"] = &slackThread{Bridge: bridge.threadKey(), Day: lastMonth.Local().Format("2006-01-02"), Timestamp: "0.100", Started: lastMonth}
+	pino.threads.threads["0.500"] = &slackThread{Bridge: bridge.threadKey(), Day: yesterday.Local().Format("2006-01-02"), Timestamp: "0.500", Started: yesterday}
+
+	// Yesterday's thread is done, so the first message of the day starts a new one
+	bridge.sendMessageAsBot("good morning")
+	posted := waitForSlackPosts(t, api, 2)
+	expectSlackPosts(t, posted[1:], []string{"good morning"})
+	expectSlackPosts(t, api.postedDestinations(), []string{"C1", "C1 1.000"})
+
+	// The rest of the day goes in the same thread
+	bridge.sendMessageAsUser("alice", "hi")
+	waitForSlackPosts(t, api, 3)
+	expectSlackPosts(t, api.postedDestinations(), []string{"C1", "C1 1.000", "C1 1.000"})
+
+	for _, test := range []struct {
+		timestamp string
+		kept      bool
+	}{
+		{"1.000", true},
+		// Replies to yesterday's thread still reach IRC
+		{"0.500", true},
+		// But not to last month's
+		{"0.100", false},
+	} {
+		if key, ok := pino.threads.bridgeKeyForThread(test.timestamp); ok != test.kept || (ok && key != bridge.threadKey()) {
+			t.Errorf("bridgeKeyForThread(%v) = %q, %v, expected kept: %v", test.timestamp, key, ok, test.kept)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package pino
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// The values of the IRCv3 +typing client tag
+const (
+	ircTypingActive = "active"
+	ircTypingPaused = "paused"
+	ircTypingDone   = "done"
+)
+
+const (
+	// Clients shouldn't say someone is typing more often than this
+	typingActiveInterval = 3 * time.Second
+	// After this long without a Slack typing event, the Slack user has paused
+	typingPauseTimeout = 6 * time.Second
+	// After this long paused, they've given up on the message
+	typingDoneTimeout = 30 * time.Second
+)
+
+// The typingRelay passes typing notifications between Slack and IRC.
+// Slack only tells us that someone is typing, so pauses and abandoned messages are
+// inferred from how long it's been since the last typing event.
+type typingRelay struct {
+	// Tells an IRC channel whether we're typing
+	sendTyping func(channel IRCChannel, typing string)
+
+	mutex sync.Mutex
+	// What we've told each IRC channel, keyed by lowercased channel
+	ircStates map[IRCChannel]*ircTypingState
+	// When we last showed a typing indicator in each Slack channel, by channel ID
+	slackIndicators map[string]time.Time
+}
+
+type ircTypingState struct {
+	state    string
+	lastSent time.Time
+	timer    *time.Timer
+}
+
+func newTypingRelay(sendTyping func(channel IRCChannel, typing string)) *typingRelay {
+	return &typingRelay{
+		sendTyping:      sendTyping,
+		ircStates:       make(map[IRCChannel]*ircTypingState),
+		slackIndicators: make(map[string]time.Time),
+	}
+}
+
+// Someone is typing in the Slack channel bridged to the IRC channel
+func (relay *typingRelay) slackUserTyping(channel IRCChannel) {
+	relay.mutex.Lock()
+
+	key := IRCChannel(strings.ToLower(string(channel)))
+	state, ok := relay.ircStates[key]
+	if !ok {
+		state = &ircTypingState{state: ircTypingDone}
+		relay.ircStates[key] = state
+	}
+
+	shouldSend := state.state != ircTypingActive || time.Since(state.lastSent) >= typingActiveInterval
+	if shouldSend {
+		state.update(ircTypingActive)
+	}
+
+	relay.schedule(channel, state, typingPauseTimeout, ircTypingPaused)
+	relay.mutex.Unlock()
+
+	// Sending can block on the connection, which shouldn't hold up anything waiting on our state
+	if shouldSend {
+		relay.sendTyping(channel, ircTypingActive)
+	}
+}
+
+// A message from Slack was relayed to the IRC channel, which ends any typing notification there
+func (relay *typingRelay) slackMessageSent(channel IRCChannel) {
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+
+	key := IRCChannel(strings.ToLower(string(channel)))
+	if state, ok := relay.ircStates[key]; ok {
+		if state.timer != nil {
+			state.timer.Stop()
+			state.timer = nil
+		}
+		delete(relay.ircStates, key)
+	}
+}
+
+// Someone in the IRC channel bridged to the Slack channel sent a +typing tag.
+// Slack can only show that the bot is typing, and only for a few seconds, so anything
+// other than "active" is left to expire on its own.
+func (relay *typingRelay) ircUserTyping(slackProxy *slackProxy, channel SlackChannel, typing string) {
+	if typing != ircTypingActive {
+		return
+	}
+
+	channelID := slackProxy.getChannelID(channel)
+
+	relay.mutex.Lock()
+	if time.Since(relay.slackIndicators[channelID]) < typingActiveInterval {
+		relay.mutex.Unlock()
+		return
+	}
+	relay.slackIndicators[channelID] = time.Now()
+	relay.mutex.Unlock()
+
+	slackProxy.sendTyping(channel)
+}
+
+// Records that we're telling the channel about the typing state. The caller must hold the mutex,
+// and send it once the mutex is released.
+func (state *ircTypingState) update(typing string) {
+	state.state = typing
+	state.lastSent = time.Now()
+}
+
+// Moves the channel on to the next typing state after the delay, unless something happens first.
+// The caller must hold the mutex.
+func (relay *typingRelay) schedule(channel IRCChannel, state *ircTypingState, delay time.Duration, next string) {
+	if state.timer != nil {
+		state.timer.Stop()
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		relay.mutex.Lock()
+		if state.timer != timer {
+			// Something else happened in the meantime
+			relay.mutex.Unlock()
+			return
+		}
+
+		state.update(next)
+		if next == ircTypingPaused {
+			relay.schedule(channel, state, typingDoneTimeout, ircTypingDone)
+		} else {
+			state.timer = nil
+		}
+		relay.mutex.Unlock()
+
+		relay.sendTyping(channel, next)
+	})
+	state.timer = timer
+}
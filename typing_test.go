@@ -0,0 +1,88 @@
+package pino
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Records what a typingRelay tells IRC, like "#chat active"
+type typingRecorder struct {
+	mutex sync.Mutex
+	sent  []string
+}
+
+func (recorder *typingRecorder) send(channel IRCChannel, typing string) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	recorder.sent = append(recorder.sent, fmt.Sprintf("%v %v", channel, typing))
+}
+
+func (recorder *typingRecorder) sentSoFar() string {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	return fmt.Sprint(recorder.sent)
+}
+
+func TestTypingRelayLimitsActiveNotifications(t *testing.T) {
+	recorder := &typingRecorder{}
+	relay := newTypingRelay(recorder.send)
+
+	relay.slackUserTyping("#chat")
+	// Slack sends these every few seconds while someone types, which is more often than IRC wants
+	relay.slackUserTyping("#Chat")
+	relay.slackUserTyping("#other")
+
+	if sent := recorder.sentSoFar(); sent != "[#chat active #other active]" {
+		t.Errorf("Unexpected typing notifications: %v", sent)
+	}
+}
+
+func TestTypingRelayStopsWhenTheMessageIsSent(t *testing.T) {
+	recorder := &typingRecorder{}
+	relay := newTypingRelay(recorder.send)
+
+	relay.slackUserTyping("#chat")
+	relay.slackMessageSent("#chat")
+
+	relay.mutex.Lock()
+	remaining := len(relay.ircStates)
+	relay.mutex.Unlock()
+	if remaining != 0 {
+		t.Errorf("Expected the typing state to be forgotten, got %v", remaining)
+	}
+
+	// The next message starts over
+	relay.slackUserTyping("#chat")
+	if sent := recorder.sentSoFar(); sent != "[#chat active #chat active]" {
+		t.Errorf("Unexpected typing notifications: %v", sent)
+	}
+
+	relay.slackMessageSent("#chat")
+}
+
+func TestTypingRelaySendsWithoutHoldingItsLock(t *testing.T) {
+	var relay *typingRelay
+	sent := make(chan string, 10)
+	relay = newTypingRelay(func(channel IRCChannel, typing string) {
+		// A slow connection shouldn't keep anyone else from using the relay
+		relay.slackMessageSent("#other")
+		sent <- typing
+	})
+
+	go relay.slackUserTyping("#chat")
+
+	select {
+	case typing := <-sent:
+		if typing != ircTypingActive {
+			t.Errorf("Expected %v, got %v", ircTypingActive, typing)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the typing notification to be sent without deadlocking")
+	}
+
+	relay.slackMessageSent("#chat")
+}